@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/mikhail-angelov/nginx-ui/app/server"
 )
@@ -21,10 +25,25 @@ func main() {
 	service := server.NewService(nginx, cert, config, embedFs)
 	web := server.NewWeb(nginx, service, config, embedFs)
 
-	log.Printf("Server started (dev:%s) on :%s port ✅", strconv.FormatBool(config.IsDev), config.Port)
-	// make sure to use the cert manager's HTTP handler is expose on 80 port for http-01 challenge
-	// .well-known/acme-challenge ... path
-	log.Panic(http.ListenAndServe(":"+config.Port, cert.GetCertManager().HTTPHandler(web.GetRouter())))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go service.Run(ctx)
+
+	// nginx owns port 80 and passes /.well-known/acme-challenge/ of every site
+	// to this listener, the cert manager's HTTP handler answers http-01 challenges
+	httpServer := &http.Server{Addr: ":" + config.Port, Handler: cert.HTTPHandler(web.GetRouter())}
+	go func() {
+		<-ctx.Done()
+		log.Printf("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
 
-	os.Exit(1)
+	log.Printf("Server started (dev:%s) on :%s port ✅", strconv.FormatBool(config.IsDev), config.Port)
+	err := httpServer.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Printf("Server failed: %v", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// acmeIssuer orders certificates from an ACME server (RFC 8555)
+type acmeIssuer struct {
+	client *acme.Client
+	email  string
+	// dns publishes dns-01 records, it is required for wildcard names
+	dns            DNSProvider
+	dnsPropagation time.Duration
+
+	// accountKeyPath is where the account key is kept between restarts
+	accountKeyPath string
+	// eab binds a new account to an existing account at the CA
+	eab *acme.ExternalAccountBinding
+
+	mu      sync.Mutex
+	account *acme.Account
+	tokens  map[string]string // http-01 token -> key authorization
+}
+
+func newAcmeIssuer(directoryURL string, email string, dns DNSProvider, dnsPropagation time.Duration) *acmeIssuer {
+	return &acmeIssuer{
+		client:         &acme.Client{DirectoryURL: directoryURL},
+		email:          email,
+		dns:            dns,
+		dnsPropagation: dnsPropagation,
+		tokens:         make(map[string]string),
+	}
+}
+
+// Obtain runs an ACME order for all domains: new-order, authorization of
+// every name, finalization with a CSR for a fresh key of keyType and
+// download of the full chain. Wildcard names are validated with dns-01
+// challenges and other names with http-01.
+func (a *acmeIssuer) Obtain(ctx context.Context, domains []string, keyType string) (*tls.Certificate, error) {
+	err := a.register(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := a.client.AuthorizeOrder(ctx, acme.DomainIDs(domains...))
+	if err != nil {
+		log.Printf("[ACME]: failed to create order for %v: %v", domains, err)
+		return nil, err
+	}
+	for _, authzURL := range order.AuthzURLs {
+		err = a.authorize(ctx, authzURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	order, err = a.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		log.Printf("[ACME]: order for %v is not ready: %v", domains, err)
+		return nil, err
+	}
+
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	der, _, err := a.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		log.Printf("[ACME]: failed to finalize order for %v: %v", domains, err)
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: der, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// register loads the account key and looks up the account of the key,
+// a new account is created on the first run
+func (a *acmeIssuer) register(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.account != nil {
+		return nil
+	}
+	if a.client.Key == nil {
+		key, err := a.loadAccountKey()
+		if err != nil {
+			return err
+		}
+		a.client.Key = key
+	}
+
+	account, err := a.client.GetReg(ctx, "")
+	if errors.Is(err, acme.ErrNoAccount) {
+		account = &acme.Account{}
+		if a.email != "" {
+			account.Contact = []string{"mailto:" + a.email}
+		}
+		account.ExternalAccountBinding = a.eab
+		account, err = a.client.Register(ctx, account, acme.AcceptTOS)
+		if err == nil {
+			log.Printf("[ACME]: registered account %s", account.URI)
+		}
+	}
+	if err != nil {
+		log.Printf("[ACME]: failed to register account: %v", err)
+		return err
+	}
+	a.account = account
+	return nil
+}
+
+// loadAccountKey reads the account key from disk or creates a new one
+func (a *acmeIssuer) loadAccountKey() (crypto.Signer, error) {
+	if a.accountKeyPath != "" {
+		content, err := os.ReadFile(a.accountKeyPath)
+		if err == nil {
+			return parsePrivateKey(content)
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("[ACME]: failed to read account key %s: %v", a.accountKeyPath, err)
+			return nil, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if a.accountKeyPath == "" {
+		return key, nil
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(a.accountKeyPath), 0700)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(a.accountKeyPath, keyPEM, 0600)
+	if err != nil {
+		log.Printf("[ACME]: failed to save account key %s: %v", a.accountKeyPath, err)
+		return nil, err
+	}
+	return key, nil
+}
+
+func (a *acmeIssuer) authorize(ctx context.Context, authzURL string) error {
+	authz, err := a.client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	challengeType := "http-01"
+	if authz.Wildcard {
+		challengeType = "dns-01"
+	}
+	var challenge *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == challengeType {
+			challenge = c
+			break
+		}
+	}
+	if challenge == nil {
+		return errors.New("no " + challengeType + " challenge offered for " + authz.Identifier.Value)
+	}
+
+	if challengeType == "dns-01" {
+		cleanup, err := a.presentDNS(ctx, authz.Identifier.Value, challenge.Token)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	} else {
+		keyAuth, err := a.client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			return err
+		}
+		a.setToken(challenge.Token, keyAuth)
+		defer a.setToken(challenge.Token, "")
+	}
+
+	_, err = a.client.Accept(ctx, challenge)
+	if err != nil {
+		return err
+	}
+	_, err = a.client.WaitAuthorization(ctx, authz.URI)
+	if err != nil {
+		log.Printf("[ACME]: authorization of %s failed: %v", authz.Identifier.Value, err)
+		return err
+	}
+	return nil
+}
+
+// presentDNS publishes the dns-01 record and waits for it to propagate,
+// the returned func removes the record
+func (a *acmeIssuer) presentDNS(ctx context.Context, domain string, token string) (func(), error) {
+	if a.dns == nil {
+		return nil, errors.New("dns-01 challenge for " + domain + " needs a DNS provider, see -dnsProvider")
+	}
+	value, err := a.client.DNS01ChallengeRecord(token)
+	if err != nil {
+		return nil, err
+	}
+	fqdn := challengeRecordName(domain)
+	err = a.dns.Present(ctx, fqdn, value)
+	if err != nil {
+		log.Printf("[ACME]: failed to publish %s: %v", fqdn, err)
+		return nil, err
+	}
+	cleanup := func() {
+		err := a.dns.CleanUp(context.Background(), fqdn, value)
+		if err != nil {
+			log.Printf("[ACME]: failed to remove %s: %v", fqdn, err)
+		}
+	}
+
+	select {
+	case <-time.After(a.dnsPropagation):
+	case <-ctx.Done():
+		cleanup()
+		return nil, ctx.Err()
+	}
+	return cleanup, nil
+}
+
+func (a *acmeIssuer) setToken(token string, keyAuth string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if keyAuth == "" {
+		delete(a.tokens, token)
+		return
+	}
+	a.tokens[token] = keyAuth
+}
+
+// HTTPHandler answers http-01 challenges of running orders and passes other requests to fallback
+func (a *acmeIssuer) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			token := strings.TrimPrefix(r.URL.Path, acmeChallengePath)
+			a.mu.Lock()
+			keyAuth, ok := a.tokens[token]
+			a.mu.Unlock()
+			if ok {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte(keyAuth))
+				return
+			}
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// acmeContext limits an order to 5 minutes, it ends earlier with ctx
+func acmeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, 5*time.Minute)
+}
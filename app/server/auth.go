@@ -9,13 +9,16 @@ import (
 )
 
 const cookieName = "jwt"
+
+// RoleAdmin is the role of the account configured with -email and -pass
+const RoleAdmin = "admin"
 var secretKey = []byte("secret-key-from-env-file")
 
-func SetAuthCookie(w http.ResponseWriter, email string) {
-	token, _ := createToken(email)
+func SetAuthCookie(w http.ResponseWriter, email string, role string) {
+	token, _ := createToken(email, role)
 	// fmt.Println("token: ", token, "err: ", err)
 	expiration := time.Now().Add(365 * 24 * time.Hour)
-	cookie := http.Cookie{Name: cookieName, Value: token, Expires: expiration, MaxAge: 86400, HttpOnly: true}
+	cookie := http.Cookie{Name: cookieName, Value: token, Expires: expiration, MaxAge: 86400, HttpOnly: true, SameSite: http.SameSiteLaxMode}
 	http.SetCookie(w, &cookie)
 }
 
@@ -32,10 +35,11 @@ func GetAuthCookie(r *http.Request) (map[string]string, error) {
 	return verifyToken(cookie.Value)
 }
 
-func createToken(username string) (string, error) {
+func createToken(username string, role string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
 		jwt.MapClaims{
 			"username": username,
+			"role":     role,
 			"exp":      time.Now().Add(time.Hour * 24).Unix(),
 		})
 
@@ -61,6 +65,8 @@ func verifyToken(tokenString string) (map[string]string, error) {
 	}
 	claim:=make(map[string]string)
 	claim["username"]=token.Claims.(jwt.MapClaims)["username"].(string)
+	// tokens issued before roles were added have none
+	claim["role"], _ = token.Claims.(jwt.MapClaims)["role"].(string)
 
 	return claim, nil
 }
@@ -0,0 +1,672 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+const (
+	backupSettingsFile = "backup.json"
+	backupManifestName = "manifest.json"
+	// backupFilesDir is the directory of ConfigDir files in the archive
+	backupFilesDir   = "config/"
+	backupPrefix     = "nginx-ui-backup-"
+	backupTimeFormat = "20060102T150405Z"
+	restoreDirPrefix = ".nginx-ui-restore-"
+	ageHeader        = "age-encryption.org/v1"
+)
+
+// BackupManifest lists the files of a backup with their checksums
+type BackupManifest struct {
+	Version   int          `json:"version"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Domains   []string     `json:"domains"`
+	Files     []BackupFile `json:"files"`
+}
+
+// BackupFile is a file of ConfigDir in a backup, Path is relative and uses slashes
+type BackupFile struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   fs.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// Backup is an archive of ConfigDir, encrypted with age when a passphrase is given
+type Backup struct {
+	Name      string
+	Content   []byte
+	Checksum  string
+	Encrypted bool
+	Manifest  *BackupManifest
+}
+
+// RestorePlan is what a restore changes in ConfigDir
+type RestorePlan struct {
+	Manifest  *BackupManifest `json:"manifest"`
+	Added     []string        `json:"added"`
+	Changed   []string        `json:"changed"`
+	Removed   []string        `json:"removed"`
+	Unchanged int             `json:"unchanged"`
+}
+
+// backupExcluded reports whether a path relative to ConfigDir is left out of
+// backups and untouched by restores: the trash, stored backups, backup
+// settings with storage credentials, restore leftovers and temp files
+func (s *Service) backupExcluded(rel string) bool {
+	top := strings.SplitN(rel, "/", 2)[0]
+	if top == backupSettingsFile || strings.HasPrefix(top, restoreDirPrefix) || strings.HasSuffix(rel, ".tmp") {
+		return true
+	}
+	for _, dir := range []string{s.trashDir, s.backupDir()} {
+		if dir == "" {
+			continue
+		}
+		excluded, err := filepath.Rel(s.configDir, dir)
+		if err == nil && !strings.HasPrefix(excluded, "..") && (rel == filepath.ToSlash(excluded) || strings.HasPrefix(rel, filepath.ToSlash(excluded)+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// managedFiles returns the contents of the backed up files of ConfigDir by relative path
+func (s *Service) managedFiles() (map[string]BackupFile, error) {
+	files := make(map[string]BackupFile)
+	err := filepath.WalkDir(s.configDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.configDir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if s.backupExcluded(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			if d.Type()&fs.ModeSymlink != 0 {
+				log.Printf("Backup skips symlink %s", rel)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		files[rel] = BackupFile{Path: rel, Size: int64(len(content)), Mode: info.Mode().Perm(), SHA256: hex.EncodeToString(sum[:])}
+		return nil
+	})
+	return files, err
+}
+
+// CreateBackup archives ConfigDir as tar.gz with a manifest, a non empty passphrase encrypts it with age
+func (s *Service) CreateBackup(passphrase string) (*Backup, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.managedFiles()
+	if err != nil {
+		log.Printf("Failed to list files for backup: %v", err)
+		return nil, err
+	}
+	now := time.Now().UTC()
+	manifest := &BackupManifest{Version: 1, CreatedAt: now, Domains: append([]string{}, s.domains...)}
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, file)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+	manifestContent, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	err = writeTarFile(tw, backupManifestName, manifestContent, 0644, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range manifest.Files {
+		content, err := os.ReadFile(filepath.Join(s.configDir, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return nil, err
+		}
+		if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != file.SHA256 {
+			return nil, errors.New(file.Path + " changed during backup, try again")
+		}
+		err = writeTarFile(tw, backupFilesDir+file.Path, content, int64(file.Mode), now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+
+	backup := &Backup{Name: backupPrefix + now.Format(backupTimeFormat) + ".tar.gz", Content: buf.Bytes(), Manifest: manifest}
+	if passphrase != "" {
+		backup.Content, err = encryptBackup(backup.Content, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		backup.Name += ".age"
+		backup.Encrypted = true
+	}
+	sum := sha256.Sum256(backup.Content)
+	backup.Checksum = hex.EncodeToString(sum[:])
+	log.Printf("Backup %s is created with %d files", backup.Name, len(manifest.Files))
+	return backup, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte, mode int64, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: int64(len(content)), ModTime: modTime, Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+func encryptBackup(content []byte, passphrase string) ([]byte, error) {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(content); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readBackup decrypts and unpacks a backup, every file is checked against the manifest
+func readBackup(data []byte, passphrase string) (*BackupManifest, map[string][]byte, error) {
+	if bytes.HasPrefix(data, []byte(ageHeader)) {
+		if passphrase == "" {
+			return nil, nil, errors.New("Backup is encrypted, the passphrase is required")
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+		r, err := age.Decrypt(bytes.NewReader(data), identity)
+		if err != nil {
+			return nil, nil, errors.New("Failed to decrypt the backup, check the passphrase")
+		}
+		data, err = io.ReadAll(r)
+		if err != nil {
+			return nil, nil, errors.New("Backup is corrupted: " + err.Error())
+		}
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, errors.New("Not a backup archive")
+	}
+	tr := tar.NewReader(gz)
+	var manifest *BackupManifest
+	contents := make(map[string][]byte)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, errors.New("Backup is corrupted: " + err.Error())
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, errors.New("Backup is corrupted: " + err.Error())
+		}
+		switch {
+		case header.Name == backupManifestName:
+			manifest = &BackupManifest{}
+			if err := json.Unmarshal(content, manifest); err != nil {
+				return nil, nil, errors.New("Backup manifest is invalid")
+			}
+		case strings.HasPrefix(header.Name, backupFilesDir) && header.Typeflag == tar.TypeReg:
+			contents[strings.TrimPrefix(header.Name, backupFilesDir)] = content
+		default:
+			return nil, nil, errors.New("Unexpected entry " + header.Name + " in backup")
+		}
+	}
+	if manifest == nil {
+		return nil, nil, errors.New("Backup has no manifest")
+	}
+	if manifest.Version != 1 {
+		return nil, nil, fmt.Errorf("Backup version %d is not supported", manifest.Version)
+	}
+	if len(contents) != len(manifest.Files) {
+		return nil, nil, errors.New("Backup files don't match the manifest")
+	}
+	for _, file := range manifest.Files {
+		if file.Path != path.Clean(file.Path) || path.IsAbs(file.Path) || strings.HasPrefix(file.Path, "../") || file.Path == ".." {
+			return nil, nil, errors.New("Backup has an unsafe path " + file.Path)
+		}
+		content, ok := contents[file.Path]
+		if !ok {
+			return nil, nil, errors.New("Backup is missing " + file.Path)
+		}
+		if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != file.SHA256 {
+			return nil, nil, errors.New("Checksum of " + file.Path + " does not match")
+		}
+	}
+	return manifest, contents, nil
+}
+
+// planRestore compares a backup with ConfigDir
+func (s *Service) planRestore(manifest *BackupManifest) (*RestorePlan, error) {
+	current, err := s.managedFiles()
+	if err != nil {
+		return nil, err
+	}
+	plan := &RestorePlan{Manifest: manifest}
+	for _, file := range manifest.Files {
+		existing, ok := current[file.Path]
+		switch {
+		case !ok:
+			plan.Added = append(plan.Added, file.Path)
+		case existing.SHA256 != file.SHA256 || existing.Mode != file.Mode:
+			plan.Changed = append(plan.Changed, file.Path)
+		default:
+			plan.Unchanged++
+		}
+		delete(current, file.Path)
+	}
+	for rel := range current {
+		plan.Removed = append(plan.Removed, rel)
+	}
+	sort.Strings(plan.Removed)
+	return plan, nil
+}
+
+// PreviewRestore validates a backup and returns what restoring it would change
+func (s *Service) PreviewRestore(data []byte, passphrase string) (*RestorePlan, error) {
+	manifest, _, err := readBackup(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.planRestore(manifest)
+}
+
+// Restore replaces ConfigDir with a backup. The current files are moved
+// aside first and put back if the restored config fails nginx -t.
+func (s *Service) Restore(data []byte, passphrase string) (*RestorePlan, error) {
+	manifest, contents, err := readBackup(data, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range manifest.Files {
+		if s.backupExcluded(file.Path) {
+			return nil, errors.New("Backup has " + file.Path + " which is not restored")
+		}
+	}
+	plan, err := s.planRestore(manifest)
+	if err != nil {
+		return nil, err
+	}
+	rollbackDir := filepath.Join(s.configDir, restoreDirPrefix+time.Now().UTC().Format(backupTimeFormat))
+	err = os.Mkdir(rollbackDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// top level entries are moved as a whole, excluded ones stay in place
+	entries, err := os.ReadDir(s.configDir)
+	if err != nil {
+		return nil, err
+	}
+	var moved []string
+	rollback := func() {
+		for _, file := range manifest.Files {
+			top := strings.SplitN(file.Path, "/", 2)[0]
+			os.RemoveAll(filepath.Join(s.configDir, top))
+		}
+		for _, name := range moved {
+			os.Rename(filepath.Join(rollbackDir, name), filepath.Join(s.configDir, name))
+		}
+		os.RemoveAll(rollbackDir)
+	}
+	for _, entry := range entries {
+		if s.backupExcluded(entry.Name()) {
+			continue
+		}
+		err = os.Rename(filepath.Join(s.configDir, entry.Name()), filepath.Join(rollbackDir, entry.Name()))
+		if err != nil {
+			log.Printf("Failed to move %s aside for restore: %v", entry.Name(), err)
+			rollback()
+			return nil, err
+		}
+		moved = append(moved, entry.Name())
+	}
+
+	for _, file := range manifest.Files {
+		target := filepath.Join(s.configDir, filepath.FromSlash(file.Path))
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err == nil {
+			err = os.WriteFile(target, contents[file.Path], file.Mode.Perm())
+		}
+		if err != nil {
+			log.Printf("Failed to restore %s: %v", file.Path, err)
+			rollback()
+			return nil, err
+		}
+	}
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Restored config is invalid, rolling back: %v", err)
+		rollback()
+		return nil, err
+	}
+
+	os.MkdirAll(s.cacheDir, 0755)
+	domains, err := getDirectories(s.cacheDir)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	s.domains = domains
+	s.resetCAs()
+	os.RemoveAll(rollbackDir)
+	log.Printf("Backup of %s is restored: %d added, %d changed, %d removed", manifest.CreatedAt.Format(time.RFC3339), len(plan.Added), len(plan.Changed), len(plan.Removed))
+
+	return plan, s.nginx.Reload()
+}
+
+// stagedRestore keeps an uploaded backup between preview and confirmation
+type stagedRestore struct {
+	token      string
+	data       []byte
+	passphrase string
+	expires    time.Time
+}
+
+const stagedRestoreLifetime = 30 * time.Minute
+
+// StageRestore validates a backup and keeps it until RestoreStaged is called
+// with the returned token, a new upload replaces the staged one
+func (s *Service) StageRestore(data []byte, passphrase string) (string, *RestorePlan, error) {
+	plan, err := s.PreviewRestore(data, passphrase)
+	if err != nil {
+		return "", nil, err
+	}
+	random := make([]byte, 16)
+	if _, err = rand.Read(random); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(random)
+	s.mu.Lock()
+	s.stagedRestore = &stagedRestore{token: token, data: data, passphrase: passphrase, expires: time.Now().Add(stagedRestoreLifetime)}
+	s.mu.Unlock()
+	return token, plan, nil
+}
+
+// RestoreStaged restores the backup staged with token
+func (s *Service) RestoreStaged(token string) (*RestorePlan, error) {
+	s.mu.Lock()
+	staged := s.stagedRestore
+	if staged == nil || staged.token != token || time.Now().After(staged.expires) {
+		s.mu.Unlock()
+		return nil, errors.New("Backup upload is expired, upload it again")
+	}
+	s.stagedRestore = nil
+	s.mu.Unlock()
+	return s.Restore(staged.data, staged.passphrase)
+}
+
+// resetCAs drops CA roots cached in memory, so restored ones are used
+func (s *Service) resetCAs() {
+	if s.cert != nil && s.cert.local != nil {
+		s.cert.local.reset()
+	}
+	if s.clientCA != nil {
+		s.clientCA.authority.reset()
+	}
+}
+
+// BackupSettings configure scheduled backups, stored as backup.json in ConfigDir
+type BackupSettings struct {
+	// IntervalHours between scheduled backups, 0 disables them
+	IntervalHours int `json:"intervalHours,omitempty"`
+	// Retention is how many backups are kept, older ones are deleted
+	Retention int `json:"retention,omitempty"`
+	// Passphrase encrypts scheduled backups with age when set
+	Passphrase string `json:"passphrase,omitempty"`
+	// Storage is "local" for Directory or "s3"
+	Storage   string   `json:"storage,omitempty"`
+	Directory string   `json:"directory,omitempty"`
+	S3        S3Config `json:"s3"`
+}
+
+const (
+	BackupStorageLocal = "local"
+	BackupStorageS3    = "s3"
+)
+
+const defaultBackupRetention = 7
+
+// GetBackupSettings returns the scheduled backup settings
+func (s *Service) GetBackupSettings() (*BackupSettings, error) {
+	settings := &BackupSettings{Storage: BackupStorageLocal, Retention: defaultBackupRetention}
+	content, err := os.ReadFile(filepath.Join(s.configDir, backupSettingsFile))
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, settings)
+	if err != nil {
+		log.Printf("Failed to parse %s: %v", backupSettingsFile, err)
+		return nil, err
+	}
+	return settings, nil
+}
+
+// SaveBackupSettings validates and stores the scheduled backup settings
+func (s *Service) SaveBackupSettings(settings *BackupSettings) error {
+	if settings.IntervalHours < 0 || settings.Retention < 0 {
+		return errors.New("Interval and retention can't be negative")
+	}
+	if settings.Retention == 0 {
+		settings.Retention = defaultBackupRetention
+	}
+	switch settings.Storage {
+	case BackupStorageLocal:
+	case BackupStorageS3:
+		if settings.S3.Bucket == "" || settings.S3.AccessKey == "" || settings.S3.SecretKey == "" {
+			return errors.New("S3 bucket and credentials are required")
+		}
+	default:
+		return errors.New("Unknown backup storage " + settings.Storage)
+	}
+	content, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the file has the passphrase and S3 credentials
+	return writeFileAtomic(filepath.Join(s.configDir, backupSettingsFile), content, 0600)
+}
+
+// backupDir is where local backups are stored
+func (s *Service) backupDir() string {
+	content, err := os.ReadFile(filepath.Join(s.configDir, backupSettingsFile))
+	if err == nil {
+		settings := &BackupSettings{}
+		if json.Unmarshal(content, settings) == nil && settings.Directory != "" {
+			return settings.Directory
+		}
+	}
+	return filepath.Join(s.configDir, "backups")
+}
+
+// backupStoreFor returns the storage of scheduled backups
+func (s *Service) backupStoreFor(settings *BackupSettings) backupStore {
+	if settings.Storage == BackupStorageS3 {
+		return newS3Store(settings.S3)
+	}
+	return &localStore{dir: s.backupDir()}
+}
+
+// StoredBackup is a backup in the configured storage
+type StoredBackup struct {
+	Name      string
+	CreatedAt time.Time
+}
+
+// ListStoredBackups returns the stored backups, the latest first
+func (s *Service) ListStoredBackups() ([]StoredBackup, error) {
+	settings, err := s.GetBackupSettings()
+	if err != nil {
+		return nil, err
+	}
+	names, err := s.backupStoreFor(settings).List()
+	if err != nil {
+		return nil, err
+	}
+	var backups []StoredBackup
+	for _, name := range names {
+		if created, ok := backupTime(name); ok {
+			backups = append(backups, StoredBackup{Name: name, CreatedAt: created})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	return backups, nil
+}
+
+// GetStoredBackup downloads a stored backup and checks it against its checksum file
+func (s *Service) GetStoredBackup(name string) ([]byte, error) {
+	if _, ok := backupTime(name); !ok {
+		return nil, errors.New("Invalid backup name " + name)
+	}
+	settings, err := s.GetBackupSettings()
+	if err != nil {
+		return nil, err
+	}
+	store := s.backupStoreFor(settings)
+	content, err := store.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := store.Get(name + ".sha256")
+	if err == nil {
+		sum := sha256.Sum256(content)
+		if fields := strings.Fields(string(checksum)); len(fields) == 0 || fields[0] != hex.EncodeToString(sum[:]) {
+			return nil, errors.New("Checksum of " + name + " does not match")
+		}
+	}
+	return content, nil
+}
+
+// StoreBackup creates a backup with the scheduled backup settings, stores it
+// with a checksum file and deletes the backups beyond the retention
+func (s *Service) StoreBackup() (*Backup, error) {
+	settings, err := s.GetBackupSettings()
+	if err != nil {
+		return nil, err
+	}
+	backup, err := s.CreateBackup(settings.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	store := s.backupStoreFor(settings)
+	err = store.Put(backup.Name, backup.Content)
+	if err == nil {
+		err = store.Put(backup.Name+".sha256", []byte(backup.Checksum+"  "+backup.Name+"\n"))
+	}
+	if err != nil {
+		log.Printf("Failed to store backup %s: %v", backup.Name, err)
+		return nil, err
+	}
+
+	backups, err := s.ListStoredBackups()
+	if err != nil {
+		return backup, nil
+	}
+	for i := settings.Retention; i < len(backups); i++ {
+		store.Delete(backups[i].Name)
+		store.Delete(backups[i].Name + ".sha256")
+		log.Printf("Backup %s is deleted by retention", backups[i].Name)
+	}
+	return backup, nil
+}
+
+// runBackups stores a backup whenever the latest one is older than the interval
+func (s *Service) runBackups(ctx context.Context) {
+	for {
+		if settings, err := s.GetBackupSettings(); err == nil && settings.IntervalHours > 0 {
+			backups, err := s.ListStoredBackups()
+			interval := time.Duration(settings.IntervalHours) * time.Hour
+			if err == nil && (len(backups) == 0 || time.Since(backups[0].CreatedAt) >= interval) {
+				if _, err := s.StoreBackup(); err != nil {
+					s.notify(EventBackupFailed, "", err.Error())
+				}
+			} else if err != nil {
+				log.Printf("Failed to list backups: %v", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Hour):
+		}
+	}
+}
+
+// backupTime parses the creation time from a backup name
+func backupTime(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupPrefix) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimPrefix(name, backupPrefix)
+	if !strings.HasSuffix(stamp, ".tar.gz") && !strings.HasSuffix(stamp, ".tar.gz.age") {
+		return time.Time{}, false
+	}
+	stamp = strings.SplitN(stamp, ".", 2)[0]
+	created, err := time.Parse(backupTimeFormat, stamp)
+	return created, err == nil
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupStore keeps backup archives by name
+type backupStore interface {
+	Put(name string, content []byte) error
+	Get(name string) ([]byte, error)
+	List() ([]string, error)
+	Delete(name string) error
+}
+
+// localStore keeps backups in a directory
+type localStore struct {
+	dir string
+}
+
+func (l *localStore) Put(name string, content []byte) error {
+	err := os.MkdirAll(l.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(l.dir, name), content, 0600)
+}
+
+func (l *localStore) Get(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(l.dir, filepath.Base(name)))
+}
+
+func (l *localStore) List() ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (l *localStore) Delete(name string) error {
+	return os.Remove(filepath.Join(l.dir, filepath.Base(name)))
+}
+
+// S3Config is an S3 compatible bucket, e.g. AWS S3 or MinIO
+type S3Config struct {
+	// Endpoint like https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+}
+
+// s3Store keeps backups in a bucket with path style requests signed with AWS Signature Version 4
+type s3Store struct {
+	config S3Config
+	client *http.Client
+	now    func() time.Time
+}
+
+func newS3Store(config S3Config) *s3Store {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = "https://s3." + config.Region + ".amazonaws.com"
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &s3Store{config: config, client: &http.Client{Timeout: 5 * time.Minute}, now: time.Now}
+}
+
+func (s3 *s3Store) objectURL(name string) string {
+	return s3.config.Endpoint + "/" + s3.config.Bucket + "/" + s3.config.Prefix + name
+}
+
+func (s3 *s3Store) Put(name string, content []byte) error {
+	_, err := s3.do(http.MethodPut, s3.objectURL(name), content)
+	return err
+}
+
+func (s3 *s3Store) Get(name string) ([]byte, error) {
+	return s3.do(http.MethodGet, s3.objectURL(name), nil)
+}
+
+func (s3 *s3Store) Delete(name string) error {
+	_, err := s3.do(http.MethodDelete, s3.objectURL(name), nil)
+	return err
+}
+
+// List returns the names under the prefix, following continuation tokens
+func (s3 *s3Store) List() ([]string, error) {
+	var names []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {s3.config.Prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := s3.do(http.MethodGet, s3.config.Endpoint+"/"+s3.config.Bucket+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.Unmarshal(body, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, s3.config.Prefix)
+			if !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return names, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s3 *s3Store) do(method string, rawURL string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	signV4(req, body, s3.config.AccessKey, s3.config.SecretKey, s3.config.Region, "s3", s3.now())
+	resp, err := s3.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		if xml.Unmarshal(content, &s3Err) == nil && s3Err.Code != "" {
+			return nil, errors.New("S3 " + method + " failed: " + s3Err.Code + " " + s3Err.Message)
+		}
+		return nil, errors.New("S3 " + method + " failed: " + resp.Status)
+	}
+	return content, nil
+}
+
+// signV4 adds AWS Signature Version 4 headers to req. Host, x-amz-* and
+// the content and range headers of the request are signed.
+func signV4(req *http.Request, body []byte, accessKey string, secretKey string, region string, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "content-md5" || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// s3EscapePath encodes every path segment once, S3 doesn't double encode paths
+func s3EscapePath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = awsEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything except unreserved characters as SigV4 requires
+func awsEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+const (
+	BulkModeText      = "text"
+	BulkModeRegex     = "regex"
+	BulkModeDirective = "directive"
+)
+
+// BulkReplace describes a find-and-replace over several site configs.
+// In directive mode Directive is the directive name, Find is an optional
+// current value to match and Replace is the new value of the directive.
+type BulkReplace struct {
+	Domains   []string
+	Mode      string
+	Directive string
+	Find      string
+	Replace   string
+}
+
+// BulkChange is the result of a bulk replace for a single site config
+type BulkChange struct {
+	Domain  string
+	Before  string
+	After   string
+	Diff    string
+	Matches int
+}
+
+// PreviewBulkReplace returns the changes a bulk replace would make without touching the files
+func (s *Service) PreviewBulkReplace(req BulkReplace) ([]BulkChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.prepareBulkReplace(req)
+}
+
+// ApplyBulkReplace writes all changed configs, validates the whole tree once
+// with nginx -t and rolls every file back if validation fails.
+func (s *Service) ApplyBulkReplace(req BulkReplace) ([]BulkChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes, err := s.prepareBulkReplace(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) == 0 {
+		return changes, nil
+	}
+
+	var written []BulkChange
+	rollback := func() {
+		for _, change := range written {
+			err := s.nginx.writeConfig(change.Domain, change.Before)
+			if err != nil {
+				log.Printf("Failed to roll back config for %s: %v", change.Domain, err)
+			}
+		}
+	}
+	for _, change := range changes {
+		err := s.nginx.writeConfig(change.Domain, change.After)
+		if err != nil {
+			rollback()
+			return changes, err
+		}
+		written = append(written, change)
+	}
+
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Bulk replace produced invalid config, rolling back %d files: %v", len(written), err)
+		rollback()
+		return changes, err
+	}
+	s.nginx.RefreshConfig()
+	log.Printf("Bulk replace applied to %d configs", len(changes))
+
+	return changes, nil
+}
+
+func (s *Service) prepareBulkReplace(req BulkReplace) ([]BulkChange, error) {
+	replace, err := newBulkReplacer(req)
+	if err != nil {
+		return nil, err
+	}
+
+	domains := req.Domains
+	if len(domains) == 0 || contains(domains, "*") {
+		domains = s.domains
+	}
+
+	var changes []BulkChange
+	for _, domain := range domains {
+		if !contains(s.domains, domain) {
+			return nil, fmt.Errorf("domain %s does not exist", domain)
+		}
+		before, err := s.nginx.GetConfig(domain)
+		if err != nil {
+			log.Printf("Failed to read config for %s: %v", domain, err)
+			return nil, err
+		}
+		after, matches, err := replace(before)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", domain, err)
+		}
+		if matches == 0 || after == before {
+			continue
+		}
+		changes = append(changes, BulkChange{
+			Domain:  domain,
+			Before:  before,
+			After:   after,
+			Diff:    diffLines(before, after),
+			Matches: matches,
+		})
+	}
+
+	return changes, nil
+}
+
+func newBulkReplacer(req BulkReplace) (func(string) (string, int, error), error) {
+	switch req.Mode {
+	case BulkModeText, "":
+		if req.Find == "" {
+			return nil, errors.New("search text is required")
+		}
+		return func(content string) (string, int, error) {
+			matches := strings.Count(content, req.Find)
+			return strings.ReplaceAll(content, req.Find, req.Replace), matches, nil
+		}, nil
+	case BulkModeRegex:
+		re, err := regexp.Compile(req.Find)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %v", err)
+		}
+		return func(content string) (string, int, error) {
+			matches := len(re.FindAllStringIndex(content, -1))
+			return re.ReplaceAllString(content, req.Replace), matches, nil
+		}, nil
+	case BulkModeDirective:
+		if req.Directive == "" {
+			return nil, errors.New("directive name is required")
+		}
+		return func(content string) (string, int, error) {
+			return replaceDirective(content, req.Directive, req.Find, req.Replace)
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown replace mode %s", req.Mode)
+}
+
+// replaceDirective sets the value of every directive with the given name.
+// When match is not empty only directives with exactly that value are changed.
+func replaceDirective(content string, name string, match string, value string) (string, int, error) {
+	directives, err := parseNginxConfig(content)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var found []*confDirective
+	walkConfDirectives(directives, nil, func(d *confDirective, parents []string) {
+		if d.name != name || d.block {
+			return
+		}
+		if match != "" && strings.Join(d.args, " ") != match {
+			return
+		}
+		found = append(found, d)
+	})
+
+	// rewrite from the end so that offsets of earlier directives stay valid
+	result := content
+	for i := len(found) - 1; i >= 0; i-- {
+		d := found[i]
+		args := value
+		if d.argsStart == d.argsEnd {
+			args = " " + value
+		}
+		result = result[:d.argsStart] + args + result[d.argsEnd:]
+	}
+
+	return result, len(found), nil
+}
+
+// diffLines returns a unified style line diff of two texts with 3 lines of context
+func diffLines(before string, after string) string {
+	a := strings.Split(before, "\n")
+	b := strings.Split(after, "\n")
+
+	// longest common subsequence table
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type diffLine struct {
+		op   byte
+		text string
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+
+	const context = 3
+	var out strings.Builder
+	lastPrinted := -1
+	for k, line := range lines {
+		if line.op == ' ' {
+			continue
+		}
+		from := max(k-context, lastPrinted+1)
+		if lastPrinted >= 0 && from > lastPrinted+1 {
+			out.WriteString("...\n")
+		}
+		to := min(k+context, len(lines)-1)
+		for n := from; n <= to; n++ {
+			if n > lastPrinted {
+				out.WriteByte(lines[n].op)
+				out.WriteString(lines[n].text)
+				out.WriteByte('\n')
+				lastPrinted = n
+			}
+		}
+	}
+
+	return out.String()
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const bulkTestConfig = `server {
+    listen   443 ssl;
+    server_name example.com;
+
+    location / {
+        proxy_pass http://10.0.0.1:3000; # backend
+    }
+    location /api {
+        proxy_pass "http://10.0.0.2:3000";
+    }
+}`
+
+func TestReplaceDirective(t *testing.T) {
+	result, matches, err := replaceDirective(bulkTestConfig, "proxy_pass", "", "http://10.0.0.9:3000")
+	assert.NoError(t, err, "Expected no error from replaceDirective")
+	assert.Equal(t, 2, matches, "Expected both proxy_pass directives to match")
+	assert.Contains(t, result, "proxy_pass http://10.0.0.9:3000; # backend", "Expected comment to be preserved")
+	assert.NotContains(t, result, "10.0.0.2", "Expected quoted value to be replaced")
+
+	result, matches, err = replaceDirective(bulkTestConfig, "proxy_pass", "http://10.0.0.2:3000", "http://10.0.0.9:3000")
+	assert.NoError(t, err, "Expected no error from replaceDirective")
+	assert.Equal(t, 1, matches, "Expected only the matching directive to be replaced")
+	assert.Contains(t, result, "http://10.0.0.1:3000", "Expected other directive to stay untouched")
+}
+
+func TestReplaceDirectiveInvalidConfig(t *testing.T) {
+	_, _, err := replaceDirective("server { listen 80;", "listen", "", "8080")
+	assert.Error(t, err, "Expected error for unbalanced braces")
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := diffLines("a\nb\nc", "a\nB\nc")
+	assert.Equal(t, " a\n-b\n+B\n c\n", diff, "Expected changed line with context")
+	assert.Equal(t, "", diffLines("a\nb", "a\nb"), "Expected empty diff for equal texts")
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	CALetsEncrypt        = "letsencrypt"
+	CALetsEncryptStaging = "letsencrypt-staging"
+)
+
+// knownCAs are ACME directories which can be referenced by name
+var knownCAs = map[string]string{
+	CALetsEncrypt:        "https://acme-v02.api.letsencrypt.org/directory",
+	CALetsEncryptStaging: "https://acme-staging-v02.api.letsencrypt.org/directory",
+	"zerossl":            "https://acme.zerossl.com/v2/DV90",
+	"google":             "https://dv.acme-v02.api.pki.goog/directory",
+	"google-staging":     "https://dv.acme-v02.test-api.pki.goog/directory",
+	"buypass":            "https://api.buypass.com/acme/directory",
+	"buypass-staging":    "https://api.test4.buypass.no/acme/directory",
+}
+
+// CAConfig describes an ACME certificate authority
+type CAConfig struct {
+	Name string `json:"name"`
+	// Directory is the ACME directory URL, it may be empty for known CAs
+	Directory string `json:"directory,omitempty"`
+	// EABKeyID and EABHMACKey are External Account Binding credentials,
+	// required by ZeroSSL and Google Trust Services. The key is base64url encoded.
+	EABKeyID   string `json:"eabKid,omitempty"`
+	EABHMACKey string `json:"eabHmacKey,omitempty"`
+	// Email overrides -email for the account contact
+	Email string `json:"email,omitempty"`
+	// Roots is a PEM file with roots trusted for the directory HTTPS, for private CAs like step-ca or Pebble
+	Roots string `json:"roots,omitempty"`
+}
+
+// loadCAConfigs returns the CAs from -acmeCAs and the default CA from
+// -acmeCA. Without -acmeCA the default is Let's Encrypt, staging in dev mode.
+func loadCAConfigs(config *Config) ([]CAConfig, string, error) {
+	var cas []CAConfig
+	if config.AcmeCAsFile != "" {
+		content, err := os.ReadFile(config.AcmeCAsFile)
+		if err != nil {
+			return nil, "", err
+		}
+		err = json.Unmarshal(content, &cas)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid CA list %s: %v", config.AcmeCAsFile, err)
+		}
+	}
+
+	defaultCA := config.AcmeCA
+	if defaultCA == "" {
+		defaultCA = CALetsEncrypt
+		if config.IsDev {
+			defaultCA = CALetsEncryptStaging
+		}
+	}
+	if strings.Contains(defaultCA, "://") {
+		// a directory URL is a CA without a name
+		cas = append(cas, CAConfig{Name: "default", Directory: defaultCA})
+		defaultCA = "default"
+	}
+
+	found := false
+	for i := range cas {
+		if cas[i].Name == defaultCA {
+			found = true
+			break
+		}
+	}
+	if !found {
+		cas = append(cas, CAConfig{Name: defaultCA})
+	}
+	// flags configure the default CA unless the CA list has its own credentials
+	for i := range cas {
+		if cas[i].Name != defaultCA {
+			continue
+		}
+		if cas[i].EABKeyID == "" {
+			cas[i].EABKeyID = config.AcmeEABKeyID
+			cas[i].EABHMACKey = config.AcmeEABHMACKey
+		}
+		if cas[i].Roots == "" {
+			cas[i].Roots = config.AcmeRoots
+		}
+	}
+
+	for i := range cas {
+		if cas[i].Name == "" {
+			return nil, "", errors.New("CA without name in " + config.AcmeCAsFile)
+		}
+		if cas[i].Directory == "" {
+			cas[i].Directory = knownCAs[cas[i].Name]
+		}
+		if cas[i].Directory == "" {
+			return nil, "", fmt.Errorf("unknown CA %s, set its directory URL", cas[i].Name)
+		}
+	}
+	return cas, defaultCA, nil
+}
+
+// newCAIssuer creates the ACME issuer of a CA with its own account key
+func newCAIssuer(ca CAConfig, config *Config, dns DNSProvider) (*acmeIssuer, error) {
+	email := ca.Email
+	if email == "" {
+		email = config.Email
+	}
+	issuer := newAcmeIssuer(ca.Directory, email, dns, config.DNSPropagation)
+
+	// Let's Encrypt keeps the account key location of earlier versions
+	issuer.accountKeyPath = filepath.Join(config.ConfigDir, "certs", ca.Name, "acme_account+key")
+	if ca.Name == CALetsEncrypt || ca.Name == CALetsEncryptStaging {
+		issuer.accountKeyPath = filepath.Join(config.ConfigDir, "certs", "acme_account+key")
+	}
+
+	if ca.EABKeyID != "" {
+		key, err := decodeEABKey(ca.EABHMACKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EAB key of %s: %v", ca.Name, err)
+		}
+		issuer.eab = &acme.ExternalAccountBinding{KID: ca.EABKeyID, Key: key}
+	}
+
+	if ca.Roots != "" {
+		content, err := os.ReadFile(ca.Roots)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, errors.New("no certificates in " + ca.Roots)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		issuer.client.HTTPClient = &http.Client{Transport: transport}
+	}
+	log.Printf("[ACME]: CA %s uses %s", ca.Name, ca.Directory)
+
+	return issuer, nil
+}
+
+// decodeEABKey decodes the HMAC key, CAs hand it out as base64url with or without padding
+func decodeEABKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, errors.New("EAB HMAC key is empty")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+}
+
+// CANames lists the configured CAs, the default one first
+func (c *Cert) CANames() []string {
+	var names []string
+	for name := range c.issuers {
+		if name != c.defaultCA {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return append([]string{c.defaultCA}, names...)
+}
+
+// getIssuer returns the issuer of a CA, the default one for an empty name
+func (c *Cert) getIssuer(ca string) (ICertIssuer, error) {
+	if ca == "" || ca == c.defaultCA {
+		return c.issuer, nil
+	}
+	issuer, ok := c.issuers[ca]
+	if !ok {
+		return nil, errors.New("Unknown CA " + ca)
+	}
+	return issuer, nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCAConfigs(t *testing.T) {
+	cas, defaultCA, err := loadCAConfigs(&Config{IsDev: true})
+	assert.NoError(t, err)
+	assert.Equal(t, CALetsEncryptStaging, defaultCA, "Expected Let's Encrypt staging in dev mode")
+	assert.Equal(t, knownCAs[CALetsEncryptStaging], cas[0].Directory)
+
+	file := filepath.Join(t.TempDir(), "cas.json")
+	content := `[{"name": "zerossl", "eabKid": "kid-1", "eabHmacKey": "c2VjcmV0"},
+		{"name": "internal", "directory": "https://ca.internal/acme/directory"}]`
+	assert.NoError(t, os.WriteFile(file, []byte(content), 0644))
+
+	cas, defaultCA, err = loadCAConfigs(&Config{AcmeCA: "zerossl", AcmeCAsFile: file})
+	assert.NoError(t, err)
+	assert.Equal(t, "zerossl", defaultCA)
+	assert.Len(t, cas, 2)
+	assert.Equal(t, knownCAs["zerossl"], cas[0].Directory, "Expected directory of a known CA to be filled in")
+	assert.Equal(t, "kid-1", cas[0].EABKeyID)
+
+	cas, defaultCA, err = loadCAConfigs(&Config{AcmeCA: "https://localhost:14000/dir", AcmeEABKeyID: "kid", AcmeEABHMACKey: "a2V5"})
+	assert.NoError(t, err)
+	assert.Equal(t, "default", defaultCA, "Expected directory URL to become the default CA")
+	assert.Equal(t, "kid", cas[0].EABKeyID, "Expected EAB flags to apply to the default CA")
+
+	_, _, err = loadCAConfigs(&Config{AcmeCA: "unknown"})
+	assert.Error(t, err, "Expected error for unknown CA without directory")
+}
+
+func TestNewCertWithCAs(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cas.json")
+	assert.NoError(t, os.WriteFile(file, []byte(`[{"name": "google", "eabKid": "kid", "eabHmacKey": "c2VjcmV0"}]`), 0644))
+
+	cert := NewCert(&Config{ConfigDir: t.TempDir(), AcmeCAsFile: file})
+	assert.Equal(t, []string{CALetsEncrypt, "google"}, cert.CANames())
+
+	issuer, err := cert.getIssuer("google")
+	assert.NoError(t, err)
+	eab := issuer.(*acmeIssuer).eab
+	assert.Equal(t, "kid", eab.KID)
+	assert.Equal(t, []byte("secret"), eab.Key)
+
+	_, err = cert.getIssuer("buypass")
+	assert.Error(t, err, "Expected error for CA which is not configured")
+}
+
+func TestDecodeEABKey(t *testing.T) {
+	key := []byte{0xfb, 0xff, 0x01}
+	for _, encoded := range []string{base64.RawURLEncoding.EncodeToString(key), base64.URLEncoding.EncodeToString(key)} {
+		decoded, err := decodeEABKey(encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, key, decoded)
+	}
+	_, err := decodeEABKey("")
+	assert.Error(t, err)
+}
+
+// TestPebbleIssuance runs the whole ACME flow against Pebble, it is skipped
+// unless PEBBLE_DIRECTORY is set. Start Pebble without challenge validation:
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json
+//	PEBBLE_DIRECTORY=https://localhost:14000/dir PEBBLE_ROOTS=test/certs/pebble.minica.pem go test -run Pebble ./...
+//
+// PEBBLE_EAB_KID and PEBBLE_EAB_HMAC test External Account Binding with
+// Pebble's externalAccountMACKeys.
+func TestPebbleIssuance(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY is not set")
+	}
+	configDir := t.TempDir()
+	cert := NewCert(&Config{
+		ConfigDir:      configDir,
+		Email:          "test@example.com",
+		AcmeCA:         directory,
+		AcmeRoots:      os.Getenv("PEBBLE_ROOTS"),
+		AcmeEABKeyID:   os.Getenv("PEBBLE_EAB_KID"),
+		AcmeEABHMACKey: os.Getenv("PEBBLE_EAB_HMAC"),
+		KeyType:        KeyTypeEC256,
+	})
+
+	cacheDir := filepath.Join(configDir, "conf", "example.test")
+	assert.NoError(t, os.MkdirAll(cacheDir, 0755))
+	err := cert.GetCertificate(context.Background(), []string{"example.test", "www.example.test"}, cacheDir, CertOptions{})
+	assert.NoError(t, err, "Expected certificate from Pebble")
+
+	info, err := ReadCertInfo(filepath.Join(cacheDir, "fullchain.pem"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"example.test", "www.example.test"}, info.Names)
+	assert.True(t, info.NotAfter.After(time.Now()))
+	assert.FileExists(t, filepath.Join(configDir, "certs", "default", "acme_account+key"))
+}
@@ -1,131 +1,329 @@
 package server
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
-	"time"
+)
 
-	"golang.org/x/crypto/acme"
-	"golang.org/x/crypto/acme/autocert"
+const (
+	KeyTypeEC256   = "ec256"
+	KeyTypeEC384   = "ec384"
+	KeyTypeRSA2048 = "rsa2048"
+	KeyTypeRSA4096 = "rsa4096"
 )
 
-type ICertManager interface {
-	GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error)
+// ICertIssuer obtains certificates from a CA
+type ICertIssuer interface {
+	Obtain(ctx context.Context, domains []string, keyType string) (*tls.Certificate, error)
 	HTTPHandler(fallback http.Handler) http.Handler
 }
 
+// CertOptions are per site options of certificate issuance
+type CertOptions struct {
+	// KeyType of the certificate key, the default key type is used if it is empty
+	KeyType string
+	// CA is the name of the CA to order from, the default CA is used if it is empty
+	CA string
+	// Source is CertSourceLocal to issue from the local CA instead of ACME
+	Source string
+}
+
 type Cert struct {
-	cm ICertManager
+	// issuer is the default CA, issuers has all configured CAs by name
+	issuer           ICertIssuer
+	issuers          map[string]ICertIssuer
+	defaultCA        string
+	local            *localCA
+	keyType          string
+	supportsWildcard bool
 }
 
 func NewCert(config *Config) *Cert {
-	certManager := &autocert.Manager{
-		// HostPolicy: autocert.HostWhitelist(domains...), // no need white list, accept all domains
-		Prompt: autocert.AcceptTOS,
-		Cache:  autocert.DirCache(config.ConfigDir + "/certs"),
-		Email:  config.Email,
-	}
 	if config.IsDev {
 		log.Printf("Cert manager is in dev mode, using staging server")
-		certManager.Client = &acme.Client{
-			DirectoryURL: "https://acme-staging-v02.api.letsencrypt.org/directory",
-		}
-	}else{
+	} else {
 		log.Printf("Cert manager is in production mode, using production server")
-		certManager.Client = &acme.Client{
-			DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+	}
+
+	dns, err := newDNSProvider(config)
+	if err != nil {
+		log.Printf("DNS provider is not configured, wildcard certificates are not available: %v", err)
+	}
+
+	cas, defaultCA, err := loadCAConfigs(config)
+	if err != nil {
+		log.Panicf("Failed to load CA configuration: %v", err)
+	}
+	issuers := make(map[string]ICertIssuer)
+	for _, ca := range cas {
+		issuer, err := newCAIssuer(ca, config, dns)
+		if err != nil {
+			log.Panicf("Failed to configure CA %s: %v", ca.Name, err)
 		}
+		issuers[ca.Name] = issuer
+	}
+
+	keyType := config.KeyType
+	if keyType == "" {
+		keyType = KeyTypeEC256
+	}
+	return &Cert{
+		issuer:           issuers[defaultCA],
+		issuers:          issuers,
+		defaultCA:        defaultCA,
+		local:            newLocalCA(filepath.Join(config.ConfigDir, "certs", "local-ca")),
+		keyType:          keyType,
+		supportsWildcard: dns != nil,
 	}
-	return &Cert{cm: certManager}
 }
 
-func (c *Cert) GetCertManager() ICertManager {
-	return c.cm
+// LocalCARoot returns the PEM root of the local CA, it is created if it doesn't exist yet
+func (c *Cert) LocalCARoot() ([]byte, error) {
+	if c == nil || c.local == nil {
+		return nil, errors.New("local CA is not configured")
+	}
+	return c.local.RootPEM()
+}
+
+// SupportsWildcard reports whether a DNS provider is configured for dns-01 challenges
+func (c *Cert) SupportsWildcard() bool {
+	return c != nil && c.supportsWildcard
+}
+
+// HTTPHandler serves http-01 challenges of running orders and passes other requests to fallback
+func (c *Cert) HTTPHandler(fallback http.Handler) http.Handler {
+	if len(c.issuers) == 0 {
+		return c.issuer.HTTPHandler(fallback)
+	}
+	handler := fallback
+	for _, issuer := range c.issuers {
+		handler = issuer.HTTPHandler(handler)
+	}
+	return handler
 }
 
-func (c *Cert) GetCertificate(domain string, cacheDir string) error {
-	cert, err := c.cm.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+// GetCertificate obtains a certificate for the domains and saves it to cacheDir.
+// The first domain is the primary name, a certificate for several names is a SAN certificate.
+func (c *Cert) GetCertificate(ctx context.Context, domains []string, cacheDir string, options CertOptions) error {
+	if len(domains) == 0 {
+		return errors.New("no domains for certificate")
+	}
+	keyType := options.KeyType
+	if keyType == "" {
+		keyType = c.keyType
+	}
+
+	issuer, err := c.getIssuer(options.CA)
+	if options.Source == CertSourceLocal {
+		issuer, err = c.local, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := acmeContext(ctx)
+	defer cancel()
+	cert, err := issuer.Obtain(ctx, domains, keyType)
 	if err != nil {
 		// http.Error(w, "Failed to get certificate", http.StatusInternalServerError)
-		log.Printf("Failed to get certificate: %s:%v", domain, err)
+		log.Printf("Failed to get certificate: %v:%v", domains, err)
+		return err
+	}
+	if cert.Leaf != nil {
+		log.Printf("Certificate for %v obtained successfully: NotAfter=%s, Issuer=%s", domains, cert.Leaf.NotAfter, cert.Leaf.Issuer)
+	}
+
+	err = saveCertificate(cert, cacheDir)
+	if err != nil {
 		return err
 	}
-	log.Printf("Certificate for %s obtained successfully: NotAfter=%s, Issuer=%s", domain, cert.Leaf.NotAfter, cert.Leaf.Issuer)
+	log.Printf("Certificate and private key have been saved for %v.", domains)
+	return nil
+}
 
-	// Save the certificate and key to the cacheDir
+// saveCertificate writes the leaf with the whole chain to fullchain.pem, the
+// intermediates to chain.pem and the PKCS#8 encoded key to privkey.pem
+func saveCertificate(cert *tls.Certificate, cacheDir string) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("certificate is empty")
+	}
 	fullchainPath := filepath.Join(cacheDir, "fullchain.pem")
 	privkeyPath := filepath.Join(cacheDir, "privkey.pem")
 	chainPath := filepath.Join(cacheDir, "chain.pem")
 
-	// Convert the certificate to PEM format
-	fullchainPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
-	privkeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))})
-
-	// Write the fullchain and private key to files
-	err = os.WriteFile(fullchainPath, fullchainPEM, 0644)
+	var fullchainPEM, chainPEM []byte
+	for i, der := range cert.Certificate {
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		fullchainPEM = append(fullchainPEM, block...)
+		if i > 0 {
+			chainPEM = append(chainPEM, block...)
+		}
+	}
+	privkeyPEM, err := encodePrivateKey(cert.PrivateKey)
 	if err != nil {
-		log.Printf("Failed to write fullchain to %s: %v", fullchainPath, err)
+		log.Printf("Failed to encode private key: %v", err)
 		return err
 	}
 
-	err = os.WriteFile(privkeyPath, privkeyPEM, 0600)
+	// both files are written before either replaces the old one, so a failed
+	// write leaves the old key and certificate pair in place. nginx reads them
+	// on the reload after saving.
+	err = os.WriteFile(privkeyPath+".tmp", privkeyPEM, 0600)
 	if err != nil {
 		log.Printf("Failed to write private key to %s: %v", privkeyPath, err)
 		return err
 	}
+	err = os.WriteFile(fullchainPath+".tmp", fullchainPEM, 0644)
+	if err != nil {
+		log.Printf("Failed to write fullchain to %s: %v", fullchainPath, err)
+		os.Remove(privkeyPath + ".tmp")
+		return err
+	}
+	err = os.Rename(privkeyPath+".tmp", privkeyPath)
+	if err == nil {
+		err = os.Rename(fullchainPath+".tmp", fullchainPath)
+	}
+	if err != nil {
+		log.Printf("Failed to replace certificate in %s: %v", cacheDir, err)
+		os.Remove(privkeyPath + ".tmp")
+		os.Remove(fullchainPath + ".tmp")
+		return err
+	}
+	if len(chainPEM) == 0 {
+		os.Remove(chainPath)
+		return nil
+	}
+	err = writeFileAtomic(chainPath, chainPEM, 0644)
+	if err != nil {
+		log.Printf("Failed to write chain to %s: %v", chainPath, err)
+		return err
+	}
+	return nil
+}
 
-	// Write the chain to a separate file, and append it to the fullchain
-	if len(cert.Certificate) > 1 {
-		chainPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[1]})
-		err = os.WriteFile(chainPath, chainPEM, 0644)
-		if err != nil {
-			log.Printf("Failed to write chain to %s: %v", chainPath, err)
-			return err
+// generateKey creates a private key of one of KeyType* types
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeEC256, "":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEC384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("unknown key type %s", keyType)
+}
+
+// encodeCertificates encodes certificates as a PEM bundle
+func encodeCertificates(certs ...*x509.Certificate) []byte {
+	var content []byte
+	for _, cert := range certs {
+		content = append(content, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return content
+}
+
+// encodePrivateKey encodes any supported private key as PKCS#8 PEM
+func encodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// parsePrivateKey reads the first private key from PEM data, PKCS#8, PKCS#1 and SEC 1 encodings are supported
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found")
 		}
-		err = os.WriteFile(fullchainPath, append(fullchainPEM, chainPEM...), 0644)
-		if err != nil {
-			log.Printf("Failed to append chain to fullchain: %v", err)
-			return err
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			signer, ok := key.(crypto.Signer)
+			if !ok {
+				return nil, errors.New("unsupported private key type")
+			}
+			return signer, nil
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
 		}
 	}
+}
 
-	log.Printf("Certificate and private key have been saved for %s.", domain)
-	return nil
+// keyTypeName describes the key type of a public key, e.g. "ECDSA P-256" or "RSA 2048"
+func keyTypeName(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", k.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
 }
 
-func GetExpireTime(file string) (*time.Time, string, string) {
+// writeFileAtomic writes to a temporary file and renames it, so readers never see a partial file
+func writeFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, content, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// ReadCertInfo reads the leaf certificate of a PEM bundle
+func ReadCertInfo(file string) (*CertInfo, error) {
 	certData, err := os.ReadFile(file)
 	if err != nil {
 		log.Printf("[Cert]: failed to read %s from disk: %v", file, err)
-		return nil, "", ""
+		return nil, err
 	}
 
 	certificates, err := parsePEMBundle(certData)
 	if err != nil {
 		log.Printf("[Cert]: failed to parsePEMBundle: %s", err)
-		return nil, "", ""
-	}
-
-	if len(certificates) == 0 {
-		log.Printf("no certs found")
-		return nil, "", ""
+		return nil, err
 	}
 
 	// check if first cert is CA
 	x509Cert := certificates[0]
 	if x509Cert.IsCA {
 		log.Printf("[Cert][%s] certificate bundle starts with a CA certificate", x509Cert.DNSNames)
-		return nil, "", ""
+		return nil, errors.New("certificate bundle starts with a CA certificate")
 	}
 
-	return &x509Cert.NotAfter, x509Cert.DNSNames[0], x509Cert.IssuingCertificateURL[0]
+	return newCertInfo(x509Cert), nil
 }
 
 // parsePEMBundle parses a certificate bundle from top to bottom and returns
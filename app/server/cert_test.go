@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/tls"
 	"net/http"
 	"os"
@@ -23,52 +25,46 @@ var config = &Config{
 	Port:      "3005",
 }
 
-// MockCertManager is a mock implementation of ICertManager
-type MockCertManager struct {
+// MockCertIssuer is a mock implementation of ICertIssuer
+type MockCertIssuer struct {
 	mock.Mock
 }
 
-func (m *MockCertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	args := m.Called(hello)
+func (m *MockCertIssuer) Obtain(ctx context.Context, domains []string, keyType string) (*tls.Certificate, error) {
+	args := m.Called(domains, keyType)
 	return args.Get(0).(*tls.Certificate), args.Error(1)
 }
 
-func (m *MockCertManager) HTTPHandler(fallback http.Handler) http.Handler {
+func (m *MockCertIssuer) HTTPHandler(fallback http.Handler) http.Handler {
 	args := m.Called(fallback)
 	return args.Get(0).(http.Handler)
 }
 
 func TestNewCert(t *testing.T) {
 	cert := NewCert(config)
-	assert.NotNil(t, cert.cm, "Expected certManager to be initialized")
-}
-
-func TestGetCertManager(t *testing.T) {
-	cert := NewCert(config)
-	manager := cert.GetCertManager()
-
-	assert.Equal(t, cert.cm, manager, "Expected GetCertManager to return certManager")
+	assert.NotNil(t, cert.issuer, "Expected issuer to be initialized")
+	assert.Equal(t, KeyTypeEC256, cert.keyType, "Expected ECDSA P-256 keys by default")
 }
 
 func TestGetCertificate(t *testing.T) {
 	cacheDir := t.TempDir()
-	mockManager := new(MockCertManager)
+	mockIssuer := new(MockCertIssuer)
 
-	// Create a test certificate
-	privKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	// Create a test certificate with a chain of two intermediates
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 
 	cert := &tls.Certificate{
-		Certificate: [][]byte{[]byte("test-cert"), []byte("second-cert")},
+		Certificate: [][]byte{[]byte("test-cert"), []byte("second-cert"), []byte("third-cert")},
 		PrivateKey:  privKey,
 	}
 
 	// Set up the mock to return the test certificate
-	mockManager.On("GetCertificate", mock.Anything).Return(cert, nil)
+	mockIssuer.On("Obtain", []string{"example.com"}, KeyTypeEC256).Return(cert, nil)
 
-	c := &Cert{cm: mockManager}
+	c := &Cert{issuer: mockIssuer, keyType: KeyTypeEC256}
 
 	// Call the GetCertificate method
-	err := c.GetCertificate("example.com", cacheDir)
+	err := c.GetCertificate(context.Background(), []string{"example.com"}, cacheDir, CertOptions{})
 	assert.NoError(t, err, "Expected no error from GetCertificate")
 
 	// Verify that the certificate and key files were created
@@ -86,15 +82,41 @@ func TestGetCertificate(t *testing.T) {
 	assert.NoError(t, err, "Expected to read fullchain.pem")
 	assert.Contains(t, string(fullchainPEM), "CERTIFICATE", "Expected fullchain.pem to contain a certificate")
 
-	// Verify that fullchainPEM contains two "BEGIN CERTIFICATE" substrings
-	assert.Equal(t, 2, strings.Count(string(fullchainPEM), "BEGIN CERTIFICATE"), "Expected fullchain.pem to contain two certificates")
+	// Verify that the whole chain is kept
+	assert.Equal(t, 3, strings.Count(string(fullchainPEM), "BEGIN CERTIFICATE"), "Expected fullchain.pem to contain three certificates")
+	chainPEM, err := os.ReadFile(filepath.Join(cacheDir, "chain.pem"))
+	assert.NoError(t, err, "Expected to read chain.pem")
+	assert.Equal(t, 2, strings.Count(string(chainPEM), "BEGIN CERTIFICATE"), "Expected chain.pem to contain the intermediates")
 
 	// Verify the contents of the privkey.pem file
 	privkeyPEM, err := os.ReadFile(privkeyPath)
 	assert.NoError(t, err, "Expected to read privkey.pem")
-	assert.Contains(t, string(privkeyPEM), "RSA PRIVATE KEY", "Expected privkey.pem to contain a private key")
+	assert.Contains(t, string(privkeyPEM), "BEGIN PRIVATE KEY", "Expected privkey.pem to contain a PKCS#8 private key")
+	key, err := parsePrivateKey(privkeyPEM)
+	assert.NoError(t, err, "Expected privkey.pem to be parsed")
+	assert.True(t, privKey.Equal(key), "Expected the saved key to match")
 
 	// Verify that the mock was called as expected
-	mockManager.AssertExpectations(t)
+	mockIssuer.AssertExpectations(t)
+
+}
+
+func TestGenerateKey(t *testing.T) {
+	for keyType, name := range map[string]string{
+		KeyTypeEC256:   "ECDSA P-256",
+		KeyTypeEC384:   "ECDSA P-384",
+		KeyTypeRSA2048: "RSA 2048",
+	} {
+		key, err := generateKey(keyType)
+		assert.NoError(t, err, "Expected no error for key type %s", keyType)
+		assert.Equal(t, name, keyTypeName(key.Public()))
+
+		keyPEM, err := encodePrivateKey(key)
+		assert.NoError(t, err, "Expected key %s to be encoded", keyType)
+		_, err = parsePrivateKey(keyPEM)
+		assert.NoError(t, err, "Expected key %s to be parsed", keyType)
+	}
 
+	_, err := generateKey("dsa")
+	assert.Error(t, err, "Expected error for unknown key type")
 }
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const renewalStatusFile = "renewal.json"
+
+// CertInfo describes a certificate as shown on the certificates page and returned by the API
+type CertInfo struct {
+	Subject   string    `json:"subject"`
+	Names     []string  `json:"names"`
+	Issuer    string    `json:"issuer"`
+	IssuerURL string    `json:"issuerUrl,omitempty"`
+	Staging   bool      `json:"staging"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	KeyType   string    `json:"keyType"`
+	Serial    string    `json:"serial"`
+	// OCSP is set when the certificate names an OCSP responder, stapling needs one
+	OCSP bool `json:"ocsp"`
+}
+
+func newCertInfo(cert *x509.Certificate) *CertInfo {
+	info := &CertInfo{
+		Subject:   cert.Subject.CommonName,
+		Names:     cert.DNSNames,
+		Issuer:    cert.Issuer.CommonName,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		KeyType:   keyTypeName(cert.PublicKey),
+		Serial:    cert.SerialNumber.Text(16),
+		OCSP:      len(cert.OCSPServer) > 0,
+	}
+	for _, ip := range cert.IPAddresses {
+		info.Names = append(info.Names, ip.String())
+	}
+	if len(cert.IssuingCertificateURL) > 0 {
+		info.IssuerURL = cert.IssuingCertificateURL[0]
+	}
+	// Let's Encrypt staging issuers are named "(STAGING) ..." and served from stg-* hosts
+	info.Staging = strings.Contains(info.Issuer, "STAGING") ||
+		strings.Contains(info.Issuer, "Fake LE") ||
+		strings.Contains(info.IssuerURL, "stg")
+	return info
+}
+
+// DaysRemaining is the number of whole days until the certificate expires, negative when expired
+func (i *CertInfo) DaysRemaining() int {
+	return int(math.Floor(time.Until(i.NotAfter).Hours() / 24))
+}
+
+// RenewalStatus is the outcome of the last certificate request of a site
+type RenewalStatus struct {
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// DomainCertificate is the certificate state of a site
+type DomainCertificate struct {
+	Domain   string `json:"domain"`
+	Disabled bool   `json:"disabled"`
+	Custom   bool   `json:"custom"`
+	// TLSProfile is the profile the site uses, Default when it comes from -tlsProfile
+	TLSProfile        string         `json:"tlsProfile"`
+	DefaultTLSProfile bool           `json:"defaultTlsProfile"`
+	Cert              *CertInfo      `json:"cert,omitempty"`
+	Renewal           *RenewalStatus `json:"renewal,omitempty"`
+	// Scan is the last TLS scan of the live site
+	Scan  *ScanResult `json:"scan,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// GetCertificates returns certificate details of all sites
+func (s *Service) GetCertificates() []DomainCertificate {
+	var result []DomainCertificate
+	for _, domain := range s.listDomains() {
+		item := DomainCertificate{Domain: domain, Disabled: s.isDisabled(domain), Custom: s.isCustomCertificate(domain)}
+		info, err := ReadCertInfo(filepath.Join(s.cacheDir, domain, "fullchain.pem"))
+		if err != nil {
+			item.Error = err.Error()
+		} else {
+			item.Cert = info
+		}
+		item.Renewal = s.getRenewalStatus(domain)
+		item.Scan = s.GetScanResult(domain)
+		item.TLSProfile = s.effectiveTLSProfile(domain)
+		if settings, err := s.GetSiteSettings(domain); err == nil {
+			item.DefaultTLSProfile = settings.TLSProfile == ""
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// RenewCertificate requests a new certificate for a site right away and reloads nginx,
+// the order is abandoned when ctx is cancelled
+func (s *Service) RenewCertificate(ctx context.Context, domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	if s.isCustomCertificate(domain) {
+		return errors.New("Site uses a custom certificate, upload a new one to renew it")
+	}
+	if s.certSource(domain) == CertSourceNone {
+		return errors.New("Site is served over HTTP only, it has no certificate to renew")
+	}
+	err := s.obtainCertificate(ctx, domain)
+	if err != nil {
+		return err
+	}
+	return s.nginx.Reload()
+}
+
+func (s *Service) isCustomCertificate(domain string) bool {
+	return s.certSource(domain) == CertSourceCustom
+}
+
+func (s *Service) getRenewalStatus(domain string) *RenewalStatus {
+	content, err := os.ReadFile(filepath.Join(s.cacheDir, domain, renewalStatusFile))
+	if err != nil {
+		return nil
+	}
+	status := &RenewalStatus{}
+	err = json.Unmarshal(content, status)
+	if err != nil {
+		log.Printf("Failed to parse renewal status of %s: %v", domain, err)
+		return nil
+	}
+	return status
+}
+
+// saveRenewalStatus records the outcome of a certificate request
+func (s *Service) saveRenewalStatus(domain string, renewErr error) {
+	status := s.getRenewalStatus(domain)
+	if status == nil {
+		status = &RenewalStatus{}
+	}
+	status.LastAttempt = time.Now().UTC()
+	status.LastError = ""
+	if renewErr != nil {
+		status.LastError = renewErr.Error()
+	} else {
+		status.LastSuccess = status.LastAttempt
+	}
+
+	content, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return
+	}
+	err = os.WriteFile(filepath.Join(s.cacheDir, domain, renewalStatusFile), content, 0644)
+	if err != nil {
+		log.Printf("Failed to save renewal status of %s: %v", domain, err)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestCertificate(t *testing.T, dir string, issuer string, names []string, notBefore time.Time, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(255),
+		Subject:      pkix.Name{CommonName: names[0]},
+		Issuer:       pkix.Name{CommonName: issuer},
+		DNSNames:     names,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	content := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "fullchain.pem"), content, 0644))
+}
+
+func TestReadCertInfo(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(10*24*time.Hour + time.Hour)
+	writeTestCertificate(t, dir, "example.com", []string{"example.com", "www.example.com"}, time.Now().Add(-time.Hour), notAfter)
+
+	info, err := ReadCertInfo(filepath.Join(dir, "fullchain.pem"))
+	assert.NoError(t, err, "Expected no error from ReadCertInfo")
+	assert.Equal(t, "example.com", info.Subject)
+	assert.Equal(t, []string{"example.com", "www.example.com"}, info.Names)
+	assert.Equal(t, "ECDSA P-256", info.KeyType)
+	assert.Equal(t, "ff", info.Serial)
+	assert.Equal(t, 10, info.DaysRemaining())
+	assert.False(t, info.Staging, "Expected self-signed certificate not to be staging")
+
+	_, err = ReadCertInfo(filepath.Join(dir, "missing.pem"))
+	assert.Error(t, err, "Expected error for missing certificate")
+}
+
+func TestGetCertificates(t *testing.T) {
+	cacheDir := t.TempDir()
+	service := &Service{cacheDir: cacheDir, domains: []string{"example.com", "new.com"}}
+	writeTestCertificate(t, filepath.Join(cacheDir, "example.com"), "example.com", []string{"example.com"}, time.Now(), time.Now().Add(24*time.Hour))
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "new.com"), 0755))
+	service.saveRenewalStatus("new.com", errors.New("rate limited"))
+	service.saveRenewalStatus("example.com", nil)
+
+	certs := service.GetCertificates()
+	assert.Len(t, certs, 2)
+	assert.Equal(t, "example.com", certs[0].Domain)
+	assert.NotNil(t, certs[0].Cert, "Expected certificate details")
+	assert.Empty(t, certs[0].Renewal.LastError)
+	assert.False(t, certs[0].Renewal.LastSuccess.IsZero(), "Expected successful renewal to be recorded")
+
+	assert.Nil(t, certs[1].Cert, "Expected no certificate for new.com")
+	assert.NotEmpty(t, certs[1].Error)
+	assert.Equal(t, "rate limited", certs[1].Renewal.LastError)
+	assert.True(t, certs[1].Renewal.LastSuccess.IsZero())
+}
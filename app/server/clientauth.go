@@ -0,0 +1,303 @@
+package server
+
+import (
+	"crypto/x509"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	clientBundleFile = "client-ca.pem"
+	// clientCertLifetime of issued client certificates, they are revoked rather than renewed
+	clientCertLifetime = 365 * 24 * time.Hour
+	// clientAuthGuard denies requests without a verified client certificate in a location
+	clientAuthGuard = "if ($ssl_client_verify != SUCCESS) { return 403; }"
+)
+
+// ClientAuthSettings enable mutual TLS for a site
+type ClientAuthSettings struct {
+	// Bundle is true when clients are verified with the uploaded client-ca.pem
+	// of the site instead of the nginx-ui client CA
+	Bundle bool `json:"bundle,omitempty"`
+	// Locations that require a client certificate, empty means the whole site
+	Locations []string `json:"locations,omitempty"`
+}
+
+// clientAuthDirectives renders ssl_verify_client for a site with mutual TLS.
+// With locations the certificate is optional on the server and the
+// locations deny requests without one.
+func (s *Service) clientAuthDirectives(domain string) []string {
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil || settings.ClientAuth == nil {
+		return nil
+	}
+	verify := "on"
+	if len(settings.ClientAuth.Locations) > 0 {
+		verify = "optional"
+	}
+	if settings.ClientAuth.Bundle {
+		return []string{
+			"ssl_client_certificate " + filepath.Join(s.cacheDir, domain, clientBundleFile),
+			"ssl_verify_client " + verify,
+			"ssl_verify_depth 2",
+		}
+	}
+	return []string{
+		"ssl_client_certificate " + s.clientCA.rootPath(),
+		"ssl_verify_client " + verify,
+		"ssl_crl " + s.clientCA.crlPath(),
+	}
+}
+
+// clientAuthLocations returns the locations of a site which require a client certificate
+func (s *Service) clientAuthLocations(domain string) []string {
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil || settings.ClientAuth == nil {
+		return nil
+	}
+	return settings.ClientAuth.Locations
+}
+
+// SetClientAuth enables mutual TLS for a site, nil disables it. A bundle
+// replaces the CA bundle of the site, without one clients are verified with
+// the nginx-ui client CA unless clientAuth.Bundle keeps the uploaded bundle.
+func (s *Service) SetClientAuth(domain string, clientAuth *ClientAuthSettings, bundle []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	path := filepath.Join(s.cacheDir, domain)
+	if clientAuth != nil && !fileExists(filepath.Join(path, "fullchain.pem")) {
+		return errors.New("Site has no certificate yet, client certificates need HTTPS")
+	}
+	content, err := s.nginx.GetConfig(domain)
+	if err != nil {
+		return err
+	}
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+
+	if clientAuth != nil {
+		clientAuth.Locations = normalizeLocations(clientAuth.Locations)
+		_, err = applyClientAuthLocations(content, clientAuth.Locations)
+		if err != nil {
+			return err
+		}
+		if len(bundle) > 0 {
+			certs, err := parsePEMBundle(bundle)
+			if err != nil {
+				return errors.New("Invalid client CA bundle: " + err.Error())
+			}
+			for _, cert := range certs {
+				if !cert.IsCA {
+					return errors.New("Client CA bundle contains " + cert.Subject.CommonName + " which is not a CA")
+				}
+			}
+			clientAuth.Bundle = true
+		}
+		if clientAuth.Bundle && len(bundle) == 0 && !fileExists(filepath.Join(path, clientBundleFile)) {
+			return errors.New("Client CA bundle is required")
+		}
+		if !clientAuth.Bundle {
+			// the root and ssl_crl must exist before nginx loads the config
+			if _, err := s.clientCA.ensureCRL(); err != nil {
+				return err
+			}
+		}
+	}
+
+	oldSettings := *settings
+	oldBundle, bundleErr := os.ReadFile(filepath.Join(path, clientBundleFile))
+	rollback := func() {
+		s.saveSiteSettings(domain, &oldSettings)
+		s.nginx.writeConfig(domain, content)
+		if bundleErr == nil {
+			os.WriteFile(filepath.Join(path, clientBundleFile), oldBundle, 0644)
+		}
+	}
+	if len(bundle) > 0 {
+		err = os.WriteFile(filepath.Join(path, clientBundleFile), bundle, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	settings.ClientAuth = clientAuth
+	err = s.saveSiteSettings(domain, settings)
+	if err != nil {
+		rollback()
+		return err
+	}
+	updated, err := s.applySiteTLS(domain, content)
+	if err == nil {
+		err = s.nginx.writeConfig(domain, updated)
+	}
+	if err == nil {
+		err = s.nginx.TestConfig()
+	}
+	if err != nil {
+		rollback()
+		return err
+	}
+	if clientAuth == nil {
+		log.Printf("Domain %s client certificates are disabled", domain)
+	} else {
+		log.Printf("Domain %s requires client certificates for %v", domain, clientAuth.Locations)
+	}
+
+	return s.nginx.Reload()
+}
+
+// IssueClientCertificate issues a client certificate and returns it with
+// its key and the client CA root as PKCS#12 for importing in browsers
+func (s *Service) IssueClientCertificate(name string, password string) ([]byte, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, errors.New("Client name is required")
+	}
+	if password == "" {
+		return nil, errors.New("Password is required, browsers don't import PKCS#12 files without one")
+	}
+	cert, key, err := s.clientCA.Issue(name, clientCertLifetime)
+	if err != nil {
+		return nil, err
+	}
+	root, _, err := s.clientCA.authority.load()
+	if err != nil {
+		return nil, err
+	}
+	return pkcs12.Modern.Encode(key, cert, []*x509.Certificate{root}, password)
+}
+
+// RevokeClientCertificate adds a client certificate to the CRL and reloads
+// nginx, which reads ssl_crl only on reload
+func (s *Service) RevokeClientCertificate(serial string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.clientCA.Revoke(serial)
+	if err != nil {
+		return err
+	}
+	return s.nginx.Reload()
+}
+
+// GetClientCertificates returns the issued client certificates, the latest first
+func (s *Service) GetClientCertificates() ([]ClientCertificate, error) {
+	clients, err := s.clientCA.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(clients, func(i, j int) bool { return clients[i].NotBefore.After(clients[j].NotBefore) })
+	return clients, nil
+}
+
+// refreshClientCRL renews the CRL before nginx starts rejecting clients
+// because of its next update time
+func (s *Service) refreshClientCRL() {
+	if !fileExists(s.clientCA.crlPath()) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	written, err := s.clientCA.ensureCRL()
+	if err != nil {
+		log.Printf("Failed to refresh client CRL: %v", err)
+		return
+	}
+	if written {
+		s.nginx.Reload()
+	}
+}
+
+// applySiteTLS renders the TLS directives and client certificate checks of a site into its config
+func (s *Service) applySiteTLS(domain string, content string) (string, error) {
+	content, err := applyTLSDirectives(content, s.tlsDirectives(domain))
+	if err != nil {
+		return "", err
+	}
+	return applyClientAuthLocations(content, s.clientAuthLocations(domain))
+}
+
+// applyClientAuthLocations adds clientAuthGuard to the given locations of
+// HTTPS server blocks and removes it from all others
+func applyClientAuthLocations(content string, locations []string) (string, error) {
+	parsed, err := parseNginxConfig(content)
+	if err != nil {
+		return "", err
+	}
+
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	found := make(map[string]bool)
+	walkConfDirectives(parsed, nil, func(d *confDirective, parents []string) {
+		if d.name != "server" || !d.block {
+			return
+		}
+		tls := false
+		for _, child := range d.children {
+			if child.name == "ssl_certificate_key" && !child.block {
+				tls = true
+			}
+		}
+		walkConfDirectives(d.children, nil, func(d *confDirective, parents []string) {
+			if d.name == "if" && d.block && strings.Contains(strings.Join(d.args, " "), "$ssl_client_verify") {
+				start, end := lineSpan(content, d.start, d.end)
+				edits = append(edits, edit{start: start, end: end})
+				return
+			}
+			if d.name != "location" || !d.block || !tls {
+				return
+			}
+			location := strings.Join(d.args, " ")
+			if !contains(locations, location) && !contains(locations, d.args[len(d.args)-1]) {
+				return
+			}
+			found[location], found[d.args[len(d.args)-1]] = true, true
+			indent := "    "
+			if from, alone := lineStart(content, d.start); alone {
+				indent = content[from:d.start] + "    "
+			}
+			edits = append(edits, edit{start: d.bodyStart, end: d.bodyStart, text: "\n" + indent + clientAuthGuard})
+		})
+	})
+	for _, location := range locations {
+		if !found[location] {
+			return "", errors.New("Location " + location + " is not in the HTTPS server of the config")
+		}
+	}
+
+	// apply from the end so that offsets of earlier edits stay valid
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	result := content
+	for _, e := range edits {
+		result = result[:e.start] + e.text + result[e.end:]
+	}
+	return result, nil
+}
+
+// normalizeLocations trims and deduplicates location paths
+func normalizeLocations(locations []string) []string {
+	var result []string
+	for _, location := range locations {
+		location = strings.TrimSpace(location)
+		if location != "" && !contains(result, location) {
+			result = append(result, location)
+		}
+	}
+	return result
+}
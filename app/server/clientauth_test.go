@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyClientAuthLocations(t *testing.T) {
+	content := `server {
+    listen 443 ssl;
+    ssl_certificate_key /conf/example.com/privkey.pem;
+    location / {
+        proxy_pass http://localhost:3000;
+    }
+    location ^~ /admin/ {
+        proxy_pass http://localhost:3001;
+    }
+}
+server {
+    listen 80;
+    location /admin/ {
+        return 301 https://$host$request_uri;
+    }
+}`
+
+	result, err := applyClientAuthLocations(content, []string{"/admin/"})
+	assert.NoError(t, err, "Expected no error from applyClientAuthLocations")
+	assert.Equal(t, `server {
+    listen 443 ssl;
+    ssl_certificate_key /conf/example.com/privkey.pem;
+    location / {
+        proxy_pass http://localhost:3000;
+    }
+    location ^~ /admin/ {
+        if ($ssl_client_verify != SUCCESS) { return 403; }
+        proxy_pass http://localhost:3001;
+    }
+}
+server {
+    listen 80;
+    location /admin/ {
+        return 301 https://$host$request_uri;
+    }
+}`, result, "Expected the guard in the HTTPS location only")
+
+	again, err := applyClientAuthLocations(result, []string{"/admin/"})
+	assert.NoError(t, err)
+	assert.Equal(t, result, again, "Expected applying the same locations twice to change nothing")
+
+	removed, err := applyClientAuthLocations(result, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, content, removed, "Expected the guard to be removed")
+
+	_, err = applyClientAuthLocations(content, []string{"/api/"})
+	assert.EqualError(t, err, "Location /api/ is not in the HTTPS server of the config")
+}
+
+func TestClientCAIssueAndRevoke(t *testing.T) {
+	ca := newClientCA(t.TempDir())
+
+	cert, _, err := ca.Issue("alice", clientCertLifetime)
+	assert.NoError(t, err, "Expected no error from Issue")
+	other, _, err := ca.Issue("bob", clientCertLifetime)
+	assert.NoError(t, err)
+	root, _, err := ca.authority.load()
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err, "Expected a client certificate signed by the client CA")
+	assert.FileExists(t, ca.crlPath(), "Expected the CRL to be created with the first certificate")
+
+	serial := cert.SerialNumber.Text(16)
+	assert.NoError(t, ca.Revoke(serial))
+	assert.EqualError(t, ca.Revoke(serial), "Client certificate "+serial+" is already revoked")
+	assert.EqualError(t, ca.Revoke("ff"), "Client certificate ff does not exist")
+
+	content, err := os.ReadFile(ca.crlPath())
+	assert.NoError(t, err)
+	block, _ := pem.Decode(content)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	assert.NoError(t, err)
+	assert.NoError(t, crl.CheckSignatureFrom(root))
+	assert.Len(t, crl.RevokedCertificateEntries, 1)
+	assert.Equal(t, cert.SerialNumber, crl.RevokedCertificateEntries[0].SerialNumber)
+	assert.True(t, crl.NextUpdate.After(time.Now().Add(clientCRLRefresh)))
+
+	clients, err := ca.List()
+	assert.NoError(t, err)
+	assert.Len(t, clients, 2)
+	assert.True(t, clients[0].Revoked())
+	assert.Equal(t, other.SerialNumber.Text(16), clients[1].Serial)
+	assert.False(t, clients[1].Revoked())
+
+	written, err := ca.ensureCRL()
+	assert.NoError(t, err)
+	assert.False(t, written, "Expected a fresh CRL to be kept")
+}
+
+func TestSetClientAuth(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	domainDir := filepath.Join(cacheDir, domain)
+	assert.NoError(t, os.MkdirAll(domainDir, 0755))
+	config := "server {\n    listen 443 ssl;\n    ssl_certificate_key " + domainDir + "/privkey.pem;\n    location / {\n        return 200;\n    }\n}\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(domainDir, "nginx.conf"), []byte(config), 0644))
+	service := &Service{
+		configDir: configDir,
+		cacheDir:  cacheDir,
+		domains:   []string{domain},
+		nginx:     newFakeNginx(t, configDir, true),
+		clientCA:  newClientCA(filepath.Join(configDir, "certs", "client-ca")),
+	}
+
+	err := service.SetClientAuth(domain, &ClientAuthSettings{}, nil)
+	assert.EqualError(t, err, "Site has no certificate yet, client certificates need HTTPS")
+	writeTestCertificate(t, domainDir, "Test CA", []string{domain}, time.Now(), time.Now().Add(90*24*time.Hour))
+
+	err = service.SetClientAuth(domain, &ClientAuthSettings{Locations: []string{"/admin/"}}, nil)
+	assert.Error(t, err, "Expected error for a location which is not in the config")
+
+	err = service.SetClientAuth(domain, &ClientAuthSettings{}, nil)
+	assert.NoError(t, err, "Expected no error from SetClientAuth")
+	content, _ := os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.Contains(t, string(content), "ssl_verify_client on;")
+	assert.Contains(t, string(content), "ssl_crl "+service.clientCA.crlPath()+";")
+	assert.FileExists(t, service.clientCA.crlPath(), "Expected the CRL to exist before nginx loads it")
+
+	err = service.SetClientAuth(domain, &ClientAuthSettings{Locations: []string{"/"}}, nil)
+	assert.NoError(t, err)
+	content, _ = os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.Contains(t, string(content), "ssl_verify_client optional;")
+	assert.Contains(t, string(content), clientAuthGuard)
+
+	err = service.SetClientAuth(domain, &ClientAuthSettings{Bundle: true}, nil)
+	assert.EqualError(t, err, "Client CA bundle is required")
+	_, intermediate, leaf, _ := testChain(t, []string{"client"})
+	err = service.SetClientAuth(domain, nil, nil)
+	assert.NoError(t, err)
+	err = service.SetClientAuth(domain, &ClientAuthSettings{}, encodeCertificates(leaf))
+	assert.EqualError(t, err, "Client CA bundle contains client which is not a CA")
+	err = service.SetClientAuth(domain, &ClientAuthSettings{}, encodeCertificates(intermediate))
+	assert.NoError(t, err)
+	content, _ = os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.Contains(t, string(content), "ssl_client_certificate "+filepath.Join(domainDir, clientBundleFile)+";")
+	assert.NotContains(t, string(content), "ssl_crl")
+
+	err = service.SetClientAuth(domain, nil, nil)
+	assert.NoError(t, err)
+	content, _ = os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.NotContains(t, string(content), "ssl_verify_client")
+	assert.NotContains(t, string(content), clientAuthGuard)
+}
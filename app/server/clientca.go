@@ -0,0 +1,238 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	clientCAIndexFile = "clients.json"
+	clientCACRLFile   = "crl.pem"
+	// nginx rejects every client certificate once the CRL is past its next
+	// update, it is refreshed daily long before that
+	clientCRLLifetime = 365 * 24 * time.Hour
+	clientCRLRefresh  = 30 * 24 * time.Hour
+)
+
+// ClientCertificate is a client certificate issued by the client CA
+type ClientCertificate struct {
+	Serial    string    `json:"serial"`
+	Name      string    `json:"name"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	RevokedAt time.Time `json:"revokedAt,omitempty"`
+}
+
+// Revoked reports whether the certificate is on the CRL
+func (c ClientCertificate) Revoked() bool {
+	return !c.RevokedAt.IsZero()
+}
+
+// clientCA issues client certificates for sites with mutual TLS. Issued
+// certificates are listed in clients.json so they can be revoked, the CRL
+// is kept next to the root for ssl_crl.
+type clientCA struct {
+	authority *localCA
+
+	mu sync.Mutex
+}
+
+func newClientCA(dir string) *clientCA {
+	return &clientCA{authority: &localCA{dir: dir, name: "nginx-ui Client CA"}}
+}
+
+func (ca *clientCA) rootPath() string {
+	return filepath.Join(ca.authority.dir, localCARootFile)
+}
+
+func (ca *clientCA) crlPath() string {
+	return filepath.Join(ca.authority.dir, clientCACRLFile)
+}
+
+// Issue creates a client certificate for name, the root and the CRL are created on first use
+func (ca *clientCA) Issue(name string, lifetime time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	root, rootKey, err := ca.authority.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, root, key.Public(), rootKey)
+	if err != nil {
+		log.Printf("[ClientCA]: failed to issue certificate for %s: %v", name, err)
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	clients, err := ca.readIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+	clients = append(clients, ClientCertificate{
+		Serial:    cert.SerialNumber.Text(16),
+		Name:      name,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+	})
+	err = ca.writeIndex(clients)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !fileExists(ca.crlPath()) {
+		err = ca.writeCRL(clients)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	log.Printf("[ClientCA]: issued certificate %s for %s", cert.SerialNumber.Text(16), name)
+
+	return cert, key, nil
+}
+
+// Revoke adds the certificate with serial to the CRL
+func (ca *clientCA) Revoke(serial string) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	clients, err := ca.readIndex()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range clients {
+		if clients[i].Serial == serial {
+			if clients[i].Revoked() {
+				return errors.New("Client certificate " + serial + " is already revoked")
+			}
+			clients[i].RevokedAt = time.Now().UTC()
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("Client certificate " + serial + " does not exist")
+	}
+	err = ca.writeIndex(clients)
+	if err != nil {
+		return err
+	}
+	log.Printf("[ClientCA]: revoked certificate %s", serial)
+	return ca.writeCRL(clients)
+}
+
+// List returns the issued client certificates
+func (ca *clientCA) List() ([]ClientCertificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.readIndex()
+}
+
+// ensureCRL writes the CRL when it is missing or close to its next update
+// and reports whether it was written
+func (ca *clientCA) ensureCRL() (bool, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	content, err := os.ReadFile(ca.crlPath())
+	if err == nil {
+		block, _ := pem.Decode(content)
+		if block != nil {
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err == nil && time.Until(crl.NextUpdate) > clientCRLRefresh {
+				return false, nil
+			}
+		}
+	}
+	clients, err := ca.readIndex()
+	if err != nil {
+		return false, err
+	}
+	return true, ca.writeCRL(clients)
+}
+
+func (ca *clientCA) writeCRL(clients []ClientCertificate) error {
+	root, rootKey, err := ca.authority.load()
+	if err != nil {
+		return err
+	}
+	var entries []x509.RevocationListEntry
+	for _, client := range clients {
+		if !client.Revoked() {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(client.Serial, 16)
+		if !ok {
+			continue
+		}
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: client.RevokedAt})
+	}
+	now := time.Now()
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.Unix()),
+		ThisUpdate:                now.Add(-time.Hour),
+		NextUpdate:                now.Add(clientCRLLifetime),
+		RevokedCertificateEntries: entries,
+	}, root, rootKey)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ca.crlPath(), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644)
+}
+
+func (ca *clientCA) readIndex() ([]ClientCertificate, error) {
+	content, err := os.ReadFile(filepath.Join(ca.authority.dir, clientCAIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var clients []ClientCertificate
+	err = json.Unmarshal(content, &clients)
+	if err != nil {
+		log.Printf("[ClientCA]: failed to parse %s: %v", clientCAIndexFile, err)
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (ca *clientCA) writeIndex(clients []ClientCertificate) error {
+	content, err := json.MarshalIndent(clients, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(ca.authority.dir, clientCAIndexFile), content, 0600)
+}
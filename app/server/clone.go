@@ -0,0 +1,98 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// CloneDomain adds a new site using the config of an existing one as a
+// starting point. The domain name and paths of the source site are replaced
+// and the new domain goes through the same checks as AddDomain.
+func (s *Service) CloneDomain(source string, domain string) (error, string) {
+	log.Printf("Cloning domain %s as %s", source, domain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, source) {
+		return errors.New("Domain does not exist"), ""
+	}
+	// an uploaded certificate doesn't cover the new name, the clone gets one from ACME
+	certSource := s.certSource(source)
+	if certSource == CertSourceCustom {
+		certSource = ""
+	}
+	err := s.validateNewDomain(domain, certSource)
+	if err != nil {
+		return err, ""
+	}
+
+	sourceContent, err := s.nginx.GetConfig(source)
+	if err != nil {
+		log.Printf("Failed to read config for %s: %v", source, err)
+		return err, ""
+	}
+	content, err := rewriteDomainConfig(sourceContent, source, domain, filepath.Join(s.cacheDir, source), filepath.Join(s.cacheDir, domain))
+	if err != nil {
+		log.Printf("Failed to rewrite config of %s: %v", source, err)
+		return err, ""
+	}
+
+	// only aliases within the source domain (like www.) are carried over,
+	// other names stay with the source site
+	sourceSettings, err := s.GetSiteSettings(source)
+	if err != nil {
+		return err, ""
+	}
+	settings := *sourceSettings
+	settings.Aliases = nil
+	settings.CertSource = certSource
+	var renamed []string
+	for _, name := range s.getServerNames(source) {
+		alias := renameHost(name, source, domain)
+		renamed = append(renamed, alias)
+		if alias != name && alias != domain {
+			settings.Aliases = append(settings.Aliases, alias)
+		}
+	}
+	content, err = rewriteServerNames(content, renamed, append([]string{domain}, settings.Aliases...))
+	if err != nil {
+		return err, ""
+	}
+
+	domainDir := filepath.Join(s.cacheDir, domain)
+	err = os.Mkdir(domainDir, 0755)
+	if err != nil {
+		log.Printf("Failed to create directory %s: %v", domainDir, err)
+		return err, ""
+	}
+	err = copySiteFiles(filepath.Join(s.cacheDir, source), domainDir)
+	if err != nil {
+		log.Printf("Failed to copy files of %s: %v", source, err)
+		os.RemoveAll(domainDir)
+		return err, ""
+	}
+	err = s.saveSiteSettings(domain, &settings)
+	if err != nil {
+		os.RemoveAll(domainDir)
+		return err, ""
+	}
+	err = s.obtainCopiedCertificate(domain, content)
+	if err != nil {
+		os.RemoveAll(domainDir)
+		s.nginx.RefreshConfig()
+		return err, ""
+	}
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Config of %s is rejected: %v", domain, err)
+		os.RemoveAll(domainDir)
+		s.nginx.RefreshConfig()
+		return err, ""
+	}
+
+	s.domains = append(s.domains, domain)
+
+	return s.nginx.Reload(), content
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloneDomain(t *testing.T) {
+	service := newRenameTestService(t)
+	assert.NoError(t, service.saveSiteSettings("wiki", &SiteSettings{Aliases: []string{"www.wiki", "kb"}, CertSource: CertSourceLocal}))
+	newDir := filepath.Join(service.cacheDir, "docs")
+
+	service.nginx = newFakeNginx(t, service.configDir, false)
+	err, _ := service.CloneDomain("wiki", "docs")
+	assert.Error(t, err, "Expected nginx -t to fail")
+	assert.NoDirExists(t, newDir, "Expected the clone to be removed")
+	assert.Equal(t, []string{"wiki"}, service.domains)
+
+	service.nginx = newFakeNginx(t, service.configDir, true)
+	err, content := service.CloneDomain("wiki", "docs")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"wiki", "docs"}, service.domains)
+	assert.Contains(t, content, "server_name docs www.docs;", "Expected only aliases within the source domain to be carried over")
+	assert.Contains(t, content, newDir+"/fullchain.pem;")
+	assert.NotContains(t, content, filepath.Join(service.cacheDir, "wiki"))
+	written, err := os.ReadFile(filepath.Join(newDir, "nginx.conf"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, string(written))
+	assert.Equal(t, []string{"docs", "www.docs"}, service.getServerNames("docs"))
+	assert.Equal(t, []string{"wiki", "www.wiki", "kb"}, service.getServerNames("wiki"), "Expected the source site to keep its names")
+	info, err := ReadCertInfo(filepath.Join(newDir, "fullchain.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docs", "www.docs"}, info.Names)
+
+	err, _ = service.CloneDomain("wiki", "docs")
+	assert.EqualError(t, err, "Domain already exists")
+}
+
+func TestCloneDomainServesChallengeBeforeIssuing(t *testing.T) {
+	service := newRenameTestService(t)
+	var logPath string
+	service.nginx, logPath = newRecordingFakeNginx(t, service.configDir, filepath.Join(service.cacheDir, "docs"))
+
+	err, content := service.CloneDomain("wiki", "docs")
+	assert.NoError(t, err)
+	assertServedOverHTTPFirst(t, logPath)
+	assert.NotContains(t, content, pendingCertMarker)
+}
+
+func TestCloneDomainWithClientCABundle(t *testing.T) {
+	service := newRenameTestService(t)
+	_, intermediate, _, _ := testChain(t, []string{"client"})
+	assert.NoError(t, service.SetClientAuth("wiki", &ClientAuthSettings{}, encodeCertificates(intermediate)))
+	newDir := filepath.Join(service.cacheDir, "docs")
+
+	// nginx rejects the clone when the bundle it refers to is missing
+	binDir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"if [ -f " + newDir + "/nginx.conf ] && [ ! -f " + newDir + "/" + clientBundleFile + " ]; then\n" +
+		"  echo 'nginx: [emerg] cannot load client CA'; exit 1\n" +
+		"fi\n" +
+		"echo 'nginx: the configuration file syntax is ok'\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "nginx"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	err, content := service.CloneDomain("wiki", "docs")
+	assert.NoError(t, err)
+	assert.Contains(t, content, "ssl_client_certificate "+filepath.Join(newDir, clientBundleFile)+";")
+	bundle, err := os.ReadFile(filepath.Join(newDir, clientBundleFile))
+	assert.NoError(t, err)
+	assert.Equal(t, encodeCertificates(intermediate), bundle)
+	settings, err := service.GetSiteSettings("docs")
+	assert.NoError(t, err)
+	assert.Equal(t, &ClientAuthSettings{Bundle: true}, settings.ClientAuth)
+}
@@ -1,6 +1,9 @@
 package server
 
-import "flag"
+import (
+	"flag"
+	"time"
+)
 
 type Config struct {
 	IsDev      bool
@@ -10,6 +13,27 @@ type Config struct {
 	Pass       string
 	Port       string
 	RemoteHost string
+	// TrashRetention is how long removed domains are kept before they are purged
+	TrashRetention time.Duration
+	// DNS provider for ACME dns-01 challenges, needed for wildcard certificates
+	DNSProvider      string
+	DNSServer        string
+	DNSTsigKey       string
+	DNSTsigAlgorithm string
+	DNSWebhookURL    string
+	DNSWebhookToken  string
+	DNSManualFile    string
+	DNSPropagation   time.Duration
+	// KeyType is the default certificate key type: ec256, ec384, rsa2048 or rsa4096
+	KeyType string
+	// AcmeCA is the name or directory URL of the default CA, AcmeCAsFile lists more CAs
+	AcmeCA         string
+	AcmeCAsFile    string
+	AcmeEABKeyID   string
+	AcmeEABHMACKey string
+	AcmeRoots      string
+	// TLSProfile is the default TLS profile of sites: modern, intermediate or old
+	TLSProfile string
 }
 
 func LoadConfig() *Config {
@@ -20,16 +44,49 @@ func LoadConfig() *Config {
 	pass := flag.String("pass", "1", "password for auth")
 	port := flag.String("port", "3005", "http port")
 	remoteHost := flag.String("remoteHost", "", "Remote host to install Nginx")
+	trashRetention := flag.Duration("trashRetention", 30*24*time.Hour, "How long removed domains are kept in trash")
+	dnsProvider := flag.String("dnsProvider", "", "DNS provider for dns-01 challenges: rfc2136, webhook or manual")
+	dnsServer := flag.String("dnsServer", "", "DNS server for rfc2136 updates, host[:port]")
+	dnsTsigKey := flag.String("dnsTsigKey", "", "TSIG key for rfc2136 updates, name:secret")
+	dnsTsigAlgorithm := flag.String("dnsTsigAlgorithm", "hmac-sha256", "TSIG algorithm for rfc2136 updates")
+	dnsWebhookURL := flag.String("dnsWebhookURL", "", "URL receiving dns-01 records for the webhook provider")
+	dnsWebhookToken := flag.String("dnsWebhookToken", "", "Bearer token for the webhook provider")
+	dnsManualFile := flag.String("dnsManualFile", "", "File where the manual provider writes dns-01 records")
+	dnsPropagation := flag.Duration("dnsPropagation", 30*time.Second, "How long to wait for dns-01 records to propagate")
+	keyType := flag.String("keyType", "ec256", "Certificate key type: ec256, ec384, rsa2048 or rsa4096")
+	acmeCA := flag.String("acmeCA", "", "Default CA: letsencrypt, zerossl, google, buypass, a name from -acmeCAs or an ACME directory URL")
+	acmeCAsFile := flag.String("acmeCAs", "", "JSON file with additional CAs: [{name, directory, eabKid, eabHmacKey, email, roots}]")
+	acmeEABKeyID := flag.String("acmeEabKid", "", "External Account Binding key ID of the default CA")
+	acmeEABHMACKey := flag.String("acmeEabHmacKey", "", "External Account Binding HMAC key of the default CA, base64url")
+	tlsProfile := flag.String("tlsProfile", "intermediate", "Default TLS profile of sites: modern, intermediate or old")
+	acmeRoots := flag.String("acmeRoots", "", "PEM file with roots trusted for the default CA directory, e.g. of a private CA")
 
 	flag.Parse()
 
 	return &Config{
-		IsDev:      *isDev,
-		IsDocker:   *isDocker,
-		ConfigDir:  *configDir,
-		Email:      *email,
-		Pass:       *pass,
-		Port:       *port,
-		RemoteHost: *remoteHost,
+		IsDev:          *isDev,
+		IsDocker:       *isDocker,
+		ConfigDir:      *configDir,
+		Email:          *email,
+		Pass:           *pass,
+		Port:           *port,
+		RemoteHost:     *remoteHost,
+		TrashRetention: *trashRetention,
+
+		DNSProvider:      *dnsProvider,
+		DNSServer:        *dnsServer,
+		DNSTsigKey:       *dnsTsigKey,
+		DNSTsigAlgorithm: *dnsTsigAlgorithm,
+		DNSWebhookURL:    *dnsWebhookURL,
+		DNSWebhookToken:  *dnsWebhookToken,
+		DNSManualFile:    *dnsManualFile,
+		DNSPropagation:   *dnsPropagation,
+		KeyType:          *keyType,
+		AcmeCA:           *acmeCA,
+		AcmeCAsFile:      *acmeCAsFile,
+		AcmeEABKeyID:     *acmeEABKeyID,
+		AcmeEABHMACKey:   *acmeEABHMACKey,
+		AcmeRoots:        *acmeRoots,
+		TLSProfile:       *tlsProfile,
 	}
 }
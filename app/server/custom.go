@@ -0,0 +1,210 @@
+package server
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// UploadCertificate installs a PEM certificate chain with its private key,
+// e.g. bought from a commercial CA or issued by an internal PKI. The site
+// is switched to the custom certificate source so ACME doesn't replace it.
+func (s *Service) UploadCertificate(domain string, certPEM []byte, keyPEM []byte) error {
+	certs, err := parsePEMBundle(certPEM)
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+	return s.installCustomCertificate(domain, key, certs)
+}
+
+// UploadPKCS12 installs a certificate with its key and chain from a PKCS#12 (.pfx/.p12) archive
+func (s *Service) UploadPKCS12(domain string, data []byte, password string) error {
+	privateKey, leaf, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return fmt.Errorf("invalid PKCS#12 file: %v", err)
+	}
+	key, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("unsupported private key type")
+	}
+	return s.installCustomCertificate(domain, key, append([]*x509.Certificate{leaf}, caCerts...))
+}
+
+func (s *Service) installCustomCertificate(domain string, key crypto.Signer, certs []*x509.Certificate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	chain, err := buildCertificateChain(key, certs)
+	if err != nil {
+		return err
+	}
+	leaf := chain[0]
+	if time.Now().After(leaf.NotAfter) {
+		return errors.New("Certificate expired on " + leaf.NotAfter.Format(time.DateOnly))
+	}
+	err = checkCertificateNames(leaf, s.getServerNames(domain))
+	if err != nil {
+		return err
+	}
+
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+	oldSettings := *settings
+	oldContent, _ := s.nginx.GetConfig(domain)
+	domainDir := filepath.Join(s.cacheDir, domain)
+	backup := backupCertificateFiles(domainDir)
+
+	cert := &tls.Certificate{PrivateKey: key, Leaf: leaf}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	err = saveCertificate(cert, domainDir)
+	if err != nil {
+		backup.restore()
+		return err
+	}
+	settings.CertSource = CertSourceCustom
+	err = s.saveSiteSettings(domain, settings)
+	if err == nil {
+		err = s.activateCertificate(domain)
+	}
+	if err == nil {
+		err = s.nginx.TestConfig()
+	}
+	if err != nil {
+		backup.restore()
+		s.saveSiteSettings(domain, &oldSettings)
+		if oldContent != "" {
+			s.nginx.writeConfig(domain, oldContent)
+		}
+		return err
+	}
+	log.Printf("Custom certificate for %s issued by %s is installed, expires on %s", domain, leaf.Issuer.CommonName, leaf.NotAfter)
+
+	return s.nginx.Reload()
+}
+
+// checkCustomCertificate verifies the uploaded certificate still covers all names of the site
+func (s *Service) checkCustomCertificate(domain string) error {
+	content, err := os.ReadFile(filepath.Join(s.cacheDir, domain, "fullchain.pem"))
+	if err != nil {
+		return err
+	}
+	certs, err := parsePEMBundle(content)
+	if err != nil {
+		return err
+	}
+	return checkCertificateNames(certs[0], s.getServerNames(domain))
+}
+
+// buildCertificateChain finds the certificate of key and orders the rest so
+// that every certificate is followed by its issuer. Certificates which
+// don't belong to the chain are rejected.
+func buildCertificateChain(key crypto.Signer, certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	var rest []*x509.Certificate
+	for _, cert := range certs {
+		if chain == nil && publicKeysEqual(cert.PublicKey, key.Public()) {
+			chain = append(chain, cert)
+			continue
+		}
+		rest = append(rest, cert)
+	}
+	if chain == nil {
+		return nil, errors.New("Private key does not match the certificate")
+	}
+
+	for len(rest) > 0 {
+		current := chain[len(chain)-1]
+		found := -1
+		for i, cert := range rest {
+			if current.CheckSignatureFrom(cert) == nil {
+				found = i
+				break
+			}
+		}
+		if found < 0 {
+			return nil, fmt.Errorf("Certificate %s is not part of the chain of %s", rest[0].Subject.CommonName, chain[0].Subject.CommonName)
+		}
+		chain = append(chain, rest[found])
+		rest = append(rest[:found], rest[found+1:]...)
+	}
+	return chain, nil
+}
+
+// checkCertificateNames returns an error if the certificate doesn't cover all names
+func checkCertificateNames(leaf *x509.Certificate, names []string) error {
+	var missing []string
+	for _, name := range names {
+		if isWildcard(name) {
+			if !contains(leaf.DNSNames, name) {
+				missing = append(missing, name)
+			}
+			continue
+		}
+		if leaf.VerifyHostname(name) != nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return errors.New("Certificate does not cover " + strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
+
+// certificateBackup keeps certificate files of a site in memory so a failed install can be undone
+type certificateBackup map[string][]byte
+
+func backupCertificateFiles(dir string) certificateBackup {
+	backup := certificateBackup{}
+	for _, name := range []string{"fullchain.pem", "chain.pem", "privkey.pem"} {
+		path := filepath.Join(dir, name)
+		content, err := os.ReadFile(path)
+		if err == nil {
+			backup[path] = content
+		} else {
+			backup[path] = nil
+		}
+	}
+	return backup
+}
+
+func (b certificateBackup) restore() {
+	for path, content := range b {
+		if content == nil {
+			os.Remove(path)
+			continue
+		}
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(path, "privkey.pem") {
+			mode = 0600
+		}
+		err := writeFileAtomic(path, content, mode)
+		if err != nil {
+			log.Printf("Failed to restore %s: %v", path, err)
+		}
+	}
+}
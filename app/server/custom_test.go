@@ -0,0 +1,128 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// testCertificate issues a certificate signed by parent, a nil parent makes it self-signed
+func testCertificate(t *testing.T, name string, names []string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert, key
+}
+
+func testChain(t *testing.T, names []string) (*x509.Certificate, *x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	root, rootKey := testCertificate(t, "Test Root", nil, true, nil, nil)
+	intermediate, intermediateKey := testCertificate(t, "Test Intermediate", nil, true, root, rootKey)
+	leaf, leafKey := testCertificate(t, names[0], names, false, intermediate, intermediateKey)
+	return root, intermediate, leaf, leafKey
+}
+
+func TestBuildCertificateChain(t *testing.T) {
+	root, intermediate, leaf, key := testChain(t, []string{"example.com"})
+
+	chain, err := buildCertificateChain(key, []*x509.Certificate{root, leaf, intermediate})
+	assert.NoError(t, err, "Expected unordered chain to be accepted")
+	assert.Equal(t, []*x509.Certificate{leaf, intermediate, root}, chain, "Expected chain to be ordered from the leaf")
+
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, err = buildCertificateChain(otherKey, []*x509.Certificate{leaf, intermediate})
+	assert.EqualError(t, err, "Private key does not match the certificate")
+
+	other, _ := testCertificate(t, "Other Root", nil, true, nil, nil)
+	_, err = buildCertificateChain(key, []*x509.Certificate{leaf, other})
+	assert.Error(t, err, "Expected unrelated certificate to be rejected")
+}
+
+func TestCheckCertificateNames(t *testing.T) {
+	_, _, leaf, _ := testChain(t, []string{"example.com", "*.example.com"})
+	assert.NoError(t, checkCertificateNames(leaf, []string{"example.com", "www.example.com", "*.example.com"}))
+	assert.EqualError(t, checkCertificateNames(leaf, []string{"example.com", "example.org"}), "Certificate does not cover example.org")
+}
+
+func TestUploadCertificate(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	service := &Service{cacheDir: cacheDir, domains: []string{domain}, nginx: newFakeNginx(t, configDir, true)}
+
+	_, intermediate, leaf, key := testChain(t, []string{domain})
+	keyPEM, err := encodePrivateKey(key)
+	assert.NoError(t, err)
+
+	err = service.UploadCertificate(domain, encodeCertificates(intermediate, leaf), keyPEM)
+	assert.NoError(t, err, "Expected no error from UploadCertificate")
+	assert.True(t, service.isCustomCertificate(domain), "Expected site to use the custom certificate")
+	fullchain, _ := os.ReadFile(filepath.Join(cacheDir, domain, "fullchain.pem"))
+	assert.Equal(t, encodeCertificates(leaf, intermediate), fullchain, "Expected leaf first in fullchain.pem")
+
+	err = service.RenewCertificate(context.Background(), domain)
+	assert.Error(t, err, "Expected custom certificate not to be renewed with ACME")
+
+	_, _, otherLeaf, otherKey := testChain(t, []string{"example.org"})
+	otherKeyPEM, _ := encodePrivateKey(otherKey)
+	err = service.UploadCertificate(domain, encodeCertificates(otherLeaf), otherKeyPEM)
+	assert.EqualError(t, err, "Certificate does not cover example.com")
+}
+
+func TestUploadPKCS12RollsBackInvalidConfig(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	service := &Service{cacheDir: cacheDir, domains: []string{domain}, nginx: newFakeNginx(t, configDir, false)}
+
+	_, intermediate, leaf, key := testChain(t, []string{domain})
+	p12, err := pkcs12.Modern.Encode(key, leaf, []*x509.Certificate{intermediate}, "secret")
+	assert.NoError(t, err)
+
+	err = service.UploadPKCS12(domain, p12, "wrong")
+	assert.Error(t, err, "Expected error for wrong password")
+
+	err = service.UploadPKCS12(domain, p12, "secret")
+	assert.Error(t, err, "Expected error when nginx rejects the config")
+	assert.False(t, service.isCustomCertificate(domain), "Expected settings to be restored")
+	assert.NoFileExists(t, filepath.Join(cacheDir, domain, "fullchain.pem"), "Expected certificate files to be removed")
+}
+
+func TestRenewalSchedulerSkipsCustomCertificates(t *testing.T) {
+	scheduler, clock, calls := newTestScheduler(t, "example.com")
+	cacheDir := scheduler.service.cacheDir
+	writeTestCertificate(t, filepath.Join(cacheDir, "example.com"), "example.com", []string{"example.com"}, clock.Now(), clock.Now().Add(10*24*time.Hour))
+	assert.NoError(t, scheduler.service.saveSiteSettings("example.com", &SiteSettings{CertSource: CertSourceCustom}))
+
+	scheduler.tick(context.Background())
+	assert.Equal(t, 0, calls["example.com"], "Expected custom certificate not to be renewed")
+	assert.Equal(t, clock.Now(), scheduler.state["example.com"].warnedAt, "Expected expiry warning")
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// DNSProvider publishes TXT records for ACME dns-01 challenges.
+// fqdn is the full record name like _acme-challenge.example.com. and
+// value is the challenge record content.
+type DNSProvider interface {
+	Present(ctx context.Context, fqdn string, value string) error
+	CleanUp(ctx context.Context, fqdn string, value string) error
+}
+
+// newDNSProvider creates the provider selected by -dnsProvider, nil means dns-01 is not available
+func newDNSProvider(config *Config) (DNSProvider, error) {
+	switch config.DNSProvider {
+	case "":
+		return nil, nil
+	case "rfc2136":
+		if config.DNSServer == "" {
+			return nil, errors.New("rfc2136 provider needs -dnsServer")
+		}
+		return &rfc2136Provider{
+			server:    config.DNSServer,
+			tsigKey:   config.DNSTsigKey,
+			algorithm: config.DNSTsigAlgorithm,
+		}, nil
+	case "webhook":
+		if config.DNSWebhookURL == "" {
+			return nil, errors.New("webhook provider needs -dnsWebhookURL")
+		}
+		return &webhookProvider{url: config.DNSWebhookURL, token: config.DNSWebhookToken, client: http.DefaultClient}, nil
+	case "manual":
+		if config.DNSManualFile == "" {
+			return nil, errors.New("manual provider needs -dnsManualFile")
+		}
+		return &manualProvider{file: config.DNSManualFile}, nil
+	}
+	return nil, fmt.Errorf("unknown DNS provider %s", config.DNSProvider)
+}
+
+// rfc2136Provider sends dynamic DNS updates with nsupdate
+type rfc2136Provider struct {
+	server    string
+	tsigKey   string // name:secret
+	algorithm string
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, fqdn string, value string) error {
+	return p.update(ctx, fmt.Sprintf("update add %s 60 TXT \"%s\"", fqdn, value))
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return p.update(ctx, fmt.Sprintf("update delete %s TXT \"%s\"", fqdn, value))
+}
+
+func (p *rfc2136Provider) update(ctx context.Context, command string) error {
+	var script strings.Builder
+	script.WriteString("server " + strings.Replace(p.server, ":", " ", 1) + "\n")
+	if p.tsigKey != "" {
+		name, secret, _ := strings.Cut(p.tsigKey, ":")
+		if p.algorithm != "" {
+			name = p.algorithm + ":" + name
+		}
+		script.WriteString("key " + name + " " + secret + "\n")
+	}
+	script.WriteString(command + "\nsend\n")
+
+	cmd := exec.CommandContext(ctx, "nsupdate")
+	cmd.Stdin = strings.NewReader(script.String())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Printf("[DNS]: nsupdate failed: %v, %s", err, string(output))
+		return fmt.Errorf("nsupdate failed: %v %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// webhookProvider posts challenge records to an HTTP endpoint which updates the DNS zone
+type webhookProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type webhookRequest struct {
+	Action string `json:"action"`
+	FQDN   string `json:"fqdn"`
+	Value  string `json:"value"`
+}
+
+func (p *webhookProvider) Present(ctx context.Context, fqdn string, value string) error {
+	return p.send(ctx, webhookRequest{Action: "present", FQDN: fqdn, Value: value})
+}
+
+func (p *webhookProvider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	return p.send(ctx, webhookRequest{Action: "cleanup", FQDN: fqdn, Value: value})
+}
+
+func (p *webhookProvider) send(ctx context.Context, body webhookRequest) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("[DNS]: webhook %s failed: %v", body.Action, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("DNS webhook %s returned %s", body.Action, resp.Status)
+	}
+	return nil
+}
+
+// manualProvider writes challenge records to a file, one "fqdn TXT value"
+// line per record, so they can be published by hand or by test tooling
+type manualProvider struct {
+	file string
+	mu   sync.Mutex
+}
+
+func (p *manualProvider) Present(ctx context.Context, fqdn string, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(p.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s TXT %s\n", fqdn, value)
+	if err == nil {
+		log.Printf("[DNS]: publish TXT record %s = %s", fqdn, value)
+	}
+	return err
+}
+
+func (p *manualProvider) CleanUp(ctx context.Context, fqdn string, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	content, err := os.ReadFile(p.file)
+	if err != nil {
+		return err
+	}
+	record := fmt.Sprintf("%s TXT %s", fqdn, value)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		if line != record && line != "" {
+			lines = append(lines, line)
+		}
+	}
+	result := strings.Join(lines, "\n")
+	if result != "" {
+		result += "\n"
+	}
+	return os.WriteFile(p.file, []byte(result), 0644)
+}
+
+// challengeRecordName returns the TXT record name for a dns-01 challenge of domain
+func challengeRecordName(domain string) string {
+	return "_acme-challenge." + strings.TrimPrefix(domain, "*.") + "."
+}
+
+func isWildcard(domain string) bool {
+	return strings.HasPrefix(domain, "*.")
+}
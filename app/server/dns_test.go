@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManualProvider(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "records.txt")
+	provider := &manualProvider{file: file}
+	ctx := context.Background()
+
+	assert.NoError(t, provider.Present(ctx, "_acme-challenge.example.com.", "value1"))
+	assert.NoError(t, provider.Present(ctx, "_acme-challenge.example.com.", "value2"))
+	content, _ := os.ReadFile(file)
+	assert.Equal(t, "_acme-challenge.example.com. TXT value1\n_acme-challenge.example.com. TXT value2\n", string(content))
+
+	assert.NoError(t, provider.CleanUp(ctx, "_acme-challenge.example.com.", "value1"))
+	content, _ = os.ReadFile(file)
+	assert.Equal(t, "_acme-challenge.example.com. TXT value2\n", string(content), "Expected only the cleaned up record to be removed")
+}
+
+func TestWebhookProvider(t *testing.T) {
+	var received webhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+
+	provider := &webhookProvider{url: server.URL, token: "secret", client: server.Client()}
+	err := provider.Present(context.Background(), "_acme-challenge.example.com.", "value")
+	assert.NoError(t, err, "Expected no error from webhook provider")
+	assert.Equal(t, webhookRequest{Action: "present", FQDN: "_acme-challenge.example.com.", Value: "value"}, received)
+}
+
+func TestWildcardDomain(t *testing.T) {
+	assert.True(t, isValidDomain("*.example.com"), "Expected wildcard domain to be valid")
+	assert.False(t, isValidDomain("a.*.example.com"), "Expected wildcard to be allowed as leftmost label only")
+	assert.Equal(t, "_acme-challenge.example.com.", challengeRecordName("*.example.com"))
+}
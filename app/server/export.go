@@ -0,0 +1,121 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	ExportPEM    = "pem"
+	ExportPKCS12 = "p12"
+	ExportTar    = "tar"
+)
+
+// CertificateExport is certificate material of a site packed for another server
+type CertificateExport struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// ExportCertificate packs the certificate files of a site: "pem" is the
+// full chain followed by the key, "p12" is PKCS#12 protected by password
+// and "tar" is a gzipped tarball of cert, chain, fullchain and key files.
+func (s *Service) ExportCertificate(domain string, format string, password string) (*CertificateExport, error) {
+	if !contains(s.listDomains(), domain) {
+		return nil, errors.New("Domain does not exist")
+	}
+	path := filepath.Join(s.cacheDir, domain)
+	fullchainPEM, err := os.ReadFile(filepath.Join(path, "fullchain.pem"))
+	if err != nil {
+		return nil, errors.New("Site has no certificate")
+	}
+	keyPEM, err := os.ReadFile(filepath.Join(path, "privkey.pem"))
+	if err != nil {
+		return nil, errors.New("Site has no private key")
+	}
+	certs, err := parsePEMBundle(fullchainPEM)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case ExportPEM:
+		return &CertificateExport{
+			Filename:    domain + ".pem",
+			ContentType: "application/x-pem-file",
+			Content:     append(append([]byte{}, fullchainPEM...), keyPEM...),
+		}, nil
+	case ExportPKCS12:
+		if password == "" {
+			return nil, errors.New("Password is required for PKCS#12")
+		}
+		content, err := pkcs12.Modern.Encode(key, certs[0], certs[1:], password)
+		if err != nil {
+			return nil, err
+		}
+		return &CertificateExport{Filename: domain + ".p12", ContentType: "application/x-pkcs12", Content: content}, nil
+	case ExportTar:
+		content, err := certificateTarball(domain, certs, fullchainPEM, keyPEM)
+		if err != nil {
+			return nil, err
+		}
+		return &CertificateExport{Filename: domain + ".tar.gz", ContentType: "application/gzip", Content: content}, nil
+	}
+	return nil, errors.New("Unknown export format " + format)
+}
+
+// certificateTarball packs the files in a directory named after the domain
+func certificateTarball(domain string, certs []*x509.Certificate, fullchainPEM []byte, keyPEM []byte) ([]byte, error) {
+	files := []struct {
+		name    string
+		content []byte
+		mode    int64
+	}{
+		{"cert.pem", encodeCertificates(certs[:1]...), 0644},
+		{"chain.pem", encodeCertificates(certs[1:]...), 0644},
+		{"fullchain.pem", fullchainPEM, 0644},
+		{"privkey.pem", keyPEM, 0600},
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, file := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    domain + "/" + file.name,
+			Mode:    file.mode,
+			Size:    int64(len(file.content)),
+			ModTime: now,
+		})
+		if err != nil {
+			return nil, err
+		}
+		_, err = tw.Write(file.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/tls"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestExportCertificate(t *testing.T) {
+	cacheDir := t.TempDir()
+	domain := "example.com"
+	domainDir := filepath.Join(cacheDir, domain)
+	assert.NoError(t, os.MkdirAll(domainDir, 0755))
+	service := &Service{cacheDir: cacheDir, domains: []string{domain}}
+
+	_, err := service.ExportCertificate(domain, ExportPEM, "")
+	assert.EqualError(t, err, "Site has no certificate")
+
+	_, intermediate, leaf, key := testChain(t, []string{domain})
+	cert := &tls.Certificate{Certificate: [][]byte{leaf.Raw, intermediate.Raw}, PrivateKey: key}
+	assert.NoError(t, saveCertificate(cert, domainDir))
+	keyPEM, _ := os.ReadFile(filepath.Join(domainDir, "privkey.pem"))
+
+	export, err := service.ExportCertificate(domain, ExportPEM, "")
+	assert.NoError(t, err, "Expected no error from PEM export")
+	assert.Equal(t, "example.com.pem", export.Filename)
+	assert.Equal(t, append(encodeCertificates(leaf, intermediate), keyPEM...), export.Content)
+
+	_, err = service.ExportCertificate(domain, ExportPKCS12, "")
+	assert.EqualError(t, err, "Password is required for PKCS#12")
+	export, err = service.ExportCertificate(domain, ExportPKCS12, "secret")
+	assert.NoError(t, err, "Expected no error from PKCS#12 export")
+	p12Key, p12Leaf, p12Chain, err := pkcs12.DecodeChain(export.Content, "secret")
+	assert.NoError(t, err)
+	assert.True(t, publicKeysEqual(key.Public(), p12Key.(crypto.Signer).Public()))
+	assert.Equal(t, leaf.Raw, p12Leaf.Raw)
+	assert.Len(t, p12Chain, 1)
+
+	export, err = service.ExportCertificate(domain, ExportTar, "")
+	assert.NoError(t, err, "Expected no error from tarball export")
+	assert.Equal(t, "example.com.tar.gz", export.Filename)
+	gz, err := gzip.NewReader(bytes.NewReader(export.Content))
+	assert.NoError(t, err)
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		files[header.Name], _ = io.ReadAll(tr)
+	}
+	assert.Equal(t, encodeCertificates(leaf), files["example.com/cert.pem"])
+	assert.Equal(t, encodeCertificates(intermediate), files["example.com/chain.pem"])
+	assert.Equal(t, keyPEM, files["example.com/privkey.pem"])
+
+	_, err = service.ExportCertificate(domain, "jks", "")
+	assert.EqualError(t, err, "Unknown export format jks")
+	_, err = service.ExportCertificate("unknown.com", ExportPEM, "")
+	assert.EqualError(t, err, "Domain does not exist")
+}
+
+func TestTokenRole(t *testing.T) {
+	token, err := createToken("admin@example.com", RoleAdmin)
+	assert.NoError(t, err)
+	claims, err := verifyToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, RoleAdmin, claims["role"])
+
+	token, _ = createToken("viewer@example.com", "")
+	claims, err = verifyToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "", claims["role"], "Expected no role")
+}
@@ -0,0 +1,528 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultImportPatterns are where Debian and RHEL style installs keep their sites
+var DefaultImportPatterns = []string{"/etc/nginx/sites-enabled/*", "/etc/nginx/conf.d/*.conf"}
+
+const (
+	// ImportMigrate moves server blocks into conf/<domain>/nginx.conf and copies certificates
+	ImportMigrate = "migrate"
+	// ImportInPlace links conf/<domain>/nginx.conf to the existing file, edits go to that file
+	ImportInPlace = "inplace"
+)
+
+// importedDir keeps the original files of migrated sites in ConfigDir
+const importedDir = "imported"
+
+// ImportedSite is a site found in existing nginx configs
+type ImportedSite struct {
+	Domain  string
+	Aliases []string
+	// Files are the config files with server blocks of the site
+	Files []string
+	// Blocks is the number of server blocks, e.g. 2 for HTTP redirect and HTTPS
+	Blocks      int
+	Certificate string
+	Key         string
+	// Certbot is set for certificates in /etc/letsencrypt/live, certbot keeps renewing them
+	Certbot bool
+	Cert    *CertInfo
+	// Problem is why the site can't be imported, empty when it can
+	Problem string
+	// InPlace reports whether the site can be managed in place
+	InPlace bool
+
+	blocks []importBlock
+}
+
+// ImportPreview is what an import would do
+type ImportPreview struct {
+	Sites   []ImportedSite
+	Skipped []string
+}
+
+// importBlock is a server block in a config file
+type importBlock struct {
+	file    string
+	start   int
+	end     int
+	names   []string
+	tls     bool
+	cert    string
+	key     string
+	content string
+}
+
+// importFile is a parsed config file
+type importFile struct {
+	path    string
+	content string
+	// other is set when the file has directives besides server blocks
+	other  bool
+	blocks []importBlock
+}
+
+// scanImport parses the files matching patterns and groups their server
+// blocks by the first server name, so the HTTP redirect and the HTTPS
+// server of a domain become one site
+func (s *Service) scanImport(patterns []string) ([]*importFile, *ImportPreview, error) {
+	var paths []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, nil, errors.New("Invalid pattern " + pattern)
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err == nil && info.Mode().IsRegular() && !contains(paths, match) {
+				paths = append(paths, match)
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil, errors.New("No config files match " + strings.Join(patterns, " "))
+	}
+
+	preview := &ImportPreview{}
+	var files []*importFile
+	sites := map[string]*ImportedSite{}
+	var order []string
+	for _, path := range paths {
+		file, err := parseImportFile(path)
+		if err != nil {
+			preview.Skipped = append(preview.Skipped, path+": "+err.Error())
+			continue
+		}
+		files = append(files, file)
+		for _, block := range file.blocks {
+			domain := ""
+			for _, name := range block.names {
+				if isValidDomain(name) || isValidInternalName(name) && strings.Contains(name, ".") {
+					domain = strings.ToLower(name)
+					break
+				}
+			}
+			if domain == "" {
+				preview.Skipped = append(preview.Skipped, path+": server without a domain name "+strings.Join(block.names, " "))
+				continue
+			}
+			site, ok := sites[domain]
+			if !ok {
+				site = &ImportedSite{Domain: domain}
+				sites[domain] = site
+				order = append(order, domain)
+			}
+			for _, name := range block.names {
+				name = strings.ToLower(name)
+				if name != domain && !contains(site.Aliases, name) && (isValidDomain(name) || isValidInternalName(name)) {
+					site.Aliases = append(site.Aliases, name)
+				}
+			}
+			if !contains(site.Files, path) {
+				site.Files = append(site.Files, path)
+			}
+			if block.cert != "" && site.Certificate == "" {
+				site.Certificate, site.Key = block.cert, block.key
+			}
+			site.blocks = append(site.blocks, block)
+			site.Blocks++
+		}
+	}
+
+	managed := s.listDomains()
+	for _, domain := range order {
+		site := sites[domain]
+		site.Certbot = strings.Contains(site.Certificate, "/letsencrypt/live/")
+		switch {
+		case contains(managed, domain):
+			site.Problem = "Domain is already managed"
+		case site.Certificate != "" && site.Key == "":
+			site.Problem = "Certificate " + site.Certificate + " has no ssl_certificate_key"
+		case site.Certificate != "":
+			info, err := ReadCertInfo(site.Certificate)
+			if err != nil {
+				site.Problem = "Certificate " + site.Certificate + " is not readable: " + err.Error()
+			} else if _, err := os.ReadFile(site.Key); err != nil {
+				site.Problem = "Key " + site.Key + " is not readable: " + err.Error()
+			} else {
+				site.Cert = info
+			}
+		}
+		site.InPlace = canImportInPlace(site, files)
+		preview.Sites = append(preview.Sites, *site)
+	}
+	return files, preview, nil
+}
+
+// parseImportFile finds the server blocks at the top level or in http of a config file
+func parseImportFile(path string) (*importFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	directives, err := parseNginxConfig(string(content))
+	if err != nil {
+		return nil, err
+	}
+	file := &importFile{path: path, content: string(content)}
+	var httpCert, httpKey string
+	walkConfDirectives(directives, nil, func(d *confDirective, parents []string) {
+		if len(parents) == 1 && parents[0] == "http" && len(d.args) == 1 {
+			switch d.name {
+			case "ssl_certificate":
+				httpCert = d.args[0]
+			case "ssl_certificate_key":
+				httpKey = d.args[0]
+			}
+		}
+	})
+	walkConfDirectives(directives, nil, func(d *confDirective, parents []string) {
+		top := len(parents) == 0 || len(parents) == 1 && parents[0] == "http"
+		if !top {
+			return
+		}
+		if d.name != "server" || !d.block {
+			if len(parents) == 0 {
+				file.other = true
+			}
+			return
+		}
+		block := importBlock{file: path, start: d.start, end: d.end, content: string(content[d.start:d.end]), cert: httpCert, key: httpKey}
+		for _, child := range d.children {
+			switch child.name {
+			case "server_name":
+				block.names = append(block.names, child.args...)
+			case "listen":
+				block.tls = block.tls || contains(child.args, "ssl")
+			case "ssl":
+				block.tls = block.tls || contains(child.args, "on")
+			case "ssl_certificate":
+				if len(child.args) == 1 {
+					block.cert = child.args[0]
+				}
+			case "ssl_certificate_key":
+				if len(child.args) == 1 {
+					block.key = child.args[0]
+				}
+			}
+		}
+		// the http level certificate only matters to TLS servers
+		if !block.tls {
+			block.cert, block.key = "", ""
+		}
+		file.blocks = append(file.blocks, block)
+	})
+	return file, nil
+}
+
+// canImportInPlace reports whether the site is the only content of a
+// single file enabled by a symlink, like sites-enabled. Removing the
+// symlink stops nginx from loading the file twice.
+func canImportInPlace(site *ImportedSite, files []*importFile) bool {
+	if len(site.Files) != 1 {
+		return false
+	}
+	info, err := os.Lstat(site.Files[0])
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return false
+	}
+	for _, file := range files {
+		if file.path == site.Files[0] {
+			return !file.other && len(file.blocks) == len(site.blocks)
+		}
+	}
+	return false
+}
+
+// PreviewImport lists the sites of existing configs matching patterns
+func (s *Service) PreviewImport(patterns []string) (*ImportPreview, error) {
+	_, preview, err := s.scanImport(patterns)
+	return preview, err
+}
+
+// importChange undoes a step of an import
+type importChange func()
+
+// ImportSites makes the selected domains of existing configs managed
+// sites. With ImportMigrate the server blocks are moved to
+// conf/<domain>/nginx.conf, certificates are copied next to it and the
+// originals are kept in ConfigDir/imported. With ImportInPlace the config
+// stays where it is. Everything is rolled back if nginx -t fails.
+func (s *Service) ImportSites(patterns []string, domains []string, mode string) ([]string, error) {
+	if mode != ImportMigrate && mode != ImportInPlace {
+		return nil, errors.New("Unknown import mode " + mode)
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("Select sites to import")
+	}
+	files, preview, err := s.scanImport(patterns)
+	if err != nil {
+		return nil, err
+	}
+	var sites []ImportedSite
+	for _, domain := range domains {
+		found := false
+		for _, site := range preview.Sites {
+			if site.Domain != domain {
+				continue
+			}
+			if site.Problem != "" {
+				return nil, errors.New(domain + ": " + site.Problem)
+			}
+			if mode == ImportInPlace && !site.InPlace {
+				return nil, errors.New(domain + " shares its file or is not enabled by a symlink, migrate it instead")
+			}
+			sites = append(sites, site)
+			found = true
+		}
+		if !found {
+			return nil, errors.New("Site " + domain + " is not found")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var undo []importChange
+	rollback := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+	for _, site := range sites {
+		var changes []importChange
+		if mode == ImportInPlace {
+			changes, err = s.importInPlace(site)
+		} else {
+			changes, err = s.importMigrate(site)
+		}
+		undo = append(undo, changes...)
+		if err != nil {
+			log.Printf("Failed to import %s: %v", site.Domain, err)
+			rollback()
+			return nil, err
+		}
+	}
+	if mode == ImportMigrate {
+		changes, err := s.removeImportedBlocks(files, sites)
+		undo = append(undo, changes...)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+	}
+
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Imported config is invalid, rolling back: %v", err)
+		rollback()
+		return nil, err
+	}
+	var imported []string
+	for _, site := range sites {
+		s.domains = append(s.domains, site.Domain)
+		imported = append(imported, site.Domain)
+	}
+	log.Printf("Sites %v are imported (%s)", imported, mode)
+	return imported, s.nginx.Reload()
+}
+
+// importMigrate writes the server blocks of a site to its domain directory
+// with certificate paths pointing at copies in the same directory
+func (s *Service) importMigrate(site ImportedSite) ([]importChange, error) {
+	domainDir := filepath.Join(s.cacheDir, site.Domain)
+	err := os.Mkdir(domainDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	changes := []importChange{func() { os.RemoveAll(domainDir) }}
+
+	var blocks []string
+	for _, block := range site.blocks {
+		content := block.content
+		if block.cert != "" {
+			content, err = rewriteCertificatePaths(content, filepath.Join(domainDir, "fullchain.pem"), filepath.Join(domainDir, "privkey.pem"))
+			if err != nil {
+				return changes, err
+			}
+		}
+		blocks = append(blocks, content)
+	}
+	content := "# imported from " + strings.Join(site.Files, ", ") + "\n" + strings.Join(blocks, "\n\n") + "\n"
+	err = os.WriteFile(filepath.Join(domainDir, "nginx.conf"), []byte(content), 0644)
+	if err != nil {
+		return changes, err
+	}
+	return changes, s.importCertificate(site, domainDir, site.Certbot)
+}
+
+// importInPlace links the domain directory to the existing config file and
+// removes the symlink which enabled it
+func (s *Service) importInPlace(site ImportedSite) ([]importChange, error) {
+	enabled := site.Files[0]
+	target, err := filepath.EvalSymlinks(enabled)
+	if err != nil {
+		return nil, err
+	}
+	link, err := os.Readlink(enabled)
+	if err != nil {
+		return nil, err
+	}
+	domainDir := filepath.Join(s.cacheDir, site.Domain)
+	err = os.Mkdir(domainDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	changes := []importChange{func() { os.RemoveAll(domainDir) }}
+	err = os.Symlink(target, filepath.Join(domainDir, "nginx.conf"))
+	if err != nil {
+		return changes, err
+	}
+	// the config keeps using the original certificate files
+	err = s.importCertificate(site, domainDir, true)
+	if err != nil {
+		return changes, err
+	}
+	err = os.Remove(enabled)
+	if err != nil {
+		return changes, err
+	}
+	changes = append(changes, func() { os.Symlink(link, enabled) })
+	return changes, nil
+}
+
+// importCertificate makes the certificate of a site available in its
+// domain directory and saves the site settings. Linked certificates pick
+// up renewals by certbot, otherwise they are copied. Imported certificates
+// are not renewed by nginx-ui, sites without TLS stay on HTTP.
+func (s *Service) importCertificate(site ImportedSite, domainDir string, link bool) error {
+	settings := &SiteSettings{Aliases: site.Aliases, ImportedFrom: strings.Join(site.Files, ", ")}
+	if site.Certificate != "" {
+		settings.CertSource = CertSourceCustom
+		files := map[string]string{"fullchain.pem": site.Certificate, "privkey.pem": site.Key}
+		for name, source := range files {
+			target := filepath.Join(domainDir, name)
+			if link {
+				err := os.Symlink(source, target)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			content, err := os.ReadFile(source)
+			if err != nil {
+				return err
+			}
+			perm := os.FileMode(0644)
+			if name == "privkey.pem" {
+				perm = 0600
+			}
+			err = os.WriteFile(target, content, perm)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		settings.CertSource = CertSourceNone
+	}
+	return s.saveSiteSettings(site.Domain, settings)
+}
+
+// removeImportedBlocks takes the migrated server blocks out of the original
+// files. A copy of every changed file is kept in ConfigDir/imported and a
+// file left without directives is moved there.
+func (s *Service) removeImportedBlocks(files []*importFile, sites []ImportedSite) ([]importChange, error) {
+	var changes []importChange
+	dir := filepath.Join(s.configDir, importedDir, time.Now().UTC().Format(backupTimeFormat))
+	for _, file := range files {
+		var blocks []importBlock
+		for _, site := range sites {
+			for _, block := range site.blocks {
+				if block.file == file.path {
+					blocks = append(blocks, block)
+				}
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return changes, err
+		}
+		// files of different directories may have the same name
+		kept := filepath.Join(dir, strings.ReplaceAll(strings.TrimPrefix(file.path, "/"), "/", "_"))
+		err = os.WriteFile(kept, []byte(file.content), 0644)
+		if err != nil {
+			return changes, err
+		}
+		path, content := file.path, file.content
+		changes = append(changes, func() { os.WriteFile(path, []byte(content), 0644) })
+
+		sort.Slice(blocks, func(i, j int) bool { return blocks[i].start > blocks[j].start })
+		remaining := file.content
+		for _, block := range blocks {
+			remaining = remaining[:block.start] + remaining[block.end:]
+		}
+		directives, err := parseNginxConfig(remaining)
+		if err == nil && len(directives) == 0 {
+			// a symlink is removed, the file it points to stays
+			info, lerr := os.Lstat(path)
+			if lerr == nil && info.Mode()&os.ModeSymlink != 0 {
+				link, _ := os.Readlink(path)
+				err = os.Remove(path)
+				changes = append(changes, func() { os.Symlink(link, path) })
+			} else {
+				err = os.Remove(path)
+			}
+		} else {
+			err = os.WriteFile(path, []byte(remaining), 0644)
+		}
+		if err != nil {
+			return changes, err
+		}
+		log.Printf("Imported server blocks are removed from %s, the original is kept in %s", path, kept)
+	}
+	return changes, nil
+}
+
+// rewriteCertificatePaths points ssl_certificate and ssl_certificate_key of a server block at new files
+func rewriteCertificatePaths(content string, cert string, key string) (string, error) {
+	directives, err := parseNginxConfig(content)
+	if err != nil {
+		return "", err
+	}
+	type replacement struct {
+		start, end int
+		value      string
+	}
+	var replacements []replacement
+	walkConfDirectives(directives, nil, func(d *confDirective, parents []string) {
+		switch d.name {
+		case "ssl_certificate":
+			replacements = append(replacements, replacement{d.argsStart, d.argsEnd, cert})
+		case "ssl_certificate_key":
+			replacements = append(replacements, replacement{d.argsStart, d.argsEnd, key})
+		}
+	})
+	// the certificate came from the http block, the server gets its own
+	if len(replacements) == 0 && len(directives) == 1 && directives[0].block {
+		server := directives[0]
+		insert := "\n    ssl_certificate        " + cert + ";\n    ssl_certificate_key    " + key + ";"
+		return content[:server.bodyStart] + insert + content[server.bodyStart:], nil
+	}
+	sort.Slice(replacements, func(i, j int) bool { return replacements[i].start > replacements[j].start })
+	for _, r := range replacements {
+		content = content[:r.start] + r.value + content[r.end:]
+	}
+	return content, nil
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newImportTestInstall creates a Debian style /etc/nginx with a certbot
+// site enabled by a symlink and a conf.d file with two sites and an upstream
+func newImportTestInstall(t *testing.T) (string, []string) {
+	etc := t.TempDir()
+	live := filepath.Join(etc, "letsencrypt", "live", "example.com")
+	writeTestCertificate(t, live, "R11", []string{"example.com", "www.example.com"}, time.Now().Add(-time.Hour), time.Now().Add(60*24*time.Hour))
+	assert.NoError(t, os.WriteFile(filepath.Join(live, "privkey.pem"), []byte("key"), 0600))
+	shopCerts := filepath.Join(etc, "ssl", "shop")
+	writeTestCertificate(t, shopCerts, "Internal CA", []string{"shop.example.org"}, time.Now().Add(-time.Hour), time.Now().Add(300*24*time.Hour))
+	assert.NoError(t, os.WriteFile(filepath.Join(shopCerts, "shop.key"), []byte("shop key"), 0600))
+
+	files := map[string]string{
+		"nginx/sites-available/example.com": `server {
+    listen 80;
+    server_name example.com www.example.com;
+    return 301 https://$host$request_uri;
+}
+
+server {
+    listen 443 ssl http2;
+    server_name example.com www.example.com;
+    ssl_certificate ` + live + `/fullchain.pem;
+    ssl_certificate_key ` + live + `/privkey.pem;
+    root /var/www/example;
+}
+`,
+		"nginx/sites-available/default": `server {
+    listen 80 default_server;
+    server_name _;
+    return 444;
+}
+`,
+		"nginx/conf.d/apps.conf": `upstream shop { server 127.0.0.1:8080; }
+
+server {
+    listen 443 ssl;
+    server_name shop.example.org;
+    ssl_certificate "` + shopCerts + `/fullchain.pem";
+    ssl_certificate_key ` + shopCerts + `/shop.key;
+    location / { proxy_pass http://shop; }
+}
+
+# the api has no TLS yet
+server {
+    listen 80;
+    server_name api.example.org;
+    location / { proxy_pass http://127.0.0.1:9000; }
+}
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(etc, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	enabled := filepath.Join(etc, "nginx", "sites-enabled")
+	assert.NoError(t, os.MkdirAll(enabled, 0755))
+	for _, site := range []string{"example.com", "default"} {
+		assert.NoError(t, os.Symlink(filepath.Join(etc, "nginx", "sites-available", site), filepath.Join(enabled, site)))
+	}
+	return etc, []string{enabled + "/*", filepath.Join(etc, "nginx", "conf.d", "*.conf")}
+}
+
+func newImportTestService(t *testing.T, valid bool) *Service {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "managed.com"), 0755))
+	return &Service{
+		configDir: configDir,
+		cacheDir:  cacheDir,
+		domains:   []string{"managed.com"},
+		nginx:     newFakeNginx(t, configDir, valid),
+	}
+}
+
+func TestPreviewImport(t *testing.T) {
+	etc, patterns := newImportTestInstall(t)
+	service := newImportTestService(t, true)
+
+	preview, err := service.PreviewImport(patterns)
+	assert.NoError(t, err)
+	assert.Len(t, preview.Sites, 3)
+	sites := map[string]ImportedSite{}
+	for _, site := range preview.Sites {
+		sites[site.Domain] = site
+	}
+
+	example := sites["example.com"]
+	assert.Equal(t, []string{"www.example.com"}, example.Aliases)
+	assert.Equal(t, 2, example.Blocks, "Expected the redirect and the HTTPS server to be one site")
+	assert.True(t, example.Certbot)
+	assert.True(t, example.InPlace)
+	assert.Empty(t, example.Problem)
+	assert.Equal(t, []string{"example.com", "www.example.com"}, example.Cert.Names)
+
+	shop := sites["shop.example.org"]
+	assert.False(t, shop.Certbot)
+	assert.False(t, shop.InPlace, "A conf.d file with other sites can't stay in place")
+	assert.Equal(t, filepath.Join(etc, "ssl", "shop", "shop.key"), shop.Key)
+
+	api := sites["api.example.org"]
+	assert.Empty(t, api.Certificate)
+	assert.Len(t, preview.Skipped, 1, "Expected the default server to be skipped")
+	assert.Contains(t, preview.Skipped[0], "server without a domain name _")
+
+	_, err = service.PreviewImport([]string{filepath.Join(etc, "missing", "*")})
+	assert.Error(t, err)
+}
+
+func TestImportMigrate(t *testing.T) {
+	etc, patterns := newImportTestInstall(t)
+	service := newImportTestService(t, true)
+
+	imported, err := service.ImportSites(patterns, []string{"example.com", "shop.example.org"}, ImportMigrate)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"example.com", "shop.example.org"}, imported)
+	assert.Equal(t, []string{"managed.com", "example.com", "shop.example.org"}, service.domains)
+
+	// the certbot certificate is linked, so renewals by certbot are picked up
+	exampleDir := filepath.Join(service.cacheDir, "example.com")
+	target, err := os.Readlink(filepath.Join(exampleDir, "fullchain.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(etc, "letsencrypt", "live", "example.com", "fullchain.pem"), target)
+	content, err := service.nginx.GetConfig("example.com")
+	assert.NoError(t, err)
+	assert.Contains(t, content, "ssl_certificate "+exampleDir+"/fullchain.pem;")
+	assert.Contains(t, content, "ssl_certificate_key "+exampleDir+"/privkey.pem;")
+	assert.Contains(t, content, "return 301 https://$host$request_uri;")
+	settings, err := service.GetSiteSettings("example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"www.example.com"}, settings.Aliases)
+	assert.Equal(t, CertSourceCustom, settings.CertSource)
+	_, err = os.Lstat(filepath.Join(etc, "nginx", "sites-enabled", "example.com"))
+	assert.True(t, os.IsNotExist(err), "Expected the enabling symlink to be removed")
+	_, err = os.Stat(filepath.Join(etc, "nginx", "sites-available", "example.com"))
+	assert.NoError(t, err, "Expected the linked file to stay")
+
+	// other certificates are copied
+	shopDir := filepath.Join(service.cacheDir, "shop.example.org")
+	key, err := os.ReadFile(filepath.Join(shopDir, "privkey.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, "shop key", string(key))
+	info, err := os.Lstat(filepath.Join(shopDir, "privkey.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode())
+
+	// the api and the upstream stay in conf.d
+	rest, err := os.ReadFile(filepath.Join(etc, "nginx", "conf.d", "apps.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(rest), "upstream shop")
+	assert.Contains(t, string(rest), "server_name api.example.org;")
+	assert.NotContains(t, string(rest), "shop.example.org")
+	kept, err := filepath.Glob(filepath.Join(service.configDir, importedDir, "*", "*apps.conf"))
+	assert.NoError(t, err)
+	assert.Len(t, kept, 1, "Expected the original file to be kept")
+
+	_, err = service.ImportSites(patterns, []string{"api.example.org", "shop.example.org"}, ImportMigrate)
+	assert.EqualError(t, err, "Site shop.example.org is not found")
+}
+
+func TestImportInPlace(t *testing.T) {
+	etc, patterns := newImportTestInstall(t)
+	service := newImportTestService(t, true)
+
+	_, err := service.ImportSites(patterns, []string{"shop.example.org"}, ImportInPlace)
+	assert.EqualError(t, err, "shop.example.org shares its file or is not enabled by a symlink, migrate it instead")
+
+	_, err = service.ImportSites(patterns, []string{"example.com"}, ImportInPlace)
+	assert.NoError(t, err)
+	available := filepath.Join(etc, "nginx", "sites-available", "example.com")
+	target, err := os.Readlink(filepath.Join(service.cacheDir, "example.com", "nginx.conf"))
+	assert.NoError(t, err)
+	assert.Equal(t, available, target)
+
+	// edits go to the original file
+	content, err := service.nginx.GetConfig("example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, service.nginx.writeConfig("example.com", strings.Replace(content, "/var/www/example", "/srv/example", 1)))
+	original, err := os.ReadFile(available)
+	assert.NoError(t, err)
+	assert.Contains(t, string(original), "root /srv/example;")
+}
+
+func TestImportedHTTPOnlySiteIsNotRenewed(t *testing.T) {
+	_, patterns := newImportTestInstall(t)
+	service := newImportTestService(t, true)
+	_, err := service.ImportSites(patterns, []string{"api.example.org"}, ImportMigrate)
+	assert.NoError(t, err)
+	assert.Equal(t, CertSourceNone, service.certSource("api.example.org"))
+
+	calls := make(map[string]int)
+	scheduler := newRenewalScheduler(service)
+	scheduler.resolve = func(domain string) bool { return true }
+	scheduler.renew = func(ctx context.Context, domain string) error {
+		calls[domain]++
+		return errors.New("acme error")
+	}
+	scheduler.tick(context.Background())
+	assert.Equal(t, 0, calls["api.example.org"], "Expected no certificate order for a site without TLS")
+	assert.Equal(t, 1, calls["managed.com"], "Expected the managed site without certificate to be issued")
+
+	assert.EqualError(t, service.RenewCertificate(context.Background(), "api.example.org"), "Site is served over HTTP only, it has no certificate to renew")
+}
+
+func TestImportRollsBackInvalidConfig(t *testing.T) {
+	etc, patterns := newImportTestInstall(t)
+	service := newImportTestService(t, false)
+	before, err := os.ReadFile(filepath.Join(etc, "nginx", "conf.d", "apps.conf"))
+	assert.NoError(t, err)
+
+	_, err = service.ImportSites(patterns, []string{"example.com", "shop.example.org"}, ImportMigrate)
+	assert.Error(t, err, "Expected nginx -t to fail")
+	assert.Equal(t, []string{"managed.com"}, service.domains)
+	_, err = os.Stat(filepath.Join(service.cacheDir, "example.com"))
+	assert.True(t, os.IsNotExist(err))
+	after, err := os.ReadFile(filepath.Join(etc, "nginx", "conf.d", "apps.conf"))
+	assert.NoError(t, err)
+	assert.Equal(t, string(before), string(after))
+	_, err = os.Readlink(filepath.Join(etc, "nginx", "sites-enabled", "example.com"))
+	assert.NoError(t, err, "Expected the symlink to be put back")
+}
+
+func TestRewriteCertificatePaths(t *testing.T) {
+	content, err := rewriteCertificatePaths("server {\n    listen 443 ssl;\n    ssl_certificate \"/a b/cert.pem\";\n    ssl_certificate_key /a/key.pem;\n}", "/new/fullchain.pem", "/new/privkey.pem")
+	assert.NoError(t, err)
+	assert.Equal(t, "server {\n    listen 443 ssl;\n    ssl_certificate /new/fullchain.pem;\n    ssl_certificate_key /new/privkey.pem;\n}", content)
+
+	// a certificate inherited from the http block is added to the server
+	content, err = rewriteCertificatePaths("server {\n    listen 443 ssl;\n}", "/new/fullchain.pem", "/new/privkey.pem")
+	assert.NoError(t, err)
+	assert.Contains(t, content, "ssl_certificate        /new/fullchain.pem;")
+}
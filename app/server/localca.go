@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// CertSourceLocal marks a site with certificates from the local CA
+const CertSourceLocal = "local"
+
+const (
+	localCARootFile = "rootCA.pem"
+	localCAKeyFile  = "rootCA-key.pem"
+	// localCertLifetime matches ACME certificates, so they renew on the same schedule
+	localCertLifetime = 90 * 24 * time.Hour
+)
+
+// localCA issues certificates for internal host names and IP addresses
+// which can't be validated by a public CA. The root is created on first
+// use and has to be installed as trusted on the clients.
+type localCA struct {
+	dir string
+	// name is the common name of the root, a random suffix is added on creation
+	name string
+
+	mu   sync.Mutex
+	root *x509.Certificate
+	key  crypto.Signer
+}
+
+func newLocalCA(dir string) *localCA {
+	return &localCA{dir: dir, name: "nginx-ui Local CA"}
+}
+
+// Obtain issues a certificate for domains signed by the local root
+func (ca *localCA) Obtain(ctx context.Context, domains []string, keyType string) (*tls.Certificate, error) {
+	root, rootKey, err := ca.load()
+	if err != nil {
+		return nil, err
+	}
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domains[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(localCertLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, name := range domains {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, root, key.Public(), rootKey)
+	if err != nil {
+		log.Printf("[LocalCA]: failed to issue certificate for %v: %v", domains, err)
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[LocalCA]: issued certificate for %v", domains)
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// HTTPHandler has nothing to serve, the local CA doesn't validate names
+func (ca *localCA) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+// RootPEM returns the root certificate for installation on clients
+func (ca *localCA) RootPEM() ([]byte, error) {
+	root, _, err := ca.load()
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}), nil
+}
+
+// reset drops the cached root, it is read again on next use
+func (ca *localCA) reset() {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.root, ca.key = nil, nil
+}
+
+// load reads the root from dir or creates a new one
+func (ca *localCA) load() (*x509.Certificate, crypto.Signer, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if ca.root != nil {
+		return ca.root, ca.key, nil
+	}
+	rootPath := filepath.Join(ca.dir, localCARootFile)
+	keyPath := filepath.Join(ca.dir, localCAKeyFile)
+
+	rootPEM, err := os.ReadFile(rootPath)
+	if os.IsNotExist(err) {
+		err = ca.create(rootPath, keyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		rootPEM, err = os.ReadFile(rootPath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := parsePEMBundle(rootPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !publicKeysEqual(certs[0].PublicKey, key.Public()) {
+		return nil, nil, errors.New("local CA key does not match " + rootPath)
+	}
+
+	ca.root, ca.key = certs[0], key
+	return ca.root, ca.key, nil
+}
+
+func (ca *localCA) create(rootPath string, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	// a unique name keeps roots of different installations apart in trust stores
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: ca.name + " " + hex.EncodeToString(suffix), Organization: []string{"nginx-ui"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodePrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(ca.dir, 0700)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(keyPath, keyPEM, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(rootPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	log.Printf("[LocalCA]: created root %s", template.Subject.CommonName)
+	return nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// isValidInternalName accepts names the local CA can issue for: IPv4
+// addresses and host names without public suffix like "nas" or "router.lan"
+func isValidInternalName(name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.To4() != nil
+	}
+	const namePattern = `^(?:\*\.)?[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`
+	return regexp.MustCompile(namePattern).MatchString(name)
+}
+
+// isValidName checks a site name or alias for the certificate source
+func isValidName(name string, source string) bool {
+	if source == CertSourceLocal {
+		return isValidInternalName(name)
+	}
+	return isValidDomain(name)
+}
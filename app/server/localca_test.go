@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalCAIssuesForInternalNames(t *testing.T) {
+	dir := t.TempDir()
+	ca := newLocalCA(dir)
+
+	cert, err := ca.Obtain(context.Background(), []string{"nas.lan", "nas", "192.168.1.10"}, KeyTypeEC256)
+	assert.NoError(t, err, "Expected no error from Obtain")
+	assert.Equal(t, []string{"nas.lan", "nas"}, cert.Leaf.DNSNames)
+	assert.True(t, cert.Leaf.IPAddresses[0].Equal(net.ParseIP("192.168.1.10")), "Expected IP address in the certificate")
+	assert.FileExists(t, filepath.Join(dir, localCAKeyFile))
+
+	rootPEM, err := ca.RootPEM()
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	assert.True(t, pool.AppendCertsFromPEM(rootPEM))
+	for _, name := range []string{"nas.lan", "192.168.1.10"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: pool})
+		assert.NoError(t, err, "Expected certificate to verify against the root for %s", name)
+	}
+
+	// the root is kept across restarts
+	reloaded, err := newLocalCA(dir).RootPEM()
+	assert.NoError(t, err)
+	assert.Equal(t, rootPEM, reloaded)
+}
+
+func TestLocalCertSource(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "intranet"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	service := &Service{
+		configDir: configDir,
+		cacheDir:  cacheDir,
+		domains:   []string{domain},
+		cert:      &Cert{local: newLocalCA(filepath.Join(configDir, "certs", "local-ca")), keyType: KeyTypeEC256},
+		nginx:     newFakeNginx(t, configDir, true),
+	}
+
+	assert.Error(t, service.validateNewDomain("wiki", ""), "Expected internal name to be rejected for ACME")
+	assert.NoError(t, service.validateNewDomain("wiki", CertSourceLocal), "Expected internal name to be accepted for the local CA")
+	_, err := service.validateAliases(domain, []string{"10.0.0.5"}, "")
+	assert.Error(t, err, "Expected IP alias to be rejected for ACME")
+
+	assert.NoError(t, service.saveSiteSettings(domain, &SiteSettings{Aliases: []string{"10.0.0.5"}}))
+	err = service.SetCertSource(domain, CertSourceLocal)
+	assert.NoError(t, err, "Expected certificate from the local CA")
+	info, err := ReadCertInfo(filepath.Join(cacheDir, domain, "fullchain.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{domain, "10.0.0.5"}, info.Names)
+	assert.Equal(t, CertSourceLocal, service.certSource(domain))
+
+	err = service.SetCertSource(domain, "")
+	assert.Error(t, err, "Expected switching an internal name to ACME to fail")
+}
+
+func TestIsValidInternalName(t *testing.T) {
+	assert.True(t, isValidInternalName("nas"))
+	assert.True(t, isValidInternalName("printer.office.lan"))
+	assert.True(t, isValidInternalName("10.0.0.1"))
+	assert.False(t, isValidInternalName("::1"), "Expected IPv6 addresses to be rejected")
+	assert.False(t, isValidInternalName("bad_name"))
+	assert.False(t, isValidInternalName("-nas"))
+}
+
+func TestRenewalSchedulerRenewsLocalWithoutResolving(t *testing.T) {
+	scheduler, _, calls := newTestScheduler(t, "nas")
+	scheduler.resolve = func(domain string) bool { return false }
+	assert.NoError(t, scheduler.service.saveSiteSettings("nas", &SiteSettings{CertSource: CertSourceLocal}))
+
+	scheduler.tick(context.Background())
+	assert.Equal(t, 1, calls["nas"], "Expected local certificate to be issued for a name which doesn't resolve")
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// managedInclude loads the managed sites, it is relative to the nginx
+// config directory, which is ConfigDir
+const managedInclude = "conf/*/nginx.conf"
+
+// MainConfigStatus tells whether nginx loads the managed site configs
+type MainConfigStatus struct {
+	Path string
+	// Included is set when the http block includes conf/*/nginx.conf
+	Included bool
+	// Problem explains why managed sites are not served, empty when they are
+	Problem string
+	// CanInclude is set when the include can be added to the http block
+	CanInclude bool
+}
+
+// CheckMainConfig inspects the main nginx.conf for an include of the managed site configs
+func (s *Service) CheckMainConfig() *MainConfigStatus {
+	status := &MainConfigStatus{Path: filepath.Join(s.configDir, "nginx.conf")}
+	content, err := os.ReadFile(status.Path)
+	if os.IsNotExist(err) {
+		status.Problem = "Main config " + status.Path + " does not exist"
+		return status
+	}
+	if err != nil {
+		status.Problem = "Main config is not readable: " + err.Error()
+		return status
+	}
+	directives, err := parseNginxConfig(string(content))
+	if err != nil {
+		status.Problem = "Main config can't be parsed: " + err.Error()
+		return status
+	}
+	if findHTTPBlock(directives) == nil {
+		status.Problem = "Main config has no http block, managed sites are not served"
+		return status
+	}
+	status.Included = s.includesManagedSites(directives)
+	if !status.Included {
+		status.Problem = "Main config doesn't include " + managedInclude + ", managed sites are not served"
+		status.CanInclude = true
+	}
+	return status
+}
+
+func findHTTPBlock(directives []*confDirective) *confDirective {
+	for _, d := range directives {
+		if d.name == "http" && d.block {
+			return d
+		}
+	}
+	return nil
+}
+
+// includesManagedSites reports whether an include in the http block
+// matches the site configs. Absolute patterns may be paths in the nginx
+// container, so their last elements are compared as well.
+func (s *Service) includesManagedSites(directives []*confDirective) bool {
+	probe := filepath.Join(s.cacheDir, "example.com", "nginx.conf")
+	included := false
+	walkConfDirectives(directives, nil, func(d *confDirective, parents []string) {
+		if d.name != "include" || len(d.args) != 1 || !contains(parents, "http") {
+			return
+		}
+		pattern := d.args[0]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(s.configDir, pattern)
+		}
+		if ok, _ := filepath.Match(pattern, probe); ok {
+			included = true
+			return
+		}
+		elements := strings.Split(filepath.ToSlash(d.args[0]), "/")
+		if len(elements) >= 3 {
+			tail := strings.Join(elements[len(elements)-3:], "/")
+			if ok, _ := filepath.Match(tail, "conf/example.com/nginx.conf"); ok {
+				included = true
+			}
+		}
+	})
+	return included
+}
+
+// EnsureMainInclude adds the include of the managed sites to the end of
+// the http block of the main config. The change is reverted if nginx -t
+// fails.
+func (s *Service) EnsureMainInclude() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer func() { s.setup = s.checkSetup() }()
+
+	status := s.CheckMainConfig()
+	if status.Included {
+		return nil
+	}
+	if !status.CanInclude {
+		return errors.New(status.Problem)
+	}
+	oldContent, err := s.nginx.GetConfig("main")
+	if err != nil {
+		return err
+	}
+	directives, err := parseNginxConfig(oldContent)
+	if err != nil {
+		return err
+	}
+	http := findHTTPBlock(directives)
+	body := strings.TrimRight(oldContent[:http.bodyEnd], " \t")
+	content := body + "\n    include " + managedInclude + ";\n" + oldContent[http.bodyEnd:]
+	err = s.nginx.writeConfig("main", content)
+	if err != nil {
+		return err
+	}
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Main config with the include of managed sites is invalid, reverting: %v", err)
+		s.nginx.writeConfig("main", oldContent)
+		return err
+	}
+	log.Printf("Main config includes %s", managedInclude)
+	return s.nginx.Reload()
+}
+
+// bootstrapConfigDir creates the layout of a fresh ConfigDir: the conf
+// directory for sites and, when there is none, a main config including them.
+// A missing ConfigDir is not created, it may be a mistyped -configDir.
+func (s *Service) bootstrapConfigDir() error {
+	if _, err := os.Stat(s.cacheDir); os.IsNotExist(err) {
+		err = os.Mkdir(s.cacheDir, 0755)
+		if err != nil {
+			return err
+		}
+		log.Printf("Created site directory %s", s.cacheDir)
+	}
+	mainPath := filepath.Join(s.configDir, "nginx.conf")
+	if _, err := os.Stat(mainPath); !os.IsNotExist(err) {
+		return nil
+	}
+	// nginx reports a missing main config itself, sites can still be managed
+	err := s.writeMainConfig(mainPath)
+	if err != nil {
+		log.Printf("Failed to create main config %s: %v", mainPath, err)
+	}
+	return nil
+}
+
+func (s *Service) writeMainConfig(mainPath string) error {
+	templatePath, err := s.findTemplate("main.tmpl")
+	if err != nil {
+		return err
+	}
+	data := struct {
+		MimeTypes bool
+		Include   string
+	}{
+		MimeTypes: fileExists(filepath.Join(s.configDir, "mime.types")),
+		Include:   managedInclude,
+	}
+	err = s.renderConfigTemplate(templatePath, mainPath, data)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created main config %s", mainPath)
+	return nil
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMainConfig(t *testing.T) {
+	configDir := t.TempDir()
+	service := &Service{configDir: configDir, cacheDir: filepath.Join(configDir, "conf")}
+	mainPath := filepath.Join(configDir, "nginx.conf")
+
+	status := service.CheckMainConfig()
+	assert.False(t, status.Included)
+	assert.Equal(t, "Main config "+mainPath+" does not exist", status.Problem)
+
+	tests := []struct {
+		content  string
+		included bool
+		problem  string
+	}{
+		{"events {}\nhttp {\n    include conf/*/nginx.conf;\n}\n", true, ""},
+		// the path of ConfigDir in the nginx container
+		{"http {\n    include /etc/nginx/conf/*/nginx.conf;\n}\n", true, ""},
+		{"http {\n    include " + configDir + "/conf/*.com/nginx.conf;\n}\n", true, ""},
+		{"http {\n    # include conf/*/nginx.conf;\n    include conf.d/*.conf;\n}\n", false, "Main config doesn't include conf/*/nginx.conf, managed sites are not served"},
+		{"include conf/*/nginx.conf;\nevents {}\n", false, "Main config has no http block, managed sites are not served"},
+		{"http {\n", false, "Main config can't be parsed: unexpected end of config in block http"},
+	}
+	for _, test := range tests {
+		assert.NoError(t, os.WriteFile(mainPath, []byte(test.content), 0644))
+		status := service.CheckMainConfig()
+		assert.Equal(t, test.included, status.Included, test.content)
+		assert.Equal(t, test.problem, status.Problem, test.content)
+	}
+}
+
+func TestEnsureMainInclude(t *testing.T) {
+	configDir := t.TempDir()
+	mainPath := filepath.Join(configDir, "nginx.conf")
+	original := "events {}\n\nhttp {\n    include mime.types;\n}\n"
+	assert.NoError(t, os.WriteFile(mainPath, []byte(original), 0644))
+
+	service := &Service{configDir: configDir, cacheDir: filepath.Join(configDir, "conf"), nginx: newFakeNginx(t, configDir, false)}
+	err := service.EnsureMainInclude()
+	assert.Error(t, err, "Expected nginx -t to fail")
+	content, err := os.ReadFile(mainPath)
+	assert.NoError(t, err)
+	assert.Equal(t, original, string(content), "Expected the main config to be reverted")
+
+	service.nginx = newFakeNginx(t, configDir, true)
+	assert.NoError(t, service.EnsureMainInclude())
+	content, err = os.ReadFile(mainPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "events {}\n\nhttp {\n    include mime.types;\n\n    include conf/*/nginx.conf;\n}\n", string(content))
+	assert.True(t, service.CheckMainConfig().Included)
+
+	// nothing changes once the include is there
+	assert.NoError(t, service.EnsureMainInclude())
+	again, err := os.ReadFile(mainPath)
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), string(again))
+
+	assert.NoError(t, os.WriteFile(mainPath, []byte("events {}\n"), 0644))
+	assert.EqualError(t, service.EnsureMainInclude(), "Main config has no http block, managed sites are not served")
+}
+
+func TestBootstrapConfigDir(t *testing.T) {
+	configDir := filepath.Join(t.TempDir(), "nginx")
+	service := &Service{configDir: configDir, cacheDir: filepath.Join(configDir, "conf")}
+	assert.Error(t, service.bootstrapConfigDir(), "Expected a missing ConfigDir not to be created")
+
+	assert.NoError(t, os.Mkdir(configDir, 0755))
+	assert.NoError(t, service.bootstrapConfigDir())
+	info, err := os.Stat(service.cacheDir)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	domains, err := getDirectories(service.cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, domains)
+}
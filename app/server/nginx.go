@@ -8,10 +8,14 @@ import (
 	"strings"
 )
 
+const disabledSuffix = ".disabled"
+
 type nginx struct {
 	rootPath string
 	isDev    bool
 	isDocker bool
+	// notify reports failed reloads, nil in tests
+	notify func(event string, domain string, message string)
 }
 
 func NewNginx(config *Config) *nginx {
@@ -22,9 +26,23 @@ func (n *nginx) getFullName(domain string) string {
 	if domain == "main" {
 		return n.rootPath + "/nginx.conf"
 	}
-	return n.rootPath + "/conf/" + domain + "/nginx.conf"
+	fullName := n.rootPath + "/conf/" + domain + "/nginx.conf"
+	// disabled sites keep their config aside, so nginx does not include it
+	if _, err := os.Stat(fullName); os.IsNotExist(err) {
+		if _, err := os.Stat(fullName + disabledSuffix); err == nil {
+			return fullName + disabledSuffix
+		}
+	}
+	return fullName
 }
 func (n *nginx) runNginxCommand(args []string) string {
+	output, _ := n.execNginx(args)
+	return output
+}
+
+// execNginx runs nginx and returns its output, nginx -t exits with non zero
+// code on invalid config so the output is kept on error too
+func (n *nginx) execNginx(args []string) (string, error) {
 	executable := "nginx"
 	if n.isDocker {
 		executable = "docker"
@@ -33,29 +51,66 @@ func (n *nginx) runNginxCommand(args []string) string {
 	cmd := exec.Command(executable, args...)
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("nginx run command error: %v\n", err)
-		return ""
+		log.Printf("nginx run command error: %v, %s\n", err, string(stdoutStderr))
+		return string(stdoutStderr), err
 	}
 	log.Printf("nginx run command output: %v\n", string(stdoutStderr))
-	return string(stdoutStderr)
+	return string(stdoutStderr), nil
 }
 
+// CheckNewConfig tests newContent in place of the config of name with
+// nginx -t, nginx is not reloaded. A disabled site is tested under its
+// enabled name, otherwise nginx doesn't include the candidate.
 func (n *nginx) CheckNewConfig(name string, newContent string) error {
 	fullPath := n.getFullName(name)
+	testPath := strings.TrimSuffix(fullPath, disabledSuffix)
 	err := os.Rename(fullPath, fullPath+".orig")
 	if err != nil {
 		return err
 	}
 	defer os.Rename(fullPath+".orig", fullPath)
-	err = n.SetConfig(name, newContent)
+	if testPath != fullPath {
+		defer os.Remove(testPath)
+	}
+	err = n.writeFile(testPath, newContent)
 	if err != nil {
 		return err
 	}
+	return n.TestConfig()
+}
+
+// CheckInstalled verifies that nginx can be run, directly or in the nginx docker container
+func (n *nginx) CheckInstalled() error {
+	if !n.isDocker {
+		if _, err := exec.LookPath("nginx"); err != nil {
+			return errors.New("nginx is not installed or not in PATH")
+		}
+		return nil
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		return errors.New("docker is not installed or not in PATH")
+	}
+	// fails without access to the docker socket too
+	output, err := exec.Command("docker", "inspect", "-f", "{{.State.Running}}", "nginx").CombinedOutput()
+	if err != nil {
+		return errors.New("nginx container is not available: " + strings.TrimSpace(string(output)))
+	}
+	if strings.TrimSpace(string(output)) != "true" {
+		return errors.New("nginx container is not running")
+	}
+	return nil
+}
+
+// TestConfig runs nginx -t against the whole config tree as it is on disk
+func (n *nginx) TestConfig() error {
 	status := n.runNginxCommand([]string{"-t"})
 	if strings.Contains(status, "syntax is ok") {
 		return nil
 	}
-	return errors.New("invalid config")
+	if status == "" {
+		return errors.New("invalid config")
+	}
+	return errors.New("invalid config: " + strings.TrimSpace(status))
 }
 
 func (n *nginx) GetConfig(name string) (string, error) {
@@ -68,21 +123,55 @@ func (n *nginx) GetConfig(name string) (string, error) {
 }
 
 func (n *nginx) SetConfig(name string, content string) error {
-	fullPath := n.getFullName(name)
+	err := n.writeConfig(name, content)
+	if err != nil {
+		return err
+	}
+	n.RefreshConfig()
+	return nil
+}
+
+// writeConfig stores the config on disk without reloading nginx
+func (n *nginx) writeConfig(name string, content string) error {
+	return n.writeFile(n.getFullName(name), content)
+}
+
+func (n *nginx) writeFile(fullPath string, content string) error {
 	err := os.WriteFile(fullPath, []byte(content), 0644)
 	if err != nil {
 		log.Printf("Failed to write config %s: %v", fullPath, err)
 		return err
 	}
-	n.RefreshConfig()
 	return nil
 }
 
-func (n *nginx) RefreshConfig()  {
+func (n *nginx) RefreshConfig() {
+	err := n.Reload()
+	if err != nil {
+		log.Printf("nginx config is not reloaded: %v", err)
+	}
+}
+
+// Reload validates the config tree and signals nginx to reload it
+func (n *nginx) Reload() error {
 	log.Println("reloading nginx config")
-	status := n.runNginxCommand([]string{"-t"})
-	if strings.Contains(status, "syntax is ok") {
-		n.runNginxCommand([]string{"-s", "reload"})
-		log.Println("nginx config is reloaded")
+	err := n.TestConfig()
+	if err != nil {
+		n.report(EventConfigInvalid, err)
+		return err
+	}
+	output, err := n.execNginx([]string{"-s", "reload"})
+	if err != nil {
+		err = errors.New("reload failed: " + strings.TrimSpace(output))
+		n.report(EventReloadFailed, err)
+		return err
+	}
+	log.Println("nginx config is reloaded")
+	return nil
+}
+
+func (n *nginx) report(event string, err error) {
+	if n.notify != nil {
+		n.notify(event, "", err.Error())
 	}
 }
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"strings"
+)
+
+// confDirective is a single directive of an nginx config file together with
+// its byte offsets in the source, so callers can rewrite parts of the file
+// without re-formatting the rest of it.
+type confDirective struct {
+	name      string
+	args      []string
+	start     int // offset of the directive name
+	argsStart int // offset of the first argument (or of the terminator if there are none)
+	argsEnd   int // offset of the terminating ';' or '{'
+	end       int // offset right after ';' or the closing '}'
+	bodyStart int // blocks only: offset right after '{'
+	bodyEnd   int // blocks only: offset of the closing '}'
+	block     bool
+	children  []*confDirective
+}
+
+type confToken struct {
+	value  string
+	start  int
+	end    int
+	quoted bool
+}
+
+// parseNginxConfig parses nginx config syntax into a tree of directives.
+// It understands quoting, comments and nested blocks, which is all that is
+// needed to locate directives and blocks reliably.
+func parseNginxConfig(content string) ([]*confDirective, error) {
+	tokens, err := tokenizeNginxConfig(content)
+	if err != nil {
+		return nil, err
+	}
+	directives, pos, err := parseConfBlock(tokens, 0)
+	if err != nil {
+		return nil, err
+	}
+	if pos < len(tokens) {
+		return nil, errors.New("unexpected '}' in config")
+	}
+	return directives, nil
+}
+
+func parseConfBlock(tokens []confToken, pos int) ([]*confDirective, int, error) {
+	var directives []*confDirective
+	for pos < len(tokens) {
+		token := tokens[pos]
+		if !token.quoted && token.value == "}" {
+			return directives, pos, nil
+		}
+		if !token.quoted && (token.value == ";" || token.value == "{") {
+			return nil, pos, errors.New("unexpected '" + token.value + "' in config")
+		}
+
+		d := &confDirective{name: token.value, start: token.start}
+		pos++
+		d.argsStart = -1
+		for pos < len(tokens) {
+			t := tokens[pos]
+			if !t.quoted && (t.value == ";" || t.value == "{" || t.value == "}") {
+				break
+			}
+			if d.argsStart < 0 {
+				d.argsStart = t.start
+			}
+			d.args = append(d.args, t.value)
+			pos++
+		}
+		if pos >= len(tokens) {
+			return nil, pos, errors.New("unexpected end of config in directive " + d.name)
+		}
+		t := tokens[pos]
+		if d.argsStart < 0 {
+			d.argsStart = t.start
+		}
+		d.argsEnd = t.start
+		switch t.value {
+		case ";":
+			d.end = t.end
+			pos++
+		case "{":
+			d.block = true
+			d.bodyStart = t.end
+			children, next, err := parseConfBlock(tokens, pos+1)
+			if err != nil {
+				return nil, next, err
+			}
+			if next >= len(tokens) {
+				return nil, next, errors.New("unexpected end of config in block " + d.name)
+			}
+			d.children = children
+			d.bodyEnd = tokens[next].start
+			d.end = tokens[next].end
+			pos = next + 1
+		default:
+			return nil, pos, errors.New("directive " + d.name + " is not terminated by ';'")
+		}
+		directives = append(directives, d)
+	}
+	return directives, pos, nil
+}
+
+func tokenizeNginxConfig(content string) ([]confToken, error) {
+	var tokens []confToken
+	i := 0
+	for i < len(content) {
+		c := content[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '#':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+		case c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, confToken{value: string(c), start: i, end: i + 1})
+			i++
+		case c == '"' || c == '\'':
+			start := i
+			var value strings.Builder
+			i++
+			for i < len(content) && content[i] != c {
+				if content[i] == '\\' && i+1 < len(content) {
+					i++
+				}
+				value.WriteByte(content[i])
+				i++
+			}
+			if i >= len(content) {
+				return nil, errors.New("unterminated quoted string in config")
+			}
+			i++
+			tokens = append(tokens, confToken{value: value.String(), start: start, end: i, quoted: true})
+		default:
+			start := i
+			for i < len(content) {
+				c := content[i]
+				if c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == ';' || c == '}' {
+					break
+				}
+				// "${var}" is part of the word, any other '{' opens a block
+				if c == '{' && (i == start || content[i-1] != '$') {
+					break
+				}
+				if c == '{' {
+					for i < len(content) && content[i] != '}' {
+						i++
+					}
+				}
+				i++
+			}
+			tokens = append(tokens, confToken{value: content[start:i], start: start, end: i})
+		}
+	}
+	return tokens, nil
+}
+
+// walkConfDirectives calls fn for every directive in the tree, depth first.
+// parents holds the names of the enclosing blocks, outermost first.
+func walkConfDirectives(directives []*confDirective, parents []string, fn func(d *confDirective, parents []string)) {
+	for _, d := range directives {
+		fn(d, parents)
+		if d.block {
+			walkConfDirectives(d.children, append(append([]string{}, parents...), d.name), fn)
+		}
+	}
+}
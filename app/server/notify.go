@@ -0,0 +1,414 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const notificationSettingsFile = "notifications.json"
+
+const (
+	EventRenewalFailed = "renewal_failed"
+	EventCertExpiring  = "cert_expiring"
+	EventReloadFailed  = "reload_failed"
+	EventConfigInvalid = "config_invalid"
+	EventBackupFailed  = "backup_failed"
+	// EventTest is sent by the Test button of a channel, it passes every filter
+	EventTest = "test"
+)
+
+// NotificationEvents lists the events channels can subscribe to
+var NotificationEvents = []string{EventRenewalFailed, EventCertExpiring, EventReloadFailed, EventConfigInvalid, EventBackupFailed}
+
+const (
+	ChannelSMTP     = "smtp"
+	ChannelWebhook  = "webhook"
+	ChannelSlack    = "slack"
+	ChannelTelegram = "telegram"
+)
+
+// NotificationChannelTypes lists the supported channels
+var NotificationChannelTypes = []string{ChannelSMTP, ChannelWebhook, ChannelSlack, ChannelTelegram}
+
+// defaultExpiryWarningDays is used until a number of days is configured
+const defaultExpiryWarningDays = 14
+
+// Notification is an event sent to the channels subscribed to it
+type Notification struct {
+	Event   string    `json:"event"`
+	Domain  string    `json:"domain,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// Text is the notification as sent to chats, the message may have several lines
+func (n Notification) Text() string {
+	if n.Domain == "" {
+		return "nginx-ui " + n.Event + ": " + n.Message
+	}
+	return "nginx-ui " + n.Event + " " + n.Domain + ": " + n.Message
+}
+
+// NotificationChannel is where notifications are delivered, only the fields of its type are used
+type NotificationChannel struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Events the channel receives, empty means all
+	Events []string `json:"events,omitempty"`
+
+	// URL of a generic or Slack compatible webhook
+	URL string `json:"url,omitempty"`
+
+	// SMTP server, port 465 uses TLS, other ports STARTTLS when the server offers it
+	SMTPHost     string   `json:"smtpHost,omitempty"`
+	SMTPPort     int      `json:"smtpPort,omitempty"`
+	SMTPUsername string   `json:"smtpUsername,omitempty"`
+	SMTPPassword string   `json:"smtpPassword,omitempty"`
+	From         string   `json:"from,omitempty"`
+	To           []string `json:"to,omitempty"`
+
+	// Telegram bot and the chat it posts to
+	TelegramToken  string `json:"telegramToken,omitempty"`
+	TelegramChatID string `json:"telegramChatId,omitempty"`
+}
+
+// Subscribed reports whether the channel receives event
+func (c NotificationChannel) Subscribed(event string) bool {
+	return event == EventTest || len(c.Events) == 0 || contains(c.Events, event)
+}
+
+// NotificationSettings are stored as notifications.json in ConfigDir
+type NotificationSettings struct {
+	// ExpiryWarningDays is how many days before expiry a certificate is reported
+	ExpiryWarningDays int                   `json:"expiryWarningDays,omitempty"`
+	Channels          []NotificationChannel `json:"channels,omitempty"`
+}
+
+// notifier delivers notifications to the configured channels
+type notifier struct {
+	path   string
+	client *http.Client
+	// telegramAPI is the Bot API address, tests replace it with a stand-in
+	telegramAPI string
+
+	mu sync.Mutex
+}
+
+func newNotifier(configDir string) *notifier {
+	return &notifier{
+		path:        filepath.Join(configDir, notificationSettingsFile),
+		client:      &http.Client{Timeout: 30 * time.Second},
+		telegramAPI: "https://api.telegram.org",
+	}
+}
+
+func (n *notifier) load() (*NotificationSettings, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	settings := &NotificationSettings{}
+	content, err := os.ReadFile(n.path)
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, settings)
+	if err != nil {
+		log.Printf("Failed to parse %s: %v", n.path, err)
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (n *notifier) save(settings *NotificationSettings) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	content, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	// the file has SMTP passwords and bot tokens
+	return writeFileAtomic(n.path, content, 0600)
+}
+
+// expiryWarning returns how long before expiry certificates are reported
+func (n *notifier) expiryWarning() time.Duration {
+	days := defaultExpiryWarningDays
+	if n != nil {
+		if settings, err := n.load(); err == nil && settings.ExpiryWarningDays > 0 {
+			days = settings.ExpiryWarningDays
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Notify sends a notification to every channel subscribed to its event
+func (n *notifier) Notify(notification Notification) error {
+	settings, err := n.load()
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, channel := range settings.Channels {
+		if !channel.Subscribed(notification.Event) {
+			continue
+		}
+		err := n.send(channel, notification)
+		if err != nil {
+			log.Printf("Failed to send %s notification to %s: %v", notification.Event, channel.Name, err)
+			errs = append(errs, fmt.Errorf("%s: %v", channel.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (n *notifier) send(channel NotificationChannel, notification Notification) error {
+	switch channel.Type {
+	case ChannelWebhook:
+		return n.postJSON(channel.URL, notification)
+	case ChannelSlack:
+		return n.postJSON(channel.URL, map[string]string{"text": notification.Text()})
+	case ChannelTelegram:
+		endpoint := n.telegramAPI + "/bot" + channel.TelegramToken + "/sendMessage"
+		return n.postForm(endpoint, url.Values{"chat_id": {channel.TelegramChatID}, "text": {notification.Text()}})
+	case ChannelSMTP:
+		return sendMail(channel, notification)
+	}
+	return errors.New("Unknown notification channel type " + channel.Type)
+}
+
+func (n *notifier) postJSON(endpoint string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook responded " + resp.Status)
+	}
+	return nil
+}
+
+func (n *notifier) postForm(endpoint string, values url.Values) error {
+	resp, err := n.client.PostForm(endpoint, values)
+	if err != nil {
+		// the error has the URL with the bot token
+		return errors.New("Telegram request failed")
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("Telegram responded " + resp.Status)
+	}
+	return nil
+}
+
+func sendMail(channel NotificationChannel, notification Notification) error {
+	port := channel.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	address := net.JoinHostPort(channel.SMTPHost, fmt.Sprint(port))
+	var auth smtp.Auth
+	if channel.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", channel.SMTPUsername, channel.SMTPPassword, channel.SMTPHost)
+	}
+	// nginx -t output has several lines, only the first one fits in the subject
+	subject := strings.TrimSpace(strings.SplitN(notification.Text(), "\n", 2)[0])
+	message := "From: " + channel.From + "\r\n" +
+		"To: " + strings.Join(channel.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + notification.Time.Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		notification.Message + "\r\n"
+	if port != 465 {
+		return smtp.SendMail(address, auth, channel.From, channel.To, []byte(message))
+	}
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{ServerName: channel.SMTPHost})
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, channel.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(channel.From); err != nil {
+		return err
+	}
+	for _, to := range channel.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(message))
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// validateChannel checks the fields the channel type needs
+func validateChannel(channel *NotificationChannel) error {
+	channel.Name = strings.TrimSpace(channel.Name)
+	if channel.Name == "" {
+		return errors.New("Channel name is required")
+	}
+	// the name is part of the test and delete URLs
+	if strings.ContainsAny(channel.Name, "/?#%") {
+		return errors.New("Channel name can't contain / ? # or %")
+	}
+	for _, event := range channel.Events {
+		if !contains(NotificationEvents, event) {
+			return errors.New("Unknown event " + event)
+		}
+	}
+	switch channel.Type {
+	case ChannelWebhook, ChannelSlack:
+		u, err := url.Parse(channel.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Webhook URL is invalid")
+		}
+	case ChannelTelegram:
+		if channel.TelegramToken == "" || channel.TelegramChatID == "" {
+			return errors.New("Telegram bot token and chat ID are required")
+		}
+	case ChannelSMTP:
+		if channel.SMTPHost == "" || channel.From == "" || len(channel.To) == 0 {
+			return errors.New("SMTP host, sender and recipients are required")
+		}
+	default:
+		return errors.New("Unknown notification channel type " + channel.Type)
+	}
+	return nil
+}
+
+// notify sends a notification in the background, so failing channels don't hold up renewals or reloads
+func (s *Service) notify(event string, domain string, message string) {
+	if s.notifier == nil {
+		return
+	}
+	notification := Notification{Event: event, Domain: domain, Message: message, Time: time.Now().UTC()}
+	go s.notifier.Notify(notification)
+}
+
+// GetNotificationSettings returns the channels and the expiry warning days
+func (s *Service) GetNotificationSettings() (*NotificationSettings, error) {
+	settings, err := s.notifier.load()
+	if err != nil {
+		return nil, err
+	}
+	if settings.ExpiryWarningDays == 0 {
+		settings.ExpiryWarningDays = defaultExpiryWarningDays
+	}
+	return settings, nil
+}
+
+// SetExpiryWarningDays changes how many days before expiry certificates are reported
+func (s *Service) SetExpiryWarningDays(days int) error {
+	if days < 1 || days > 90 {
+		return errors.New("Expiry warning days must be between 1 and 90")
+	}
+	settings, err := s.notifier.load()
+	if err != nil {
+		return err
+	}
+	settings.ExpiryWarningDays = days
+	return s.notifier.save(settings)
+}
+
+// AddNotificationChannel adds a channel or replaces the channel with the same name
+func (s *Service) AddNotificationChannel(channel NotificationChannel) error {
+	err := validateChannel(&channel)
+	if err != nil {
+		return err
+	}
+	settings, err := s.notifier.load()
+	if err != nil {
+		return err
+	}
+	replaced := false
+	for i := range settings.Channels {
+		if settings.Channels[i].Name == channel.Name {
+			settings.Channels[i] = channel
+			replaced = true
+		}
+	}
+	if !replaced {
+		settings.Channels = append(settings.Channels, channel)
+	}
+	log.Printf("Notification channel %s (%s) is saved", channel.Name, channel.Type)
+	return s.notifier.save(settings)
+}
+
+// DeleteNotificationChannel removes a channel by name
+func (s *Service) DeleteNotificationChannel(name string) error {
+	settings, err := s.notifier.load()
+	if err != nil {
+		return err
+	}
+	var channels []NotificationChannel
+	for _, channel := range settings.Channels {
+		if channel.Name != name {
+			channels = append(channels, channel)
+		}
+	}
+	if len(channels) == len(settings.Channels) {
+		return errors.New("Channel " + name + " does not exist")
+	}
+	settings.Channels = channels
+	return s.notifier.save(settings)
+}
+
+// TestNotificationChannel sends a test notification to one channel and waits for the result
+func (s *Service) TestNotificationChannel(name string) error {
+	settings, err := s.notifier.load()
+	if err != nil {
+		return err
+	}
+	for _, channel := range settings.Channels {
+		if channel.Name == name {
+			return s.notifier.send(channel, Notification{
+				Event:   EventTest,
+				Message: "Notifications of nginx-ui are delivered to " + name,
+				Time:    time.Now().UTC(),
+			})
+		}
+	}
+	return errors.New("Channel " + name + " does not exist")
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startSMTPStandIn accepts mails without authentication and sends each message to the channel
+func startSMTPStandIn(t *testing.T) (string, int, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				io.WriteString(conn, "220 localhost ESMTP\r\n")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					command := strings.ToUpper(strings.TrimSpace(line))
+					switch {
+					case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+						io.WriteString(conn, "250 localhost\r\n")
+					case command == "DATA":
+						io.WriteString(conn, "354 go ahead\r\n")
+						var message strings.Builder
+						for {
+							line, err := reader.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							message.WriteString(line)
+						}
+						messages <- message.String()
+						io.WriteString(conn, "250 ok\r\n")
+					case command == "QUIT":
+						io.WriteString(conn, "221 bye\r\n")
+						return
+					default:
+						io.WriteString(conn, "250 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, messages
+}
+
+// startHTTPStandIn records request bodies of webhooks and the Telegram API
+func startHTTPStandIn(t *testing.T) (*httptest.Server, chan *http.Request, chan string) {
+	requests := make(chan *http.Request, 10)
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests, bodies
+}
+
+func TestNotifyChannels(t *testing.T) {
+	configDir := t.TempDir()
+	service := &Service{configDir: configDir, notifier: newNotifier(configDir)}
+	smtpHost, smtpPort, mails := startSMTPStandIn(t)
+	stand, requests, bodies := startHTTPStandIn(t)
+	service.notifier.telegramAPI = stand.URL
+
+	assert.NoError(t, service.AddNotificationChannel(NotificationChannel{
+		Name: "ops mail", Type: ChannelSMTP, SMTPHost: smtpHost, SMTPPort: smtpPort,
+		From: "nginx-ui@example.com", To: []string{"ops@example.com"},
+	}))
+	assert.NoError(t, service.AddNotificationChannel(NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: stand.URL + "/hook", Events: []string{EventRenewalFailed}}))
+	assert.NoError(t, service.AddNotificationChannel(NotificationChannel{Name: "slack", Type: ChannelSlack, URL: stand.URL + "/slack", Events: []string{EventReloadFailed}}))
+	assert.NoError(t, service.AddNotificationChannel(NotificationChannel{Name: "telegram", Type: ChannelTelegram, TelegramToken: "123:abc", TelegramChatID: "42", Events: []string{EventRenewalFailed}}))
+	assert.EqualError(t, service.AddNotificationChannel(NotificationChannel{Name: "bad", Type: ChannelWebhook, URL: "ftp://example.com"}), "Webhook URL is invalid")
+	assert.EqualError(t, service.AddNotificationChannel(NotificationChannel{Name: "bad", Type: ChannelSlack, URL: "https://example.com", Events: []string{"coffee"}}), "Unknown event coffee")
+
+	err := service.notifier.Notify(Notification{Event: EventRenewalFailed, Domain: "example.com", Message: "no route", Time: time.Now()})
+	assert.NoError(t, err, "Expected all channels to deliver")
+
+	mail := <-mails
+	assert.Contains(t, mail, "Subject: nginx-ui renewal_failed example.com: no route")
+	assert.Contains(t, mail, "To: ops@example.com")
+
+	received := map[string]string{}
+	for i := 0; i < 2; i++ {
+		r := <-requests
+		received[r.URL.Path] = <-bodies
+		if strings.HasPrefix(r.URL.Path, "/bot") {
+			form, _ := url.ParseQuery(received[r.URL.Path])
+			assert.Equal(t, "42", form.Get("chat_id"))
+		}
+	}
+	var notification Notification
+	assert.NoError(t, json.Unmarshal([]byte(received["/hook"]), &notification))
+	assert.Equal(t, "example.com", notification.Domain)
+	assert.Contains(t, received, "/bot123:abc/sendMessage")
+	assert.NotContains(t, received, "/slack", "Expected Slack to be filtered out")
+
+	assert.NoError(t, service.TestNotificationChannel("slack"), "Expected test notifications to pass filters")
+	<-requests
+	assert.JSONEq(t, `{"text": "nginx-ui test: Notifications of nginx-ui are delivered to slack"}`, <-bodies)
+
+	assert.NoError(t, service.DeleteNotificationChannel("hook"))
+	settings, err := service.GetNotificationSettings()
+	assert.NoError(t, err)
+	assert.Len(t, settings.Channels, 3)
+	assert.Equal(t, defaultExpiryWarningDays, settings.ExpiryWarningDays)
+	assert.FileExists(t, filepath.Join(configDir, notificationSettingsFile))
+}
+
+func TestRenewalFailureIsNotified(t *testing.T) {
+	scheduler, clock, _ := newTestScheduler(t, "example.com")
+	configDir := t.TempDir()
+	scheduler.service.notifier = newNotifier(configDir)
+	stand, _, bodies := startHTTPStandIn(t)
+	assert.NoError(t, scheduler.service.AddNotificationChannel(NotificationChannel{Name: "hook", Type: ChannelWebhook, URL: stand.URL}))
+	assert.NoError(t, scheduler.service.SetExpiryWarningDays(30))
+	scheduler.renew = func(ctx context.Context, domain string) error { return errors.New("challenge failed") }
+	cacheDir := scheduler.service.cacheDir
+	writeTestCertificate(t, filepath.Join(cacheDir, "example.com"), "example.com", []string{"example.com"}, clock.Now().Add(-70*24*time.Hour), clock.Now().Add(20*24*time.Hour))
+
+	scheduler.tick(context.Background())
+
+	events := map[string]Notification{}
+	for i := 0; i < 2; i++ {
+		var notification Notification
+		assert.NoError(t, json.Unmarshal([]byte(<-bodies), &notification))
+		events[notification.Event] = notification
+	}
+	assert.Contains(t, events[EventRenewalFailed].Message, "challenge failed")
+	assert.Equal(t, "certificate expires on 2025-01-21", events[EventCertExpiring].Message)
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RenameDomain moves a site to a new domain name: the config is copied with
+// server_name and file paths rewritten, the new name is served over HTTP
+// until its certificate is obtained and the tree is validated before nginx
+// is reloaded. With redirect the old name is kept as a site which redirects
+// to the new one, otherwise the old site goes to trash.
+func (s *Service) RenameDomain(oldDomain string, newDomain string, redirect bool, user string) error {
+	log.Printf("Renaming domain %s to %s", oldDomain, newDomain)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, oldDomain) {
+		return errors.New("Domain does not exist")
+	}
+	// an uploaded certificate doesn't cover the new name, the new site gets one from ACME
+	certSource := s.certSource(oldDomain)
+	if certSource == CertSourceCustom {
+		certSource = ""
+	}
+	err := s.validateNewDomain(newDomain, certSource)
+	if err != nil {
+		return err
+	}
+	if !redirect {
+		refs, err := s.findReferences(oldDomain)
+		if err != nil {
+			return err
+		}
+		if len(refs) > 0 {
+			return errors.New("Domain is referenced by " + strings.Join(refs, ", "))
+		}
+	}
+
+	oldDir := filepath.Join(s.cacheDir, oldDomain)
+	newDir := filepath.Join(s.cacheDir, newDomain)
+	oldContent, err := s.nginx.GetConfig(oldDomain)
+	if err != nil {
+		log.Printf("Failed to read config for %s: %v", oldDomain, err)
+		return err
+	}
+	newContent, err := rewriteDomainConfig(oldContent, oldDomain, newDomain, oldDir, newDir)
+	if err != nil {
+		log.Printf("Failed to rewrite config of %s: %v", oldDomain, err)
+		return err
+	}
+
+	err = os.Mkdir(newDir, 0755)
+	if err != nil {
+		log.Printf("Failed to create directory %s: %v", newDir, err)
+		return err
+	}
+	err = copySiteFiles(oldDir, newDir)
+	if err != nil {
+		log.Printf("Failed to copy files of %s: %v", oldDomain, err)
+		os.RemoveAll(newDir)
+		return err
+	}
+	oldSettings, err := s.GetSiteSettings(oldDomain)
+	if err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+	newSettings := *oldSettings
+	newSettings.Aliases = nil
+	newSettings.CertSource = certSource
+	for _, alias := range oldSettings.Aliases {
+		newSettings.Aliases = append(newSettings.Aliases, renameHost(alias, oldDomain, newDomain))
+	}
+	err = s.saveSiteSettings(newDomain, &newSettings)
+	if err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+	err = s.obtainCopiedCertificate(newDomain, newContent)
+	if err != nil {
+		os.RemoveAll(newDir)
+		s.nginx.RefreshConfig()
+		return err
+	}
+
+	// replace the old site with a redirect or move it to trash
+	var entry *TrashEntry
+	if redirect {
+		// the aliases move to the new site, the redirect serves the old name only
+		redirectSettings := *oldSettings
+		redirectSettings.Aliases = nil
+		err = s.saveSiteSettings(oldDomain, &redirectSettings)
+		if err == nil {
+			err = s.generateRedirectConfig(oldDomain, newDomain)
+		}
+	} else {
+		entry, err = s.moveToTrash(oldDomain, user)
+	}
+	if err != nil {
+		os.RemoveAll(newDir)
+		return err
+	}
+
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Config is invalid after renaming %s to %s, rolling back: %v", oldDomain, newDomain, err)
+		os.RemoveAll(newDir)
+		if redirect {
+			s.saveSiteSettings(oldDomain, oldSettings)
+			s.nginx.writeConfig(oldDomain, oldContent)
+		} else {
+			s.undoMoveToTrash(entry)
+		}
+		s.nginx.RefreshConfig()
+		return err
+	}
+
+	s.domains = append(s.domains, newDomain)
+	if !redirect {
+		s.domains = remove(s.domains, oldDomain)
+	}
+
+	return s.nginx.Reload()
+}
+
+// obtainCopiedCertificate gets the certificate of a renamed or cloned site
+// the way AddDomain does: the site is served over HTTP with the ACME
+// challenge location first, then content replaces that config. nginx is not
+// reloaded with content.
+func (s *Service) obtainCopiedCertificate(domain string, content string) error {
+	templatePath, err := s.findTemplate("nginx.tmpl")
+	if err != nil {
+		return err
+	}
+	err = s.generateNginxConfig(domain, templatePath)
+	if err != nil {
+		log.Printf("Failed to generate nginx.conf for %s: %v", domain, err)
+		return err
+	}
+	// the CA reaches the challenge path of the new name through nginx
+	err = s.nginx.Reload()
+	if err != nil {
+		log.Printf("Config of %s is rejected: %v", domain, err)
+		return err
+	}
+	err = s.obtainCertificate(context.Background(), domain)
+	if err != nil {
+		log.Printf("Failed to get certificate for %s: %v", domain, err)
+		return err
+	}
+	return s.nginx.writeConfig(domain, content)
+}
+
+// siteOwnFiles are written for each site, copySiteFiles leaves them out
+var siteOwnFiles = []string{"nginx.conf", "nginx.conf" + disabledSuffix, siteSettingsFile, "fullchain.pem", "privkey.pem", "chain.pem", renewalStatusFile, scanResultFile}
+
+// copySiteFiles copies the files of a site directory which the config may
+// refer to, like the client CA bundle or included snippets, to another site
+func copySiteFiles(srcDir string, dstDir string) error {
+	return filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil || rel == "." || contains(siteOwnFiles, rel) {
+			return err
+		}
+		target := filepath.Join(dstDir, rel)
+		if d.IsDir() {
+			return os.Mkdir(target, 0755)
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, info.Mode().Perm())
+	})
+}
+
+// generateRedirectConfig replaces the site config with a permanent redirect to another domain
+func (s *Service) generateRedirectConfig(domain string, target string) error {
+	templatePath, err := s.findTemplate("redirect.tmpl")
+	if err != nil {
+		return err
+	}
+	data := struct {
+		Domain    string
+		Path      string
+		Target    string
+		UIBackend string
+	}{
+		Domain:    domain,
+		Path:      filepath.Join(s.cacheDir, domain),
+		Target:    target,
+		UIBackend: s.uiBackend,
+	}
+	return s.renderConfigTemplate(templatePath, s.nginx.getFullName(domain), data)
+}
+
+// rewriteDomainConfig moves a site config to another domain: names in
+// server_name directives (including subdomains like www.) and paths to
+// the site directory are replaced.
+func rewriteDomainConfig(content string, oldDomain string, newDomain string, oldDir string, newDir string) (string, error) {
+	directives, err := parseNginxConfig(content)
+	if err != nil {
+		return "", err
+	}
+
+	var serverNames []*confDirective
+	walkConfDirectives(directives, nil, func(d *confDirective, parents []string) {
+		if d.name == "server_name" && !d.block {
+			serverNames = append(serverNames, d)
+		}
+	})
+
+	// rewrite from the end so that offsets of earlier directives stay valid
+	result := content
+	for i := len(serverNames) - 1; i >= 0; i-- {
+		d := serverNames[i]
+		var names []string
+		for _, name := range d.args {
+			names = append(names, renameHost(name, oldDomain, newDomain))
+		}
+		result = result[:d.argsStart] + strings.Join(names, " ") + result[d.argsEnd:]
+	}
+
+	return strings.ReplaceAll(result, oldDir+"/", newDir+"/"), nil
+}
+
+// renameHost moves a host name to another domain, e.g. www.old.com becomes www.new.com.
+// Names outside of the old domain are returned unchanged.
+func renameHost(name string, oldDomain string, newDomain string) string {
+	if name == oldDomain {
+		return newDomain
+	}
+	if strings.HasSuffix(name, "."+oldDomain) {
+		return strings.TrimSuffix(name, oldDomain) + newDomain
+	}
+	return name
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteDomainConfig(t *testing.T) {
+	content := `server {
+    listen   443 ssl;
+    server_name old.com www.old.com;
+
+    ssl_certificate        /etc/nginx/conf/old.com/fullchain.pem;
+    ssl_certificate_key    /etc/nginx/conf/old.com/privkey.pem;
+
+    location / {
+        proxy_pass http://old.com.internal:3000;
+    }
+}`
+
+	result, err := rewriteDomainConfig(content, "old.com", "new.com", "/etc/nginx/conf/old.com", "/etc/nginx/conf/new.com")
+	assert.NoError(t, err, "Expected no error from rewriteDomainConfig")
+	assert.Contains(t, result, "server_name new.com www.new.com;", "Expected server names to be renamed")
+	assert.Contains(t, result, "ssl_certificate        /etc/nginx/conf/new.com/fullchain.pem;", "Expected certificate path to be moved")
+	assert.Contains(t, result, "proxy_pass http://old.com.internal:3000;", "Expected other directives to stay untouched")
+}
+
+// newRenameTestService has the local CA site wiki with the alias www.wiki,
+// config templates are read from app/ui/configs
+func newRenameTestService(t *testing.T) *Service {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	service := &Service{
+		configDir:      configDir,
+		cacheDir:       cacheDir,
+		trashDir:       filepath.Join(configDir, "trash"),
+		trashRetention: time.Hour,
+		domains:        []string{"wiki"},
+		cert:           &Cert{local: newLocalCA(filepath.Join(configDir, "certs", "local-ca")), keyType: KeyTypeEC256},
+		nginx:          newFakeNginx(t, configDir, true),
+		embedFs:        os.DirFS(".."),
+		uiBackend:      "http://127.0.0.1:3005",
+	}
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "wiki"), 0755))
+	assert.NoError(t, service.saveSiteSettings("wiki", &SiteSettings{Aliases: []string{"www.wiki"}, CertSource: CertSourceLocal}))
+	assert.NoError(t, service.obtainCertificate(context.Background(), "wiki"))
+	templatePath, err := service.findTemplate("nginx.tmpl")
+	assert.NoError(t, err)
+	assert.NoError(t, service.generateNginxConfig("wiki", templatePath))
+	return service
+}
+
+func TestRenameDomain(t *testing.T) {
+	service := newRenameTestService(t)
+	oldDir := filepath.Join(service.cacheDir, "wiki")
+	newDir := filepath.Join(service.cacheDir, "docs")
+
+	ref := filepath.Join(service.configDir, "conf.d", "portal.conf")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(ref), 0755))
+	assert.NoError(t, os.WriteFile(ref, []byte("include conf/wiki/locations.conf;\n"), 0644))
+	assert.EqualError(t, service.RenameDomain("wiki", "docs", false, "admin"), "Domain is referenced by "+ref)
+	assert.NoError(t, os.Remove(ref))
+
+	service.nginx = newFakeNginx(t, service.configDir, false)
+	assert.Error(t, service.RenameDomain("wiki", "docs", false, "admin"), "Expected nginx -t to fail")
+	assert.NoDirExists(t, newDir, "Expected the new site to be removed")
+	assert.FileExists(t, filepath.Join(oldDir, "nginx.conf"), "Expected the old site to be restored from trash")
+	assert.Equal(t, []string{"wiki"}, service.domains)
+
+	// files the config refers to move with the site, status files of the old name don't
+	assert.NoError(t, os.WriteFile(filepath.Join(oldDir, clientBundleFile), []byte("bundle"), 0644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(oldDir, "snippets"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(oldDir, "snippets", "headers.conf"), []byte("add_header X-Site wiki;\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(oldDir, scanResultFile), []byte("{}"), 0644))
+
+	service.nginx = newFakeNginx(t, service.configDir, true)
+	assert.NoError(t, service.RenameDomain("wiki", "docs", false, "admin"))
+	assert.Equal(t, []string{"docs"}, service.domains)
+	assert.NoDirExists(t, oldDir, "Expected the old site to be moved to trash")
+	assert.FileExists(t, filepath.Join(newDir, clientBundleFile))
+	assert.FileExists(t, filepath.Join(newDir, "snippets", "headers.conf"))
+	assert.NoFileExists(t, filepath.Join(newDir, scanResultFile))
+	content, err := os.ReadFile(filepath.Join(newDir, "nginx.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "server_name docs www.docs;")
+	assert.Contains(t, string(content), newDir+"/fullchain.pem;")
+	assert.NotContains(t, string(content), oldDir)
+	info, err := ReadCertInfo(filepath.Join(newDir, "fullchain.pem"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docs", "www.docs"}, info.Names)
+	settings, err := service.GetSiteSettings("docs")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"www.docs"}, settings.Aliases)
+	assert.Equal(t, CertSourceLocal, settings.CertSource)
+}
+
+func TestRenameDomainWithRedirect(t *testing.T) {
+	service := newRenameTestService(t)
+	configPath := filepath.Join(service.cacheDir, "wiki", "nginx.conf")
+	original, err := os.ReadFile(configPath)
+	assert.NoError(t, err)
+
+	service.nginx = newFakeNginx(t, service.configDir, false)
+	assert.Error(t, service.RenameDomain("wiki", "docs", true, "admin"), "Expected nginx -t to fail")
+	content, err := os.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, string(original), string(content), "Expected the old config to be restored")
+	assert.Equal(t, []string{"www.wiki"}, service.getServerNames("wiki")[1:])
+	assert.NoDirExists(t, filepath.Join(service.cacheDir, "docs"))
+
+	service.nginx = newFakeNginx(t, service.configDir, true)
+	assert.NoError(t, service.RenameDomain("wiki", "docs", true, "admin"))
+	assert.Equal(t, []string{"wiki", "docs"}, service.domains)
+	content, err = os.ReadFile(configPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "return 301 https://docs$request_uri;")
+	assert.Equal(t, []string{"wiki"}, service.getServerNames("wiki"), "Expected the aliases to move to the new site")
+	assert.Equal(t, []string{"docs", "www.docs"}, service.getServerNames("docs"))
+}
+
+// newRecordingFakeNginx is a fake nginx which accepts every config and logs,
+// on each reload, whether siteDir has a certificate and its config
+func newRecordingFakeNginx(t *testing.T, configDir string, siteDir string) (*nginx, string) {
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, "reloads.log")
+	script := "#!/bin/sh\necho 'nginx: the configuration file syntax is ok'\n" +
+		"if [ \"$1\" = \"-s\" ]; then\n" +
+		"  { test -f " + siteDir + "/fullchain.pem && echo certificate || echo no certificate; cat " + siteDir + "/nginx.conf; echo; echo ---; } >> " + logPath + "\n" +
+		"fi\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "nginx"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return &nginx{rootPath: configDir}, logPath
+}
+
+// assertServedOverHTTPFirst checks that the first reload served the new site
+// with the ACME challenge location before it had a certificate
+func assertServedOverHTTPFirst(t *testing.T, logPath string) {
+	content, err := os.ReadFile(logPath)
+	assert.NoError(t, err, "Expected nginx to be reloaded")
+	reloads := strings.Split(string(content), "---\n")
+	assert.GreaterOrEqual(t, len(reloads), 2)
+	first := reloads[0]
+	assert.True(t, strings.HasPrefix(first, "no certificate\n"+pendingCertMarker), "Expected the pending config to be loaded before issuing:\n"+first)
+	assert.Contains(t, first, "location /.well-known/acme-challenge/")
+	assert.NotContains(t, first, "ssl_certificate")
+	last := reloads[len(reloads)-2]
+	assert.True(t, strings.HasPrefix(last, "certificate\n"), "Expected the certificate to be issued before the last reload")
+	assert.Contains(t, last, "ssl_certificate")
+}
+
+func TestRenameDomainServesChallengeBeforeIssuing(t *testing.T) {
+	service := newRenameTestService(t)
+	var logPath string
+	service.nginx, logPath = newRecordingFakeNginx(t, service.configDir, filepath.Join(service.cacheDir, "docs"))
+
+	assert.NoError(t, service.RenameDomain("wiki", "docs", true, "admin"))
+	assertServedOverHTTPFirst(t, logPath)
+	content, err := os.ReadFile(filepath.Join(service.cacheDir, "docs", "nginx.conf"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), pendingCertMarker, "Expected the renamed config in place of the pending one")
+	assert.Contains(t, string(content), "server_name docs www.docs;")
+}
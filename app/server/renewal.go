@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// clock is the time source of the renewal scheduler, tests replace it with a fake
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now().UTC() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// renewalState is what the scheduler remembers about the certificate of a domain
+type renewalState struct {
+	serial   string    // serial of the certificate renewAt was computed for
+	renewAt  time.Time // when the current certificate is due for renewal
+	failures int       // failed attempts in a row
+	retryAt  time.Time // next attempt after a failure
+	warnedAt time.Time // last expiry warning
+}
+
+// renewalScheduler renews every certificate at 2/3 of its lifetime. Failed
+// attempts are retried with exponential backoff starting at 15 minutes,
+// which keeps a host name under Let's Encrypt's 5 failed validations an
+// hour, and new orders are capped at 300 per account in 3 hours.
+type renewalScheduler struct {
+	service *Service
+	clock   clock
+	// renew orders a new certificate, resolve checks a domain points somewhere
+	renew   func(ctx context.Context, domain string) error
+	resolve func(domain string) bool
+	random  func() float64
+
+	// checkInterval is the longest sleep, so new domains are picked up
+	checkInterval time.Duration
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxOrders     int
+	orderWindow   time.Duration
+
+	mu     sync.Mutex
+	state  map[string]*renewalState
+	orders []time.Time // start times of recent orders
+}
+
+func newRenewalScheduler(service *Service) *renewalScheduler {
+	return &renewalScheduler{
+		service:       service,
+		clock:         realClock{},
+		renew:         service.RenewCertificate,
+		resolve:       isDomainResolvable,
+		random:        rand.Float64,
+		checkInterval: time.Hour,
+		minBackoff:    15 * time.Minute,
+		maxBackoff:    24 * time.Hour,
+		maxOrders:     300,
+		orderWindow:   3 * time.Hour,
+		state:         make(map[string]*renewalState),
+	}
+}
+
+// Run renews certificates until ctx is cancelled
+func (r *renewalScheduler) Run(ctx context.Context) {
+	for {
+		wait := r.tick(ctx)
+		select {
+		case <-ctx.Done():
+			log.Printf("Certificate renewal is stopped")
+			return
+		case <-r.clock.After(wait):
+		}
+	}
+}
+
+// tick renews certificates which are due and returns how long to sleep until the next one
+func (r *renewalScheduler) tick(ctx context.Context) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	next := now.Add(r.checkInterval)
+	for _, domain := range r.service.listDomains() {
+		if ctx.Err() != nil {
+			return 0
+		}
+		if r.service.isDisabled(domain) {
+			continue
+		}
+		r.warnExpiry(domain, now)
+		if source := r.service.certSource(domain); source == CertSourceCustom || source == CertSourceNone {
+			continue
+		}
+		due := r.dueTime(domain, now)
+		if due.After(now) {
+			if due.Before(next) {
+				next = due
+			}
+			continue
+		}
+
+		if !r.allowOrder(now) {
+			log.Printf("Certificate order limit of %d per %s is reached, %s is postponed", r.maxOrders, r.orderWindow, domain)
+			if limit := r.orders[0].Add(r.orderWindow); limit.Before(next) {
+				next = limit
+			}
+			continue
+		}
+		r.attempt(ctx, domain, now)
+		due = r.dueTime(domain, now)
+		if due.Before(next) {
+			next = due
+		}
+	}
+
+	wait := next.Sub(now)
+	if wait < time.Minute {
+		wait = time.Minute
+	}
+	return wait
+}
+
+// dueTime returns when the certificate of domain has to be renewed
+func (r *renewalScheduler) dueTime(domain string, now time.Time) time.Time {
+	st, ok := r.state[domain]
+	if !ok {
+		st = &renewalState{}
+		r.state[domain] = st
+	}
+
+	info, err := ReadCertInfo(filepath.Join(r.service.cacheDir, domain, "fullchain.pem"))
+	current := err == nil &&
+		sameNames(info.Names, r.service.getServerNames(domain)) &&
+		(r.service.isDev || !info.Staging)
+	if current && info.Serial != st.serial {
+		// a new certificate, e.g. renewed from the UI, resets failures
+		st.serial = info.Serial
+		st.renewAt = renewalTime(info, r.random())
+		st.failures = 0
+	}
+
+	if st.failures > 0 {
+		return st.retryAt
+	}
+	if !current {
+		return now
+	}
+	return st.renewAt
+}
+
+// attempt renews the certificate of domain and schedules a retry on failure
+func (r *renewalScheduler) attempt(ctx context.Context, domain string, now time.Time) {
+	st := r.state[domain]
+	var err error
+	// names of the local CA don't have to resolve
+	if r.service.certSource(domain) != CertSourceLocal && !r.resolve(domain) {
+		err = errors.New("Domain is not resolvable")
+		r.service.saveRenewalStatus(domain, err)
+	} else {
+		log.Printf("Certificate for %s is due, renewing...", domain)
+		r.orders = append(r.orders, now)
+		err = r.renew(ctx, domain)
+	}
+
+	if err != nil {
+		st.failures++
+		st.retryAt = now.Add(r.backoff(st.failures))
+		log.Printf("Failed to renew certificate for %s (attempt %d), next try at %s: %v", domain, st.failures, st.retryAt, err)
+		r.service.notify(EventRenewalFailed, domain, fmt.Sprintf("attempt %d failed, next try at %s: %v", st.failures, st.retryAt.Format(time.RFC3339), err))
+		return
+	}
+	st.failures = 0
+	st.serial = ""
+	log.Printf("Certificate for %s is renewed", domain)
+}
+
+// warnExpiry notifies once a day when a certificate expires within the
+// configured number of days. ACME certificates only get there when renewals
+// keep failing, custom certificates have to be replaced by hand.
+func (r *renewalScheduler) warnExpiry(domain string, now time.Time) {
+	info, err := ReadCertInfo(filepath.Join(r.service.cacheDir, domain, "fullchain.pem"))
+	if err != nil || info.NotAfter.Sub(now) > r.service.notifier.expiryWarning() {
+		return
+	}
+	st, ok := r.state[domain]
+	if !ok {
+		st = &renewalState{}
+		r.state[domain] = st
+	}
+	if now.Sub(st.warnedAt) < 24*time.Hour {
+		return
+	}
+	st.warnedAt = now
+	message := "certificate expires on " + info.NotAfter.Format(time.DateOnly)
+	if r.service.isCustomCertificate(domain) {
+		message += ", upload a new one"
+	}
+	log.Printf("WARNING: %s %s", domain, message)
+	r.service.notify(EventCertExpiring, domain, message)
+}
+
+// allowOrder reports whether another order fits into the rate limit window
+func (r *renewalScheduler) allowOrder(now time.Time) bool {
+	i := 0
+	for i < len(r.orders) && !r.orders[i].After(now.Add(-r.orderWindow)) {
+		i++
+	}
+	r.orders = r.orders[i:]
+	return len(r.orders) < r.maxOrders
+}
+
+// backoff doubles the retry delay with every failure, up to maxBackoff, plus up to 10% jitter
+func (r *renewalScheduler) backoff(failures int) time.Duration {
+	d := r.maxBackoff
+	if failures < 32 && r.minBackoff<<(failures-1) < r.maxBackoff {
+		d = r.minBackoff << (failures - 1)
+	}
+	return d + time.Duration(float64(d)*r.random()/10)
+}
+
+// renewalTime is 2/3 into the certificate lifetime, moved earlier by up to
+// 1/30 of the lifetime so that sites issued together don't renew together
+func renewalTime(info *CertInfo, jitter float64) time.Time {
+	lifetime := info.NotAfter.Sub(info.NotBefore)
+	return info.NotBefore.Add(lifetime * 2 / 3).Add(-time.Duration(float64(lifetime/30) * jitter))
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock only moves when the test advances it
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var waiters []fakeWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+func (c *fakeClock) Waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func newTestScheduler(t *testing.T, domains ...string) (*renewalScheduler, *fakeClock, map[string]int) {
+	cacheDir := t.TempDir()
+	for _, domain := range domains {
+		assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	}
+	service := &Service{cacheDir: cacheDir, domains: domains}
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	calls := make(map[string]int)
+
+	scheduler := newRenewalScheduler(service)
+	scheduler.clock = clock
+	scheduler.random = func() float64 { return 0 }
+	scheduler.resolve = func(domain string) bool { return true }
+	scheduler.renew = func(ctx context.Context, domain string) error {
+		calls[domain]++
+		now := clock.Now()
+		writeTestCertificate(t, filepath.Join(cacheDir, domain), domain, []string{domain}, now, now.Add(90*24*time.Hour))
+		return nil
+	}
+	return scheduler, clock, calls
+}
+
+func TestRenewalSchedulerRenewsAtTwoThirdsOfLifetime(t *testing.T) {
+	scheduler, clock, calls := newTestScheduler(t, "example.com")
+	ctx := context.Background()
+
+	wait := scheduler.tick(ctx)
+	assert.Equal(t, 1, calls["example.com"], "Expected missing certificate to be issued")
+	assert.Equal(t, time.Hour, wait, "Expected next check after checkInterval")
+
+	clock.Advance(60*24*time.Hour - time.Minute)
+	scheduler.tick(ctx)
+	assert.Equal(t, 1, calls["example.com"], "Expected certificate not to be renewed before 2/3 of lifetime")
+
+	clock.Advance(time.Minute)
+	scheduler.tick(ctx)
+	assert.Equal(t, 2, calls["example.com"], "Expected certificate to be renewed at 2/3 of lifetime")
+}
+
+func TestRenewalSchedulerBacksOffOnFailure(t *testing.T) {
+	scheduler, clock, _ := newTestScheduler(t, "example.com")
+	ctx := context.Background()
+	attempts := 0
+	scheduler.renew = func(ctx context.Context, domain string) error {
+		attempts++
+		return errors.New("acme error")
+	}
+
+	wait := scheduler.tick(ctx)
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, 15*time.Minute, wait, "Expected first retry after minBackoff")
+
+	clock.Advance(10 * time.Minute)
+	scheduler.tick(ctx)
+	assert.Equal(t, 1, attempts, "Expected no retry before backoff")
+
+	clock.Advance(5 * time.Minute)
+	wait = scheduler.tick(ctx)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 30*time.Minute, wait, "Expected backoff to double")
+
+	for i := 0; i < 10; i++ {
+		clock.Advance(wait)
+		wait = scheduler.tick(ctx)
+	}
+	assert.Equal(t, time.Hour, wait, "Expected wait to be capped by checkInterval")
+	assert.Equal(t, 24*time.Hour, scheduler.backoff(20), "Expected backoff to be capped by maxBackoff")
+}
+
+func TestRenewalSchedulerRespectsOrderLimit(t *testing.T) {
+	scheduler, clock, calls := newTestScheduler(t, "a.com", "b.com", "c.com")
+	scheduler.maxOrders = 2
+	ctx := context.Background()
+
+	scheduler.tick(ctx)
+	assert.Equal(t, 1, calls["a.com"])
+	assert.Equal(t, 1, calls["b.com"])
+	assert.Equal(t, 0, calls["c.com"], "Expected third order to be postponed")
+
+	clock.Advance(3 * time.Hour)
+	scheduler.tick(ctx)
+	assert.Equal(t, 1, calls["c.com"], "Expected postponed order once the window has passed")
+}
+
+func TestRenewalSchedulerStopsOnCancel(t *testing.T) {
+	scheduler, clock, _ := newTestScheduler(t, "example.com")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return clock.Waiting() == 1 }, time.Second, time.Millisecond, "Expected scheduler to wait for the next check")
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Expected scheduler to stop after cancel")
+	}
+}
+
+// blockingIssuer holds every order until its context ends
+type blockingIssuer struct {
+	started chan struct{}
+}
+
+func (b *blockingIssuer) Obtain(ctx context.Context, domains []string, keyType string) (*tls.Certificate, error) {
+	close(b.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (b *blockingIssuer) HTTPHandler(fallback http.Handler) http.Handler {
+	return fallback
+}
+
+func TestRenewalSchedulerStopCancelsOrder(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, "example.com"), 0755))
+	issuer := &blockingIssuer{started: make(chan struct{})}
+	service := &Service{
+		configDir: configDir,
+		cacheDir:  cacheDir,
+		domains:   []string{"example.com"},
+		cert:      &Cert{issuer: issuer, keyType: KeyTypeEC256},
+		nginx:     newFakeNginx(t, configDir, true),
+	}
+	scheduler := newRenewalScheduler(service)
+	scheduler.resolve = func(domain string) bool { return true }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(ctx)
+		close(done)
+	}()
+	<-issuer.started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the order to end with the scheduler")
+	}
+	status := service.getRenewalStatus("example.com")
+	assert.Contains(t, status.LastError, context.Canceled.Error())
+}
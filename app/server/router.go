@@ -3,8 +3,10 @@ package server
 import (
 	"context"
 	"embed"
+	"errors"
 	"io/fs"
 	"net/http"
+	"net/url"
 )
 
 // Router is a simple HTTP router
@@ -18,19 +20,21 @@ func NewRouter(embedFs embed.FS) *Router {
 	r := &Router{mux: http.NewServeMux()}
 
 	staticFs, _ := fs.Sub(embedFs, "ui")
-	r.mux.Handle("/static/", http.FileServer(http.FS(staticFs)))
+	r.mux.Handle("GET /static/", http.FileServer(http.FS(staticFs)))
 
 	return r
 }
 
-// GET registers a new GET route
+// GET registers a new GET route, auth routes need a logged in user
 func (r *Router) GET(auth bool, pattern string, handler http.HandlerFunc) {
-	r.mux.HandleFunc(pattern, r.withContext(handler))
+	r.mux.HandleFunc("GET "+pattern, r.withContext(authorize(auth, handler)))
 }
 
-// POST registers a new POST route
+// POST registers a new POST route, auth routes need a logged in user.
+// Requests from other sites are refused, so a page elsewhere can't post
+// a form with the session cookie.
 func (r *Router) POST(auth bool, pattern string, handler http.HandlerFunc) {
-	r.mux.HandleFunc(pattern, r.withContext(handler))
+	r.mux.HandleFunc("POST "+pattern, r.withContext(sameOrigin(authorize(auth, handler))))
 }
 
 // GetRouter returns the underlying http.ServeMux
@@ -44,6 +48,48 @@ func (r *Router) withContext(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// authorize answers 401 to requests without a logged in user
+func authorize(auth bool, next http.HandlerFunc) http.HandlerFunc {
+	if !auth {
+		return next
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Context().Value(ContextKey("claims")) == nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, req)
+	}
+}
+
+var errAdminRequired = errors.New("This page requires the admin role")
+
+// adminOnly answers 403 to users without the admin role
+func adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !isAdmin(req) {
+			http.Error(w, errAdminRequired.Error(), http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
+
+// sameOrigin refuses requests whose Origin is another site
+func sameOrigin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if origin := req.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			// behind a proxy Host may be the upstream address
+			if err != nil || (u.Host != req.Host && u.Host != req.Header.Get("X-Forwarded-Host")) {
+				http.Error(w, "Cross-site request refused", http.StatusForbidden)
+				return
+			}
+		}
+		next(w, req)
+	}
+}
+
 // This is used to avoid context key collisions
 // it serves as a domain for the context keys
 type ContextKey string
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"embed"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouterChecksMethodLoginAndRole(t *testing.T) {
+	router := NewRouter(embed.FS{})
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	router.GET(false, "/public", ok)
+	router.GET(IS_AUTH, "/view", ok)
+	router.POST(IS_AUTH, "/action", ok)
+	router.POST(IS_AUTH, "/admin-action", adminOnly(ok))
+
+	userToken, err := createToken("user@test.com", "user")
+	assert.NoError(t, err)
+	adminToken, err := createToken("admin@test.com", RoleAdmin)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		origin string
+		status int
+	}{
+		{http.MethodGet, "/public", "", "", http.StatusNoContent},
+		{http.MethodGet, "/view", "", "", http.StatusUnauthorized},
+		{http.MethodGet, "/view", userToken, "", http.StatusNoContent},
+		{http.MethodGet, "/action", userToken, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/action", "", "", http.StatusUnauthorized},
+		{http.MethodPost, "/action", userToken, "", http.StatusNoContent},
+		{http.MethodPost, "/action", userToken, "http://example.com", http.StatusNoContent},
+		{http.MethodPost, "/action", userToken, "https://evil.example.org", http.StatusForbidden},
+		{http.MethodPost, "/admin-action", userToken, "", http.StatusForbidden},
+		{http.MethodPost, "/admin-action", adminToken, "", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://example.com"+test.path, nil)
+		if test.token != "" {
+			req.AddCookie(&http.Cookie{Name: cookieName, Value: test.token})
+		}
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		router.GetRouter().ServeHTTP(w, req)
+		assert.Equal(t, test.status, w.Code, "%s %s token=%t origin=%s", test.method, test.path, test.token != "", test.origin)
+	}
+}
+
+func TestNewWebRegistersRoutes(t *testing.T) {
+	// conflicting patterns panic when the routes are registered
+	web := NewWeb(&nginx{}, &Service{}, &Config{}, embed.FS{})
+
+	req := httptest.NewRequest(http.MethodPost, "/import/apply", nil)
+	w := httptest.NewRecorder()
+	web.GetRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Expected the import to require a login")
+
+	req = httptest.NewRequest(http.MethodDelete, "/import/apply", nil)
+	w = httptest.NewRecorder()
+	web.GetRouter().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
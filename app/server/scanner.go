@@ -0,0 +1,294 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const scanResultFile = "scan.json"
+
+const (
+	FindingCritical = "critical"
+	FindingWarning  = "warning"
+	FindingInfo     = "info"
+)
+
+// Finding is an issue found by the TLS scanner
+type Finding struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// ScanResult is what a live site serves on 443 compared to the certificate on disk
+type ScanResult struct {
+	Domain    string    `json:"domain"`
+	Host      string    `json:"host"`
+	Address   string    `json:"address"`
+	ScannedAt time.Time `json:"scannedAt"`
+	Grade     string    `json:"grade"`
+	Findings  []Finding `json:"findings"`
+	// Protocols and Ciphers accepted by the server, ciphers are probed up to TLS 1.2
+	Protocols []string `json:"protocols"`
+	Ciphers   []string `json:"ciphers"`
+	// Served is the leaf certificate the server presented
+	Served       *CertInfo `json:"served,omitempty"`
+	MatchesDisk  bool      `json:"matchesDisk"`
+	ChainTrusted bool      `json:"chainTrusted"`
+	HSTS         bool      `json:"hsts"`
+}
+
+// tlsScanner connects to sites with crypto/tls, roots has the system roots
+// and the local CA root so sites of the local CA are trusted too
+type tlsScanner struct {
+	roots   *x509.CertPool
+	address func(host string) string
+	timeout time.Duration
+}
+
+func newTLSScanner(localRoot []byte) *tlsScanner {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if localRoot != nil {
+		roots.AppendCertsFromPEM(localRoot)
+	}
+	return &tlsScanner{
+		roots:   roots,
+		address: func(host string) string { return net.JoinHostPort(host, "443") },
+		timeout: 5 * time.Second,
+	}
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// scan checks host of a site, names are all names the certificate has to
+// cover and onDisk is the leaf of fullchain.pem, nil if it can't be read
+func (sc *tlsScanner) scan(ctx context.Context, domain string, host string, names []string, onDisk *x509.Certificate) *ScanResult {
+	result := &ScanResult{Domain: domain, Host: host, Address: sc.address(host), ScannedAt: time.Now().UTC()}
+
+	state, err := sc.handshake(ctx, host, &tls.Config{MinVersion: tls.VersionTLS10})
+	if err != nil {
+		result.addFinding(FindingCritical, "TLS connection failed: "+err.Error())
+		result.Grade = "F"
+		return result
+	}
+	leaf := state.PeerCertificates[0]
+	result.Served = newCertInfo(leaf)
+
+	for _, version := range []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13} {
+		if _, err := sc.handshake(ctx, host, &tls.Config{MinVersion: version, MaxVersion: version}); err == nil {
+			result.Protocols = append(result.Protocols, tlsVersionNames[version])
+		}
+	}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if !supportsPreTLS13(suite) {
+			continue
+		}
+		config := &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{suite.ID}}
+		if _, err := sc.handshake(ctx, host, config); err == nil {
+			result.Ciphers = append(result.Ciphers, suite.Name)
+			if suite.Insecure {
+				result.addFinding(FindingCritical, "Insecure cipher "+suite.Name+" is accepted")
+			}
+		}
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{Roots: sc.roots, Intermediates: intermediates})
+	result.ChainTrusted = err == nil
+	if err != nil {
+		result.addFinding(FindingCritical, "Certificate chain is not trusted: "+err.Error())
+	}
+
+	missing := checkCertificateNames(leaf, names)
+	if missing != nil {
+		result.addFinding(FindingCritical, missing.Error())
+	}
+
+	left := time.Until(leaf.NotAfter)
+	switch {
+	case left <= 0:
+		result.addFinding(FindingCritical, "Certificate expired on "+leaf.NotAfter.Format(time.DateOnly))
+	case left < 7*24*time.Hour:
+		result.addFinding(FindingWarning, "Certificate expires on "+leaf.NotAfter.Format(time.DateOnly))
+	}
+
+	if onDisk == nil {
+		result.addFinding(FindingWarning, "There is no certificate on disk to compare with")
+	} else {
+		result.MatchesDisk = bytes.Equal(onDisk.Raw, leaf.Raw)
+		if !result.MatchesDisk {
+			result.addFinding(FindingCritical, "nginx serves a different certificate than fullchain.pem, it was probably not reloaded")
+		}
+	}
+
+	if contains(result.Protocols, "TLSv1") || contains(result.Protocols, "TLSv1.1") {
+		result.addFinding(FindingWarning, "Deprecated TLSv1 and TLSv1.1 are accepted")
+	}
+	if !contains(result.Protocols, "TLSv1.3") {
+		result.addFinding(FindingWarning, "TLSv1.3 is not supported")
+	}
+
+	result.HSTS = sc.hasHSTS(ctx, host)
+	if !result.HSTS {
+		result.addFinding(FindingInfo, "Strict-Transport-Security header is missing")
+	}
+
+	result.Grade = result.grade()
+	return result
+}
+
+func (sc *tlsScanner) handshake(ctx context.Context, host string, config *tls.Config) (*tls.ConnectionState, error) {
+	// the chain is verified separately, so the scan sees what is served even if it is invalid
+	config.ServerName = host
+	config.InsecureSkipVerify = true
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: sc.timeout}, Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", sc.address(host))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	state := conn.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no certificate is served")
+	}
+	return &state, nil
+}
+
+func (sc *tlsScanner) hasHSTS(ctx context.Context, host string) bool {
+	client := &http.Client{
+		Timeout: sc.timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: host, InsecureSkipVerify: true},
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{Timeout: sc.timeout}).DialContext(ctx, network, sc.address(host))
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://"+host+"/", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Strict-Transport-Security") != ""
+}
+
+func (r *ScanResult) addFinding(severity string, message string) {
+	r.Findings = append(r.Findings, Finding{Severity: severity, Message: message})
+}
+
+// grade is F with a critical finding, B with deprecated protocols or
+// without TLS 1.3, A otherwise and A+ for A with HSTS
+func (r *ScanResult) grade() string {
+	for _, finding := range r.Findings {
+		if finding.Severity == FindingCritical {
+			return "F"
+		}
+	}
+	if contains(r.Protocols, "TLSv1") || contains(r.Protocols, "TLSv1.1") || !contains(r.Protocols, "TLSv1.3") {
+		return "B"
+	}
+	if r.HSTS {
+		return "A+"
+	}
+	return "A"
+}
+
+func supportsPreTLS13(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version < tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanDomain grades the live site of domain and keeps the result in the domain directory
+func (s *Service) ScanDomain(domain string) (*ScanResult, error) {
+	if !contains(s.listDomains(), domain) {
+		return nil, errors.New("Domain does not exist")
+	}
+	names := s.getServerNames(domain)
+	host := ""
+	for _, name := range names {
+		if !isWildcard(name) {
+			host = name
+			break
+		}
+	}
+	if host == "" {
+		return nil, errors.New("Site has only wildcard names, there is no host to connect to")
+	}
+
+	var onDisk *x509.Certificate
+	content, err := os.ReadFile(filepath.Join(s.cacheDir, domain, "fullchain.pem"))
+	if err == nil {
+		if certs, err := parsePEMBundle(content); err == nil {
+			onDisk = certs[0]
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	result := s.scanner().scan(ctx, domain, host, names, onDisk)
+	log.Printf("TLS scan of %s: grade %s, %d findings", domain, result.Grade, len(result.Findings))
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(s.cacheDir, domain, scanResultFile), data, 0644)
+	}
+	if err != nil {
+		log.Printf("Failed to save scan result of %s: %v", domain, err)
+	}
+	return result, nil
+}
+
+// GetScanResult returns the last scan of a site, nil if it was never scanned
+func (s *Service) GetScanResult(domain string) *ScanResult {
+	content, err := os.ReadFile(filepath.Join(s.cacheDir, domain, scanResultFile))
+	if err != nil {
+		return nil
+	}
+	result := &ScanResult{}
+	if json.Unmarshal(content, result) != nil {
+		return nil
+	}
+	return result
+}
+
+func (s *Service) scanner() *tlsScanner {
+	if s.tlsScanner != nil {
+		return s.tlsScanner
+	}
+	var localRoot []byte
+	if s.cert != nil && s.cert.local != nil && fileExists(filepath.Join(s.cert.local.dir, localCARootFile)) {
+		localRoot, _ = s.cert.LocalCARoot()
+	}
+	return newTLSScanner(localRoot)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// startTLSSite serves a site with the given TLS config and returns a scanner pointed at it
+func startTLSSite(t *testing.T, config *tls.Config, root *x509.Certificate) *tlsScanner {
+	site := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=63072000")
+	}))
+	site.TLS = config
+	// every rejected probe is a handshake error
+	site.Config.ErrorLog = log.New(io.Discard, "", 0)
+	site.StartTLS()
+	t.Cleanup(site.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	scanner := newTLSScanner(nil)
+	scanner.roots = roots
+	scanner.address = func(host string) string { return site.Listener.Addr().String() }
+	return scanner
+}
+
+func tlsCertificate(key any, chain ...*x509.Certificate) []tls.Certificate {
+	cert := tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return []tls.Certificate{cert}
+}
+
+func TestScanGradesModernSite(t *testing.T) {
+	root, intermediate, leaf, key := testChain(t, []string{"example.com"})
+	scanner := startTLSSite(t, &tls.Config{MinVersion: tls.VersionTLS12, Certificates: tlsCertificate(key, leaf, intermediate)}, root)
+
+	result := scanner.scan(context.Background(), "example.com", "example.com", []string{"example.com"}, leaf)
+	assert.Equal(t, "A+", result.Grade, "Expected A+ for a modern site, findings: %v", result.Findings)
+	assert.Equal(t, []string{"TLSv1.2", "TLSv1.3"}, result.Protocols)
+	assert.Contains(t, result.Ciphers, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	assert.True(t, result.MatchesDisk)
+	assert.True(t, result.ChainTrusted)
+	assert.True(t, result.HSTS)
+}
+
+func TestScanFindsStaleCertificate(t *testing.T) {
+	root, intermediate, leaf, key := testChain(t, []string{"example.com"})
+	scanner := startTLSSite(t, &tls.Config{MinVersion: tls.VersionTLS12, Certificates: tlsCertificate(key, leaf, intermediate)}, root)
+	_, _, renewed, _ := testChain(t, []string{"example.com"})
+
+	result := scanner.scan(context.Background(), "example.com", "example.com", []string{"example.com", "www.example.com"}, renewed)
+	assert.Equal(t, "F", result.Grade)
+	assert.False(t, result.MatchesDisk)
+	assert.Contains(t, result.Findings, Finding{FindingCritical, "nginx serves a different certificate than fullchain.pem, it was probably not reloaded"})
+	assert.Contains(t, result.Findings, Finding{FindingCritical, "Certificate does not cover www.example.com"})
+}
+
+func TestScanGradesLegacyProtocols(t *testing.T) {
+	root, intermediate, leaf, key := testChain(t, []string{"example.com"})
+	config := &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS12, Certificates: tlsCertificate(key, leaf, intermediate)}
+	scanner := startTLSSite(t, config, root)
+
+	result := scanner.scan(context.Background(), "example.com", "example.com", []string{"example.com"}, leaf)
+	assert.Equal(t, "B", result.Grade, "Expected B with TLSv1 and without TLSv1.3, findings: %v", result.Findings)
+	assert.Equal(t, []string{"TLSv1", "TLSv1.1", "TLSv1.2"}, result.Protocols)
+}
+
+func TestScanUntrustedChain(t *testing.T) {
+	_, intermediate, leaf, key := testChain(t, []string{"example.com"})
+	otherRoot, _ := testCertificate(t, "Other Root", nil, true, nil, nil)
+	scanner := startTLSSite(t, &tls.Config{Certificates: tlsCertificate(key, leaf, intermediate)}, otherRoot)
+
+	result := scanner.scan(context.Background(), "example.com", "example.com", []string{"example.com"}, leaf)
+	assert.Equal(t, "F", result.Grade)
+	assert.False(t, result.ChainTrusted)
+}
+
+func TestScanDomainSavesResult(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	root, intermediate, leaf, key := testChain(t, []string{domain})
+	assert.NoError(t, os.WriteFile(filepath.Join(cacheDir, domain, "fullchain.pem"), encodeCertificates(leaf, intermediate), 0644))
+	scanner := startTLSSite(t, &tls.Config{Certificates: tlsCertificate(key, leaf, intermediate)}, root)
+	service := &Service{cacheDir: cacheDir, domains: []string{domain}, tlsScanner: scanner}
+
+	assert.Nil(t, service.GetScanResult(domain), "Expected no result before the first scan")
+	result, err := service.ScanDomain(domain)
+	assert.NoError(t, err)
+	assert.True(t, result.MatchesDisk)
+	assert.Equal(t, result.Grade, service.GetScanResult(domain).Grade)
+
+	_, err = service.ScanDomain("unknown.com")
+	assert.EqualError(t, err, "Domain does not exist")
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"embed"
 	"errors"
 	"html/template"
@@ -11,6 +12,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,172 +22,505 @@ type domainRecord struct {
 }
 
 type Service struct {
-	cacheDir string
-	domains  []string
-	cert     *Cert
-	nginx    *nginx
-	isDev    bool
-	embedFs  embed.FS
+	mu             sync.Mutex
+	configDir      string
+	cacheDir       string
+	trashDir       string
+	trashRetention time.Duration
+	domains        []string
+	cert           *Cert
+	nginx          *nginx
+	isDev          bool
+	embedFs        fs.FS
+	renewals       *renewalScheduler
+	// uiBackend is the nginx-ui address nginx passes ACME challenges to
+	uiBackend string
+	// tlsProfile is the default TLS profile of sites
+	tlsProfile string
+	// tlsScanner grades live sites, nil means one is created per scan
+	tlsScanner *tlsScanner
+	// clientCA issues client certificates for sites with mutual TLS
+	clientCA *clientCA
+	// notifier reports renewal, expiry and nginx failures
+	notifier *notifier
+	// stagedRestore is an uploaded backup waiting for confirmation
+	stagedRestore *stagedRestore
+	// setup is the last result of CheckSetup, shown on the dashboard
+	setup *SetupStatus
 }
 
 func NewService(nginx *nginx, cert *Cert, config *Config, embedFs embed.FS) *Service {
 	cacheDir:= config.ConfigDir + "/conf"
-	_, err := os.Stat(cacheDir)
-	if os.IsNotExist(err) {
-		panic("Cache directory does not exist")
+	service := &Service{
+		nginx:          nginx,
+		cert:           cert,
+		configDir:      config.ConfigDir,
+		cacheDir:       cacheDir,
+		trashDir:       config.ConfigDir + "/trash",
+		trashRetention: config.TrashRetention,
+		embedFs:        embedFs,
+		isDev:          config.IsDev,
+		uiBackend:      "http://127.0.0.1:" + config.Port,
+		tlsProfile:     config.TLSProfile,
+		clientCA:       newClientCA(filepath.Join(config.ConfigDir, "certs", "client-ca")),
+		notifier:       newNotifier(config.ConfigDir),
 	}
-
-	domains, err := getDirectories(cacheDir)
+	// a fresh ConfigDir gets the site directory and a main config including
+	// it, on failure nginx-ui starts without sites and shows what's wrong
+	err := service.bootstrapConfigDir()
 	if err != nil {
-		log.Panicf("Failed to get directories: %v", err)
+		log.Printf("Failed to create %s: %v", cacheDir, err)
+	} else if service.domains, err = getDirectories(cacheDir); err != nil {
+		log.Printf("Failed to load sites: %v", err)
+	}
+	for _, check := range service.CheckSetup().Problems() {
+		log.Printf("Setup: %s: %s", check.Name, check.Problem)
+	}
+	if nginx != nil {
+		nginx.notify = service.notify
 	}
+	if _, ok := tlsProfiles[config.TLSProfile]; !ok {
+		log.Printf("Unknown TLS profile %s, using %s", config.TLSProfile, TLSProfileIntermediate)
+		service.tlsProfile = TLSProfileIntermediate
+	}
+	service.renewals = newRenewalScheduler(service)
+
+	return service
+}
 
-	service := &Service{nginx: nginx, cert: cert, cacheDir: cacheDir, domains: domains, embedFs: embedFs, isDev: config.IsDev}
-	go func() {
-		for {
-			service.checkAndRefreshCertificates()
-			time.Sleep(24 * time.Hour)
+// Run renews certificates, stores scheduled backups, refreshes the client CRL and purges expired trash until ctx is cancelled
+func (s *Service) Run(ctx context.Context) {
+	go s.renewals.Run(ctx)
+	go s.runBackups(ctx)
+	for {
+		s.purgeExpiredTrash()
+		s.refreshClientCRL()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(24 * time.Hour):
 		}
-	}()
+	}
+}
 
-	return service
+// DomainInfo is a managed site as shown in the UI
+type DomainInfo struct {
+	Name     string
+	Disabled bool
 }
 
-func (s *Service) GetDomains() []string {
-	return s.domains
+// listDomains returns a copy of the domain list which is safe to iterate without the lock
+func (s *Service) listDomains() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.domains...)
 }
 
-func (s *Service) AddDomain(domain string) (error, string) {
-	log.Printf("Adding domain: %s", domain)
-	if contains(s.domains, domain) {
-		log.Printf("Domain %s already exists", domain)
-		return errors.New("Domain already exists"), ""
+func (s *Service) GetDomains() []DomainInfo {
+	var domains []DomainInfo
+	for _, domain := range s.listDomains() {
+		domains = append(domains, DomainInfo{Name: domain, Disabled: s.isDisabled(domain)})
 	}
-	if !isValidDomain(domain) {
-		log.Printf("Invalid domain name: %s", domain)
-		return errors.New("Invalid domain name"), ""
+	return domains
+}
+
+// DisableDomain moves the site config aside so nginx stops serving it,
+// the directory and certificates are kept so it can be enabled again
+func (s *Service) DisableDomain(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
 	}
-	if !isDomainResolvable(domain) {
-		log.Printf("Domain %s is not resolvable", domain)
-		return errors.New("Domain is not resolvable"), ""
+	if s.isDisabled(domain) {
+		return nil
+	}
+
+	configPath := filepath.Join(s.cacheDir, domain, "nginx.conf")
+	err := os.Rename(configPath, configPath+disabledSuffix)
+	if err != nil {
+		log.Printf("Failed to disable %s: %v", domain, err)
+		return err
+	}
+	log.Printf("Domain %s is disabled", domain)
+	s.nginx.RefreshConfig()
+
+	return nil
+}
+
+// EnableDomain puts the site config back and validates it, the site stays
+// disabled if nginx rejects the config
+func (s *Service) EnableDomain(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	if !s.isDisabled(domain) {
+		return nil
+	}
+
+	configPath := filepath.Join(s.cacheDir, domain, "nginx.conf")
+	err := os.Rename(configPath+disabledSuffix, configPath)
+	if err != nil {
+		log.Printf("Failed to enable %s: %v", domain, err)
+		return err
+	}
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Config of %s is invalid, keeping it disabled: %v", domain, err)
+		os.Rename(configPath, configPath+disabledSuffix)
+		return err
+	}
+	log.Printf("Domain %s is enabled", domain)
+	s.nginx.RefreshConfig()
+
+	return nil
+}
+
+func (s *Service) isDisabled(domain string) bool {
+	_, err := os.Stat(filepath.Join(s.cacheDir, domain, "nginx.conf"+disabledSuffix))
+	return err == nil
+}
+
+// AddDomain creates a new site for domain, aliases are extra host names served by the site
+func (s *Service) AddDomain(domain string, aliases []string, source string) (error, string) {
+	log.Printf("Adding domain: %s %v", domain, aliases)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if source != "" && source != CertSourceLocal {
+		return errors.New("Unknown certificate source " + source), ""
+	}
+	err := s.validateNewDomain(domain, source)
+	if err != nil {
+		return err, ""
+	}
+	aliases, err = s.validateAliases(domain, aliases, source)
+	if err != nil {
+		return err, ""
 	}
 
-	err := os.Mkdir(s.cacheDir+"/"+domain, 0755)
+	err = os.Mkdir(s.cacheDir+"/"+domain, 0755)
 	if err != nil {
 		log.Printf("Failed to create directory %s: %v", s.cacheDir+"/"+domain, err)
 		return err, ""
 	}
+	if len(aliases) > 0 || source != "" {
+		err = s.saveSiteSettings(domain, &SiteSettings{Aliases: aliases, CertSource: source})
+		if err != nil {
+			os.RemoveAll(s.cacheDir + "/" + domain)
+			return err, ""
+		}
+	}
 
 	// Generate nginx.conf for the new domain
-	templatePaths, err := fs.Glob(s.embedFs, "ui/configs/nginx.tmpl")
-	if err != nil || len(templatePaths) == 0 {
-		return errors.New("template file not found"), ""
+	templatePath, err := s.findTemplate("nginx.tmpl")
+	if err != nil {
+		return err, ""
 	}
-	templatePath := templatePaths[0]
 	err = s.generateNginxConfig(domain, templatePath)
 	if err != nil {
 		log.Printf("Failed to generate nginx.conf for %s: %v", domain, err)
 		os.RemoveAll(s.cacheDir + "/" + domain)
 		return err, ""
 	}
-	
-	// Generate SSL certificate for the new domain
-	err = s.cert.GetCertificate(domain, s.cacheDir+"/"+domain)
+	// the site is served over HTTP first, so that the CA can reach the challenge path
+	err = s.nginx.Reload()
 	if err != nil {
-		log.Printf("Failed to get certificate for %s: %v", domain, err)
+		log.Printf("Config of %s is rejected: %v", domain, err)
 		os.RemoveAll(s.cacheDir + "/" + domain)
 		return err, ""
 	}
-
 	s.domains = append(s.domains, domain)
 
+	// Generate SSL certificate for the new domain, the site stays on HTTP
+	// and the renewal scheduler retries if it fails
+	certErr := s.obtainCertificate(context.Background(), domain)
+	if certErr != nil {
+		log.Printf("Failed to get certificate for %s: %v", domain, certErr)
+		certErr = errors.New("Site is served over HTTP until the certificate is issued: " + certErr.Error())
+	} else {
+		err = s.nginx.Reload()
+		if err != nil {
+			return err, ""
+		}
+	}
+
 	//read config
 	content, err := s.nginx.GetConfig(domain)
+	if certErr != nil {
+		err = certErr
+	}
 
 	return err, content
 }
 
-func (s *Service) RemoveDomain(domain string) error {
+// validateNewDomain checks that a domain can be added as a new site with
+// certificates from source. Names for the local CA don't have to resolve.
+func (s *Service) validateNewDomain(domain string, source string) error {
+	if contains(s.domains, domain) {
+		log.Printf("Domain %s already exists", domain)
+		return errors.New("Domain already exists")
+	}
+	for _, other := range s.domains {
+		if contains(s.getServerNames(other), domain) {
+			return errors.New(domain + " is already served by " + other)
+		}
+	}
+	if !isValidName(domain, source) {
+		log.Printf("Invalid domain name: %s", domain)
+		return errors.New("Invalid domain name")
+	}
+	if source == CertSourceLocal {
+		return nil
+	}
+	if isWildcard(domain) && !s.cert.SupportsWildcard() {
+		return errors.New("Wildcard domains need a DNS provider, see -dnsProvider")
+	}
+	if !isDomainResolvable(domain) {
+		log.Printf("Domain %s is not resolvable", domain)
+		return errors.New("Domain is not resolvable")
+	}
+	return nil
+}
+
+// RemoveDomain moves the domain directory to trash and reloads nginx.
+// The removal is refused if other configs include files of the domain and
+// is rolled back if nginx rejects the config tree without the domain.
+// The domain can be restored from trash until the retention expires.
+func (s *Service) RemoveDomain(domain string, user string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if !contains(s.domains, domain) {
 		return errors.New("Domain does not exist")
 	}
 
-	err := os.RemoveAll(s.cacheDir + "/" + domain)
+	refs, err := s.findReferences(domain)
+	if err != nil {
+		return err
+	}
+	if len(refs) > 0 {
+		log.Printf("Domain %s is referenced by %v", domain, refs)
+		return errors.New("Domain is referenced by " + strings.Join(refs, ", "))
+	}
+
+	entry, err := s.moveToTrash(domain, user)
 	if err != nil {
 		log.Printf("Failed to remove directory %s: %v", domain, err)
 		return err
 	}
 
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Config is invalid without %s, restoring it: %v", domain, err)
+		restoreErr := s.undoMoveToTrash(entry)
+		if restoreErr != nil {
+			s.domains = remove(s.domains, domain)
+			return restoreErr
+		}
+		return err
+	}
+
 	s.domains = remove(s.domains, domain)
 
+	err = s.nginx.Reload()
+	if err != nil {
+		log.Printf("Failed to reload nginx after removing %s: %v", domain, err)
+		return err
+	}
+
 	return nil
 }
 
-func (s *Service) checkAndRefreshCertificates() {
-	isRefreshedCertificates := false
-	for _, domain := range s.domains {
-		certPath := s.cacheDir + "/" + domain + "/fullchain.pem"
-		expirationTime, certDomain, issuer := GetExpireTime(certPath)
-		log.Printf("Certificate for %s/%s expires on %s, issuer: %s", domain, certDomain, expirationTime, issuer)
-		if expirationTime == nil ||
-			expirationTime.Sub(time.Now().UTC()).Hours() < (7*24) ||
-			(!s.isDev && strings.Contains(issuer, "stg") ||
-				(certDomain != domain)) {
-			log.Printf("Certificate for %s is expired or will expire soon, refreshing...", domain)
-
-			isValid := isDomainResolvable(domain)
-			if !isValid {
-				log.Printf("Domain %s is not resolvable, skipping certificate refresh", domain)
-				continue
-			}
+// findReferences returns config files outside of the domain directory which refer to files inside it
+func (s *Service) findReferences(domain string) ([]string, error) {
+	domainDir := filepath.Join(s.cacheDir, domain)
+	absDomainDir, err := filepath.Abs(domainDir)
+	if err != nil {
+		return nil, err
+	}
+	relDomainDir := "conf/" + domain + "/"
 
-			err := s.cert.GetCertificate(domain, s.cacheDir+"/"+domain)
-			isRefreshedCertificates = true
-			if err != nil {
-				log.Printf("Failed to get certificate for %s: %v", domain, err)
+	var refs []string
+	err = filepath.WalkDir(s.configDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == domainDir || path == s.trashDir {
+				return filepath.SkipDir
 			}
-		} else {
-			log.Printf("Certificate for %s is still valid", domain)
+			return nil
+		}
+		if !strings.HasSuffix(d.Name(), ".conf") {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
 		}
+		text := string(content)
+		if strings.Contains(text, absDomainDir+"/") || strings.Contains(text, domainDir+"/") || strings.Contains(text, relDomainDir) {
+			refs = append(refs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to look for references to %s: %v", domain, err)
+		return nil, err
 	}
-	if isRefreshedCertificates {
-		s.nginx.RefreshConfig()
+
+	return refs, nil
+}
+
+// obtainCertificate gets a certificate for all names of the site into the domain directory
+func (s *Service) obtainCertificate(ctx context.Context, domain string) error {
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+	if settings.CertSource == CertSourceCustom {
+		return s.checkCustomCertificate(domain)
+	}
+	if settings.CertSource == CertSourceNone {
+		return nil
 	}
+	options := CertOptions{KeyType: settings.KeyType, CA: settings.CA, Source: settings.CertSource}
+	err = s.cert.GetCertificate(ctx, s.getServerNames(domain), filepath.Join(s.cacheDir, domain), options)
+	s.saveRenewalStatus(domain, err)
+	if err != nil {
+		return err
+	}
+	return s.activateCertificate(domain)
 }
 
+// pendingCertMarker starts a config generated before the site has a certificate
+const pendingCertMarker = "# nginx-ui: pending certificate"
+
+// generateNginxConfig renders the site config. A site with certificate files
+// is served with HTTPS, a site without is served over HTTP with the ACME
+// challenge path until activateCertificate re-renders it.
 func (s *Service) generateNginxConfig(domain string, templatePath string) error {
-	tmpl, err := template.ParseFS(s.embedFs, templatePath)
+	return s.renderConfigTemplate(templatePath, filepath.Join(s.cacheDir, domain, "nginx.conf"), s.siteTemplateData(domain))
+}
+
+// activateCertificate re-renders a config generated before the site had a
+// certificate. Other configs get their TLS directives refreshed, the new
+// certificate may come without chain.pem which ssl_trusted_certificate and
+// stapling need.
+func (s *Service) activateCertificate(domain string) error {
+	content, err := s.nginx.GetConfig(domain)
+	if err != nil {
+		return nil
+	}
+	if !strings.HasPrefix(content, pendingCertMarker) {
+		updated, err := s.applySiteTLS(domain, content)
+		if err != nil {
+			log.Printf("Failed to refresh TLS directives of %s: %v", domain, err)
+			return nil
+		}
+		if updated == content {
+			return nil
+		}
+		return s.nginx.writeConfig(domain, updated)
+	}
+	templatePath, err := s.findTemplate("nginx.tmpl")
 	if err != nil {
-		log.Printf("Failed to parse template %s: %v", templatePath, err)
 		return err
 	}
-
-	outputPath := filepath.Join(s.cacheDir, domain, "nginx.conf")
-	outputFile, err := os.Create(outputPath)
+	content, err = s.executeConfigTemplate(templatePath, s.siteTemplateData(domain))
 	if err != nil {
-		log.Printf("Failed to create file %s: %v", outputPath, err)
 		return err
 	}
-	defer outputFile.Close()
+	// the template only has the default location, others can't be protected yet
+	if protected, err := applyClientAuthLocations(content, s.clientAuthLocations(domain)); err == nil {
+		content = protected
+	} else {
+		log.Printf("Failed to require client certificates for %s: %v", domain, err)
+	}
+	err = s.nginx.writeConfig(domain, content)
+	if err != nil {
+		return err
+	}
+	log.Printf("Certificate for %s is issued, the site is served with HTTPS", domain)
+	return nil
+}
 
-	data := struct {
-		Domain  string
-		Path    string
-		Backend string
+func (s *Service) siteTemplateData(domain string) interface{} {
+	path := filepath.Join(s.cacheDir, domain)
+	return struct {
+		Domain        string
+		Aliases       []string
+		Path          string
+		Backend       string
+		UIBackend     string
+		HasCert       bool
+		TLSDirectives []string
+		PendingMarker string
 	}{
-		Domain:  domain,
-		Path:    filepath.Join(s.cacheDir, domain),
-		Backend: "http://localhost:3000",
+		Domain:        domain,
+		Aliases:       s.getServerNames(domain)[1:],
+		Path:          path,
+		Backend:       "http://localhost:3000",
+		UIBackend:     s.uiBackend,
+		HasCert:       fileExists(filepath.Join(path, "fullchain.pem")) && fileExists(filepath.Join(path, "privkey.pem")),
+		TLSDirectives: s.tlsDirectives(domain),
+		PendingMarker: pendingCertMarker,
 	}
-	err = tmpl.Execute(outputFile, data)
+}
+
+func (s *Service) renderConfigTemplate(templatePath string, outputPath string, data interface{}) error {
+	content, err := s.executeConfigTemplate(templatePath, data)
 	if err != nil {
-		log.Printf("Failed to execute template %s, %s: %v", domain, templatePath, err)
+		return err
+	}
+	err = os.WriteFile(outputPath, []byte(content), 0644)
+	if err != nil {
+		log.Printf("Failed to create file %s: %v", outputPath, err)
 		return err
 	}
 
 	return nil
 }
 
+func (s *Service) executeConfigTemplate(templatePath string, data interface{}) (string, error) {
+	tmpl, err := template.ParseFS(s.embedFs, templatePath)
+	if err != nil {
+		log.Printf("Failed to parse template %s: %v", templatePath, err)
+		return "", err
+	}
+
+	var content strings.Builder
+	err = tmpl.Execute(&content, data)
+	if err != nil {
+		log.Printf("Failed to execute template %s: %v", templatePath, err)
+		return "", err
+	}
+
+	return content.String(), nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// findTemplate returns the path of a config template embedded in ui/configs
+func (s *Service) findTemplate(name string) (string, error) {
+	if s.embedFs == nil {
+		return "", errors.New("template file not found")
+	}
+	templatePaths, err := fs.Glob(s.embedFs, "ui/configs/"+name)
+	if err != nil || len(templatePaths) == 0 {
+		return "", errors.New("template file not found")
+	}
+	return templatePaths[0], nil
+}
+
 func getDirectories(dir string) ([]string, error) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -221,12 +556,14 @@ func remove(slice []string, item string) []string {
 	return result
 }
 func isValidDomain(domain string) bool {
-	// Define a regular expression pattern for a valid domain
-	const domainPattern = `^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,}$`
+	// Define a regular expression pattern for a valid domain, a wildcard is allowed as the leftmost label
+	const domainPattern = `^(?:\*\.)?(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,}$`
 	re := regexp.MustCompile(domainPattern)
 	return re.MatchString(domain)
 }
 func isDomainResolvable(domain string) bool {
+	// a wildcard can't be looked up, its parent domain has to resolve
+	domain = strings.TrimPrefix(domain, "*.")
 	_, err := net.LookupHost(domain)
 	if err != nil {
 		log.Printf("Failed to resolve domain %s: %v", domain, err)
@@ -4,6 +4,7 @@ import (
 	"embed"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -58,3 +59,87 @@ func TestGenerateNginxConfig(t *testing.T) {
     assert.NoError(t, err, "Failed to read nginx.conf file")
     assert.Contains(t, string(content), "server_name example.com;", "Expected nginx.conf to contain the domain name")
 }
+
+func TestGenerateNginxConfigWaitsForCertificate(t *testing.T) {
+	cacheDir := t.TempDir()
+	domain := "example.com"
+	domainDir := filepath.Join(cacheDir, domain)
+	assert.NoError(t, os.MkdirAll(domainDir, 0755))
+	service := &Service{cacheDir: cacheDir, embedFs: embedFs, uiBackend: "http://127.0.0.1:3005"}
+
+	err := service.generateNginxConfig(domain, "testdata/nginx.tmpl")
+	assert.NoError(t, err, "Failed to generate nginx.conf")
+	content, _ := os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.True(t, strings.HasPrefix(string(content), pendingCertMarker), "Expected pending marker without certificate")
+	assert.Contains(t, string(content), "listen   80;")
+	assert.Contains(t, string(content), "location /.well-known/acme-challenge/ {\n        proxy_pass http://127.0.0.1:3005;")
+	assert.NotContains(t, string(content), "ssl_certificate")
+
+	assert.NoError(t, os.WriteFile(filepath.Join(domainDir, "fullchain.pem"), []byte("cert"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(domainDir, "privkey.pem"), []byte("key"), 0600))
+	err = service.generateNginxConfig(domain, "testdata/nginx.tmpl")
+	assert.NoError(t, err, "Failed to generate nginx.conf")
+	content, _ = os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.Contains(t, string(content), "listen   443 ssl;")
+	assert.Contains(t, string(content), "ssl_certificate        "+domainDir+"/fullchain.pem;")
+	assert.NotContains(t, string(content), "ssl_trusted_certificate", "Expected no trusted certificate without chain.pem")
+	assert.Contains(t, string(content), "ssl_protocols TLSv1.2 TLSv1.3;", "Expected the default TLS profile")
+	assert.Contains(t, string(content), "return 301 https://$host$request_uri;", "Expected port 80 to redirect to HTTPS")
+	assert.Contains(t, string(content), "location /.well-known/acme-challenge/ {\n        proxy_pass http://127.0.0.1:3005;", "Expected port 80 to pass ACME challenges to nginx-ui")
+	assert.NotContains(t, string(content), pendingCertMarker)
+}
+
+func TestDisableEnableDomain(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	configPath := filepath.Join(cacheDir, domain, "nginx.conf")
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	assert.NoError(t, os.WriteFile(configPath, []byte("server {}\n"), 0644))
+	service := &Service{configDir: configDir, cacheDir: cacheDir, domains: []string{domain}, nginx: newFakeNginx(t, configDir, true)}
+
+	assert.EqualError(t, service.DisableDomain("missing.com"), "Domain does not exist")
+	assert.NoError(t, service.DisableDomain(domain))
+	assert.NoFileExists(t, configPath)
+	assert.FileExists(t, configPath+disabledSuffix)
+	assert.Equal(t, []DomainInfo{{Name: domain, Disabled: true}}, service.GetDomains())
+	assert.NoError(t, service.DisableDomain(domain), "Expected disabling twice to be a no-op")
+
+	// the config is kept disabled when nginx rejects it
+	service.nginx = newFakeNginx(t, configDir, false)
+	assert.Error(t, service.EnableDomain(domain))
+	assert.NoFileExists(t, configPath)
+	assert.FileExists(t, configPath+disabledSuffix)
+
+	service.nginx = newFakeNginx(t, configDir, true)
+	assert.NoError(t, service.EnableDomain(domain))
+	assert.FileExists(t, configPath)
+	assert.NoFileExists(t, configPath+disabledSuffix)
+	assert.Equal(t, []DomainInfo{{Name: domain}}, service.GetDomains())
+}
+
+func TestCheckNewConfigOfDisabledSite(t *testing.T) {
+	configDir := t.TempDir()
+	domainDir := filepath.Join(configDir, "conf", "example.com")
+	configPath := filepath.Join(domainDir, "nginx.conf")
+	assert.NoError(t, os.MkdirAll(domainDir, 0755))
+	assert.NoError(t, os.WriteFile(configPath+disabledSuffix, []byte("server {}\n"), 0644))
+
+	// the fake nginx logs its arguments and the enabled config it sees
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, "nginx.log")
+	script := "#!/bin/sh\necho \"$@\" >> " + logPath + "\ncat " + configPath + " >> " + logPath + "\necho 'nginx: the configuration file syntax is ok'\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "nginx"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	n := &nginx{rootPath: configDir}
+
+	assert.NoError(t, n.CheckNewConfig("example.com", "server { listen 80; }\n"))
+	calls, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "-t\nserver { listen 80; }\n", string(calls), "Expected only nginx -t with the candidate under the enabled name")
+	assert.NoFileExists(t, configPath, "Expected the site to stay disabled")
+	assert.NoFileExists(t, configPath+disabledSuffix+".orig")
+	content, err := os.ReadFile(configPath + disabledSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, "server {}\n", string(content), "Expected the config to be restored")
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// SetupCheck is a requirement of nginx-ui, Problem is empty when it is met
+type SetupCheck struct {
+	Name    string
+	Problem string
+	// Hint tells how to fix the problem by hand
+	Hint string
+	// Fixable problems are fixed by CreateLayout
+	Fixable bool
+}
+
+// SetupStatus is the result of the setup checks. nginx-ui starts with
+// failing checks too, the features depending on them return errors.
+type SetupStatus struct {
+	Checks []SetupCheck
+	Main   *MainConfigStatus
+}
+
+// Problems returns the failing checks
+func (st *SetupStatus) Problems() []SetupCheck {
+	var problems []SetupCheck
+	for _, check := range st.Checks {
+		if check.Problem != "" {
+			problems = append(problems, check)
+		}
+	}
+	return problems
+}
+
+// Fixable reports whether CreateLayout fixes any of the problems
+func (st *SetupStatus) Fixable() bool {
+	for _, check := range st.Problems() {
+		if check.Fixable {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSetup checks the config directory, nginx and the main config. It runs
+// docker and writes to the directories, pages use the cached GetSetupStatus.
+func (s *Service) CheckSetup() *SetupStatus {
+	status := s.checkSetup()
+	s.mu.Lock()
+	s.setup = status
+	s.mu.Unlock()
+	return status
+}
+
+// GetSetupStatus returns the result of the last CheckSetup
+func (s *Service) GetSetupStatus() *SetupStatus {
+	s.mu.Lock()
+	status := s.setup
+	s.mu.Unlock()
+	if status == nil {
+		return s.CheckSetup()
+	}
+	return status
+}
+
+func (s *Service) checkSetup() *SetupStatus {
+	status := &SetupStatus{}
+	status.Checks = append(status.Checks, checkWritableDir("Config directory", s.configDir), checkWritableDir("Site directory", s.cacheDir))
+
+	check := SetupCheck{Name: "nginx"}
+	if s.nginx == nil {
+		check.Problem = "nginx is not configured"
+	} else if err := s.nginx.CheckInstalled(); err != nil {
+		check.Problem = err.Error()
+		if s.nginx.isDocker {
+			check.Hint = "Start the nginx container, e.g. docker compose up -d nginx, and run nginx-ui as a user with access to the docker socket"
+		} else {
+			check.Hint = "Install nginx, e.g. apt install nginx, or start nginx-ui with -docker to use the nginx container"
+		}
+	}
+	status.Checks = append(status.Checks, check)
+
+	status.Main = s.CheckMainConfig()
+	check = SetupCheck{Name: "Main config", Problem: status.Main.Problem}
+	switch {
+	case status.Main.CanInclude:
+		check.Hint = "Add the include on the dashboard or edit the main config"
+	case !fileExists(status.Main.Path):
+		check.Hint = "Create layout writes a main config including the sites"
+		check.Fixable = true
+	case check.Problem != "":
+		check.Hint = "Edit the main config"
+	}
+	status.Checks = append(status.Checks, check)
+	return status
+}
+
+// checkWritableDir checks that dir exists and nginx-ui can create files in it
+func checkWritableDir(name string, dir string) SetupCheck {
+	check := SetupCheck{Name: name}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		check.Problem = dir + " does not exist"
+		check.Hint = "Create layout creates it, or start nginx-ui with -configDir of the nginx config directory"
+		check.Fixable = true
+		return check
+	}
+	if err != nil {
+		check.Problem = dir + " is not accessible: " + err.Error()
+	} else if !info.IsDir() {
+		check.Problem = dir + " is not a directory"
+	} else if file, err := os.CreateTemp(dir, ".nginx-ui-check-*"); err != nil {
+		check.Problem = "nginx-ui can't write to " + dir + ": " + err.Error()
+	} else {
+		file.Close()
+		os.Remove(file.Name())
+		return check
+	}
+	check.Hint = "Run nginx-ui as the owner of " + dir + " or change its permissions, e.g. chown -R $(id -u) " + dir
+	return check
+}
+
+// CreateLayout creates the config and site directories and a main config
+// when missing, then loads the sites
+func (s *Service) CreateLayout() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := os.MkdirAll(s.configDir, 0755)
+	if err != nil {
+		log.Printf("Failed to create %s: %v", s.configDir, err)
+		return errors.New("Failed to create " + s.configDir + ": " + err.Error())
+	}
+	err = s.bootstrapConfigDir()
+	if err != nil {
+		log.Printf("Failed to create %s: %v", s.cacheDir, err)
+		return errors.New("Failed to create " + s.cacheDir + ": " + err.Error())
+	}
+	domains, err := getDirectories(s.cacheDir)
+	if err != nil {
+		return err
+	}
+	s.domains = domains
+	s.setup = s.checkSetup()
+	log.Printf("Config layout is created in %s", s.configDir)
+	return nil
+}
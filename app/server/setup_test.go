@@ -0,0 +1,92 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func findSetupCheck(status *SetupStatus, name string) SetupCheck {
+	for _, check := range status.Checks {
+		if check.Name == name {
+			return check
+		}
+	}
+	return SetupCheck{}
+}
+
+func TestCheckSetupMissingConfigDir(t *testing.T) {
+	configDir := filepath.Join(t.TempDir(), "nginx")
+	service := &Service{configDir: configDir, cacheDir: filepath.Join(configDir, "conf"), nginx: newFakeNginx(t, configDir, true)}
+
+	status := service.CheckSetup()
+	assert.True(t, status.Fixable())
+	check := findSetupCheck(status, "Config directory")
+	assert.Equal(t, configDir+" does not exist", check.Problem)
+	assert.True(t, check.Fixable)
+	assert.Empty(t, findSetupCheck(status, "nginx").Problem)
+	assert.True(t, findSetupCheck(status, "Main config").Fixable)
+
+	// a site left in place is loaded once the layout is created
+	assert.NoError(t, service.CreateLayout())
+	assert.NoError(t, os.Mkdir(filepath.Join(service.cacheDir, "example.com"), 0755))
+	assert.NoError(t, service.CreateLayout())
+	assert.Equal(t, []string{"example.com"}, service.domains)
+
+	// CreateLayout refreshes the status shown on the dashboard
+	status = service.GetSetupStatus()
+	assert.Empty(t, findSetupCheck(status, "Config directory").Problem)
+	assert.Empty(t, findSetupCheck(status, "Site directory").Problem)
+
+	// pages get the cached status until the next check
+	assert.NoError(t, os.RemoveAll(service.cacheDir))
+	assert.Same(t, status, service.GetSetupStatus())
+	assert.Equal(t, service.cacheDir+" does not exist", findSetupCheck(service.CheckSetup(), "Site directory").Problem)
+	assert.True(t, service.GetSetupStatus().Fixable())
+}
+
+func TestCheckSetupNginx(t *testing.T) {
+	configDir := t.TempDir()
+	service := &Service{configDir: configDir, cacheDir: filepath.Join(configDir, "conf"), nginx: &nginx{rootPath: configDir}}
+	t.Setenv("PATH", t.TempDir())
+	check := findSetupCheck(service.CheckSetup(), "nginx")
+	assert.Equal(t, "nginx is not installed or not in PATH", check.Problem)
+	assert.False(t, check.Fixable)
+
+	service.nginx.isDocker = true
+	assert.EqualError(t, service.nginx.CheckInstalled(), "docker is not installed or not in PATH")
+
+	binDir := t.TempDir()
+	t.Setenv("PATH", binDir)
+	docker := filepath.Join(binDir, "docker")
+	assert.NoError(t, os.WriteFile(docker, []byte("#!/bin/sh\necho false\n"), 0755))
+	assert.EqualError(t, service.nginx.CheckInstalled(), "nginx container is not running")
+
+	assert.NoError(t, os.WriteFile(docker, []byte("#!/bin/sh\necho 'Error: No such object: nginx'\nexit 1\n"), 0755))
+	assert.EqualError(t, service.nginx.CheckInstalled(), "nginx container is not available: Error: No such object: nginx")
+
+	assert.NoError(t, os.WriteFile(docker, []byte("#!/bin/sh\necho true\n"), 0755))
+	assert.NoError(t, service.nginx.CheckInstalled())
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir := t.TempDir()
+	assert.Empty(t, checkWritableDir("dir", dir).Problem)
+
+	file := filepath.Join(dir, "file")
+	assert.NoError(t, os.WriteFile(file, nil, 0644))
+	check := checkWritableDir("dir", file)
+	assert.Equal(t, file+" is not a directory", check.Problem)
+	assert.False(t, check.Fixable)
+
+	if os.Geteuid() == 0 {
+		t.Skip("root writes to read-only directories")
+	}
+	readOnly := filepath.Join(dir, "ro")
+	assert.NoError(t, os.Mkdir(readOnly, 0555))
+	check = checkWritableDir("dir", readOnly)
+	assert.Contains(t, check.Problem, "nginx-ui can't write to "+readOnly)
+	assert.Contains(t, check.Hint, "chown")
+}
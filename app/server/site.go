@@ -0,0 +1,334 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const siteSettingsFile = "site.json"
+
+// CertSourceCustom marks a site with an uploaded certificate, ACME doesn't renew it
+const CertSourceCustom = "custom"
+
+// CertSourceNone marks a site served over HTTP only, like an imported site
+// without TLS, nginx-ui doesn't obtain a certificate for it
+const CertSourceNone = "none"
+
+// SiteSettings are per site options stored as site.json in the domain directory
+type SiteSettings struct {
+	// Aliases are extra host names served by the site and covered by its certificate
+	Aliases []string `json:"aliases,omitempty"`
+	// KeyType of the certificate key, see KeyType* constants, empty means the -keyType default
+	KeyType string `json:"keyType,omitempty"`
+	// CA the certificate is ordered from, empty means the -acmeCA default
+	CA string `json:"ca,omitempty"`
+	// CertSource is where the certificate comes from, empty means ACME
+	CertSource string `json:"certSource,omitempty"`
+	// TLSProfile is modern, intermediate or old, empty means the -tlsProfile default
+	TLSProfile string `json:"tlsProfile,omitempty"`
+	// ClientAuth requires client certificates, nil means any client is served
+	ClientAuth *ClientAuthSettings `json:"clientAuth,omitempty"`
+	// ImportedFrom are the config files the site was imported from
+	ImportedFrom string `json:"importedFrom,omitempty"`
+}
+
+// GetSiteSettings reads the settings of a site, a site without settings file gets defaults
+func (s *Service) GetSiteSettings(domain string) (*SiteSettings, error) {
+	settings := &SiteSettings{}
+	content, err := os.ReadFile(filepath.Join(s.cacheDir, domain, siteSettingsFile))
+	if os.IsNotExist(err) {
+		return settings, nil
+	}
+	if err != nil {
+		log.Printf("Failed to read site settings of %s: %v", domain, err)
+		return nil, err
+	}
+	err = json.Unmarshal(content, settings)
+	if err != nil {
+		log.Printf("Failed to parse site settings of %s: %v", domain, err)
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *Service) saveSiteSettings(domain string, settings *SiteSettings) error {
+	content, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.cacheDir, domain, siteSettingsFile)
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		log.Printf("Failed to write site settings %s: %v", path, err)
+		return err
+	}
+	return nil
+}
+
+// getServerNames returns the primary domain followed by its aliases
+func (s *Service) getServerNames(domain string) []string {
+	names := []string{domain}
+	settings, err := s.GetSiteSettings(domain)
+	if err == nil {
+		names = append(names, settings.Aliases...)
+	}
+	return names
+}
+
+// SetAliases changes the extra host names of a site: server_name directives
+// are rewritten, a certificate covering all names is obtained and nginx is
+// reloaded. Config and settings are restored if any step fails.
+func (s *Service) SetAliases(domain string, aliases []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	aliases, err := s.validateAliases(domain, aliases, s.certSource(domain))
+	if err != nil {
+		return err
+	}
+
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+	oldContent, err := s.nginx.GetConfig(domain)
+	if err != nil {
+		return err
+	}
+	oldNames := s.getServerNames(domain)
+	oldSettings := *settings
+
+	names := append([]string{domain}, aliases...)
+	content, err := rewriteServerNames(oldContent, oldNames, names)
+	if err != nil {
+		log.Printf("Failed to rewrite server_name of %s: %v", domain, err)
+		return err
+	}
+
+	settings.Aliases = aliases
+	err = s.saveSiteSettings(domain, settings)
+	if err != nil {
+		return err
+	}
+	rollback := func() {
+		s.saveSiteSettings(domain, &oldSettings)
+		s.nginx.writeConfig(domain, oldContent)
+	}
+
+	err = s.nginx.writeConfig(domain, content)
+	if err != nil {
+		rollback()
+		return err
+	}
+	err = s.obtainCertificate(context.Background(), domain)
+	if err != nil {
+		log.Printf("Failed to get certificate for %v: %v", names, err)
+		rollback()
+		return err
+	}
+	err = s.nginx.TestConfig()
+	if err != nil {
+		rollback()
+		return err
+	}
+	log.Printf("Domain %s aliases are set to %v", domain, aliases)
+
+	return s.nginx.Reload()
+}
+
+// SetKeyType changes the certificate key type of a site and issues a new certificate with it
+func (s *Service) SetKeyType(domain string, keyType string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	if keyType != "" {
+		if _, err := generateKey(keyType); err != nil {
+			return err
+		}
+	}
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+	oldSettings := *settings
+	settings.KeyType = keyType
+	err = s.saveSiteSettings(domain, settings)
+	if err != nil {
+		return err
+	}
+	err = s.obtainCertificate(context.Background(), domain)
+	if err != nil {
+		s.saveSiteSettings(domain, &oldSettings)
+		return err
+	}
+	log.Printf("Domain %s key type is set to %s", domain, keyType)
+
+	return s.nginx.Reload()
+}
+
+// SetCA changes the CA of a site and orders a new certificate from it
+func (s *Service) SetCA(domain string, ca string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	if _, err := s.cert.getIssuer(ca); err != nil {
+		return err
+	}
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+	oldSettings := *settings
+	settings.CA = ca
+	err = s.saveSiteSettings(domain, settings)
+	if err != nil {
+		return err
+	}
+	err = s.obtainCertificate(context.Background(), domain)
+	if err != nil {
+		s.saveSiteSettings(domain, &oldSettings)
+		return err
+	}
+	log.Printf("Domain %s CA is set to %s", domain, ca)
+
+	return s.nginx.Reload()
+}
+
+// SetCertSource switches a site between ACME ("") and the local CA and
+// issues a certificate from the new source. Custom certificates are set by uploading one.
+func (s *Service) SetCertSource(domain string, source string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	if source != "" && source != CertSourceLocal {
+		return errors.New("Unknown certificate source " + source)
+	}
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+	if source == "" {
+		for _, name := range s.getServerNames(domain) {
+			if !isValidDomain(name) {
+				return errors.New(name + " is an internal name, ACME can't issue a certificate for it")
+			}
+		}
+	}
+	oldSettings := *settings
+	settings.CertSource = source
+	err = s.saveSiteSettings(domain, settings)
+	if err != nil {
+		return err
+	}
+	err = s.obtainCertificate(context.Background(), domain)
+	if err != nil {
+		s.saveSiteSettings(domain, &oldSettings)
+		return err
+	}
+	log.Printf("Domain %s certificate source is set to %q", domain, source)
+
+	return s.nginx.Reload()
+}
+
+// certSource returns where the certificate of a site comes from, empty for ACME
+func (s *Service) certSource(domain string) string {
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return ""
+	}
+	return settings.CertSource
+}
+
+// validateAliases normalizes the alias list and checks every name
+func (s *Service) validateAliases(domain string, aliases []string, source string) ([]string, error) {
+	var result []string
+	for _, alias := range aliases {
+		alias = strings.ToLower(strings.TrimSpace(alias))
+		if alias == "" || alias == domain || contains(result, alias) {
+			continue
+		}
+		if !isValidName(alias, source) {
+			return nil, errors.New("Invalid domain name " + alias)
+		}
+		for _, other := range s.domains {
+			if other != domain && contains(s.getServerNames(other), alias) {
+				return nil, errors.New(alias + " is already served by " + other)
+			}
+		}
+		result = append(result, alias)
+	}
+	return result, nil
+}
+
+// rewriteServerNames replaces oldNames in server_name directives with names.
+// Directives which don't serve any of the old names are left untouched.
+func rewriteServerNames(content string, oldNames []string, names []string) (string, error) {
+	directives, err := parseNginxConfig(content)
+	if err != nil {
+		return "", err
+	}
+
+	var serverNames []*confDirective
+	walkConfDirectives(directives, nil, func(d *confDirective, parents []string) {
+		if d.name != "server_name" || d.block {
+			return
+		}
+		for _, arg := range d.args {
+			if contains(oldNames, arg) {
+				serverNames = append(serverNames, d)
+				return
+			}
+		}
+	})
+
+	// rewrite from the end so that offsets of earlier directives stay valid
+	result := content
+	for i := len(serverNames) - 1; i >= 0; i-- {
+		d := serverNames[i]
+		// keep names which are not managed, e.g. default_server or regexps
+		args := append([]string{}, names...)
+		for _, arg := range d.args {
+			if !contains(oldNames, arg) && !contains(args, arg) {
+				args = append(args, arg)
+			}
+		}
+		result = result[:d.argsStart] + strings.Join(args, " ") + result[d.argsEnd:]
+	}
+
+	return result, nil
+}
+
+// sameNames reports whether two host name lists contain the same names in any order
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string{}, a...)
+	b = append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if !strings.EqualFold(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
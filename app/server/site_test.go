@@ -0,0 +1,50 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriteServerNames(t *testing.T) {
+	content := `server {
+    listen 80 default_server;
+    server_name _;
+}
+server {
+    listen 443 ssl;
+    server_name example.com old.example.com;
+}`
+
+	result, err := rewriteServerNames(content, []string{"example.com", "old.example.com"}, []string{"example.com", "www.example.com"})
+	assert.NoError(t, err, "Expected no error from rewriteServerNames")
+	assert.Contains(t, result, "server_name example.com www.example.com;", "Expected aliases to be rendered")
+	assert.Contains(t, result, "server_name _;", "Expected unrelated server block to stay untouched")
+}
+
+func TestSiteSettings(t *testing.T) {
+	cacheDir := t.TempDir()
+	domain := "example.com"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	service := &Service{cacheDir: cacheDir, domains: []string{domain, "other.com"}}
+
+	assert.Equal(t, []string{domain}, service.getServerNames(domain), "Expected only primary name without settings")
+
+	err := service.saveSiteSettings(domain, &SiteSettings{Aliases: []string{"www.example.com"}})
+	assert.NoError(t, err, "Expected no error from saveSiteSettings")
+	assert.Equal(t, []string{domain, "www.example.com"}, service.getServerNames(domain))
+
+	_, err = service.validateAliases("other.com", []string{"www.example.com"}, "")
+	assert.Error(t, err, "Expected error for alias served by another site")
+	assert.EqualError(t, service.validateNewDomain("www.example.com", CertSourceLocal), "www.example.com is already served by example.com", "Expected an alias not to be added as a new site")
+	aliases, err := service.validateAliases(domain, []string{" WWW.example.com ", domain, "www.example.com"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"www.example.com"}, aliases, "Expected aliases to be normalized and deduplicated")
+}
+
+func TestSameNames(t *testing.T) {
+	assert.True(t, sameNames([]string{"a.com", "b.com"}, []string{"b.com", "a.com"}))
+	assert.False(t, sameNames([]string{"a.com"}, []string{"a.com", "b.com"}))
+}
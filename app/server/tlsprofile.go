@@ -0,0 +1,312 @@
+package server
+
+import (
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	TLSProfileModern       = "modern"
+	TLSProfileIntermediate = "intermediate"
+	TLSProfileOld          = "old"
+)
+
+// TLSProfile is a Mozilla server side TLS configuration, see https://ssl-config.mozilla.org
+type TLSProfile struct {
+	Name                string
+	Protocols           string
+	Ciphers             string // empty for TLS 1.3 only, its ciphers are not configurable
+	PreferServerCiphers bool
+	// DHParam profiles offer DHE ciphers which need ssl_dhparam
+	DHParam bool
+}
+
+var tlsProfiles = map[string]TLSProfile{
+	TLSProfileModern: {
+		Name:      TLSProfileModern,
+		Protocols: "TLSv1.3",
+	},
+	TLSProfileIntermediate: {
+		Name:      TLSProfileIntermediate,
+		Protocols: "TLSv1.2 TLSv1.3",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:" +
+			"ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305",
+		DHParam: true,
+	},
+	TLSProfileOld: {
+		Name:      TLSProfileOld,
+		Protocols: "TLSv1 TLSv1.1 TLSv1.2 TLSv1.3",
+		Ciphers: "ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:" +
+			"ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384:DHE-RSA-CHACHA20-POLY1305:" +
+			"ECDHE-ECDSA-AES128-SHA256:ECDHE-RSA-AES128-SHA256:ECDHE-ECDSA-AES128-SHA:ECDHE-RSA-AES128-SHA:ECDHE-ECDSA-AES256-SHA384:ECDHE-RSA-AES256-SHA384:" +
+			"ECDHE-ECDSA-AES256-SHA:ECDHE-RSA-AES256-SHA:DHE-RSA-AES128-SHA256:DHE-RSA-AES256-SHA256:AES128-GCM-SHA256:AES256-GCM-SHA384:" +
+			"AES128-SHA256:AES256-SHA256:AES128-SHA:AES256-SHA:DES-CBC3-SHA",
+		PreferServerCiphers: true,
+		DHParam:             true,
+	},
+}
+
+// TLSProfileNames lists the profiles from the most to the least strict
+var TLSProfileNames = []string{TLSProfileModern, TLSProfileIntermediate, TLSProfileOld}
+
+// tlsManagedDirectives are replaced when a profile is applied to a config
+var tlsManagedDirectives = []string{
+	"ssl_protocols", "ssl_ciphers", "ssl_prefer_server_ciphers",
+	"ssl_session_timeout", "ssl_session_cache", "ssl_session_tickets",
+	"ssl_dhparam", "ssl_stapling", "ssl_stapling_verify", "ssl_trusted_certificate",
+	"ssl_client_certificate", "ssl_verify_client", "ssl_verify_depth", "ssl_crl",
+}
+
+// ffdhe2048 is the RFC 7919 2048 bit group, the DH params recommended by
+// Mozilla instead of generating a random group
+const ffdhe2048 = "FFFFFFFFFFFFFFFFADF85458A2BB4A9AAFDC5620273D3CF1D8B9C583CE2D3695A9E13641146433FBCC939DCE249B3EF9" +
+	"7D2FE363630C75D8F681B202AEC4617AD3DF1ED5D5FD65612433F51F5F066ED085636555" +
+	"3DED1AF3B557135E7F57C935984F0C70E0E68B77E2A689DAF3EFE8721DF158A136ADE735" +
+	"30ACCA4F483A797ABC0AB182B324FB61D108A94BB2C8E3FBB96ADAB760D7F4681D4F42A3" +
+	"DE394DF4AE56EDE76372BB190B07A7C8EE0A6D709E02FCE1CDF7E2ECC03404CD28342F61" +
+	"9172FE9CE98583FF8E4F1232EEF28183C3FE3B1B4C6FAD733BB5FCBC2EC22005C58EF183" +
+	"7D1683B2C6F34A26C1B2EFFA886B423861285C97FFFFFFFFFFFFFFFF"
+
+// effectiveTLSProfile returns the profile of a site, the -tlsProfile default if it has none
+func (s *Service) effectiveTLSProfile(domain string) string {
+	settings, err := s.GetSiteSettings(domain)
+	if err == nil && settings.TLSProfile != "" {
+		return settings.TLSProfile
+	}
+	if s.tlsProfile != "" {
+		return s.tlsProfile
+	}
+	return TLSProfileIntermediate
+}
+
+// tlsDirectives renders the TLS profile of a site. OCSP stapling is only
+// enabled when the certificate names an OCSP responder, nginx warns otherwise.
+func (s *Service) tlsDirectives(domain string) []string {
+	profile := tlsProfiles[s.effectiveTLSProfile(domain)]
+	path := filepath.Join(s.cacheDir, domain)
+
+	directives := []string{"ssl_protocols " + profile.Protocols}
+	if profile.Ciphers != "" {
+		directives = append(directives, "ssl_ciphers "+profile.Ciphers)
+	}
+	directives = append(directives,
+		"ssl_prefer_server_ciphers "+onOff(profile.PreferServerCiphers),
+		"ssl_session_timeout 1d",
+		"ssl_session_cache shared:MozSSL:10m",
+		"ssl_session_tickets off",
+	)
+	if profile.DHParam && fileExists(s.dhParamPath()) {
+		directives = append(directives, "ssl_dhparam "+s.dhParamPath())
+	}
+	if fileExists(filepath.Join(path, "chain.pem")) {
+		directives = append(directives, "ssl_trusted_certificate "+filepath.Join(path, "chain.pem"))
+		info, err := ReadCertInfo(filepath.Join(path, "fullchain.pem"))
+		if err == nil && info.OCSP {
+			directives = append(directives, "ssl_stapling on", "ssl_stapling_verify on")
+		}
+	}
+	return append(directives, s.clientAuthDirectives(domain)...)
+}
+
+// SetTLSProfile changes the TLS profile of a site, an empty profile means the default one
+func (s *Service) SetTLSProfile(domain string, profile string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.domains, domain) {
+		return errors.New("Domain does not exist")
+	}
+	if _, ok := tlsProfiles[profile]; profile != "" && !ok {
+		return errors.New("Unknown TLS profile " + profile)
+	}
+	settings, err := s.GetSiteSettings(domain)
+	if err != nil {
+		return err
+	}
+	oldSettings := *settings
+	settings.TLSProfile = profile
+	err = s.saveSiteSettings(domain, settings)
+	if err != nil {
+		return err
+	}
+	err = s.applyTLSProfiles([]string{domain})
+	if err != nil {
+		s.saveSiteSettings(domain, &oldSettings)
+		return err
+	}
+	log.Printf("Domain %s TLS profile is set to %s", domain, s.effectiveTLSProfile(domain))
+
+	return s.nginx.Reload()
+}
+
+// GenerateDHParams writes DH params for DHE ciphers and adds them to all
+// sites. 2048 bits use the RFC 7919 ffdhe2048 group, other sizes are
+// generated with openssl which takes a while.
+func (s *Service) GenerateDHParams(bits int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.dhParamPath()
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	if bits == 2048 {
+		p, _ := new(big.Int).SetString(ffdhe2048, 16)
+		der, err := asn1.Marshal(struct{ P, G *big.Int }{p, big.NewInt(2)})
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "DH PARAMETERS", Bytes: der}), 0644)
+		if err != nil {
+			return err
+		}
+	} else {
+		output, err := exec.Command("openssl", "dhparam", "-out", path, fmt.Sprint(bits)).CombinedOutput()
+		if err != nil {
+			log.Printf("Failed to generate DH params: %v %s", err, string(output))
+			return fmt.Errorf("openssl dhparam failed: %v", err)
+		}
+	}
+	log.Printf("DH params (%d bits) are written to %s", bits, path)
+
+	err = s.applyTLSProfiles(s.domains)
+	if err != nil {
+		return err
+	}
+	return s.nginx.Reload()
+}
+
+// applyTLSProfiles rewrites the TLS directives of sites with a certificate
+// and validates the result, all configs are restored if nginx rejects it
+func (s *Service) applyTLSProfiles(domains []string) error {
+	backup := make(map[string]string)
+	for _, domain := range domains {
+		content, err := s.nginx.GetConfig(domain)
+		if err != nil {
+			continue
+		}
+		updated, err := s.applySiteTLS(domain, content)
+		if err != nil {
+			log.Printf("Failed to apply TLS profile to %s: %v", domain, err)
+			continue
+		}
+		if updated == content {
+			continue
+		}
+		backup[domain] = content
+		err = s.nginx.writeConfig(domain, updated)
+		if err != nil {
+			break
+		}
+	}
+
+	err := s.nginx.TestConfig()
+	if err != nil {
+		for domain, content := range backup {
+			s.nginx.writeConfig(domain, content)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Service) dhParamPath() string {
+	return filepath.Join(s.configDir, "certs", "dhparam.pem")
+}
+
+// applyTLSDirectives replaces the TLS directives in every server block with
+// ssl_certificate_key by directives, they are placed right after the key
+func applyTLSDirectives(content string, directives []string) (string, error) {
+	parsed, err := parseNginxConfig(content)
+	if err != nil {
+		return "", err
+	}
+
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	walkConfDirectives(parsed, nil, func(d *confDirective, parents []string) {
+		if d.name != "server" || !d.block {
+			return
+		}
+		var key *confDirective
+		for _, child := range d.children {
+			if child.name == "ssl_certificate_key" && !child.block {
+				key = child
+			}
+		}
+		if key == nil {
+			return
+		}
+		indent := "    "
+		if from, alone := lineStart(content, key.start); alone {
+			indent = content[from:key.start]
+		}
+		var text strings.Builder
+		for _, directive := range directives {
+			text.WriteString("\n" + indent + directive + ";")
+		}
+		edits = append(edits, edit{start: key.end, end: key.end, text: text.String()})
+		for _, child := range d.children {
+			if !child.block && contains(tlsManagedDirectives, child.name) {
+				start, end := lineSpan(content, child.start, child.end)
+				edits = append(edits, edit{start: start, end: end})
+			}
+		}
+	})
+
+	// apply from the end so that offsets of earlier edits stay valid
+	sort.SliceStable(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	result := content
+	for _, e := range edits {
+		result = result[:e.start] + e.text + result[e.end:]
+	}
+	return result, nil
+}
+
+// lineStart returns the offset of the line of pos and whether only blanks precede pos on it
+func lineStart(content string, pos int) (int, bool) {
+	i := pos
+	for i > 0 && (content[i-1] == ' ' || content[i-1] == '\t') {
+		i--
+	}
+	return i, i == 0 || content[i-1] == '\n'
+}
+
+// lineSpan widens [start, end) to whole lines when nothing else is on them
+func lineSpan(content string, start int, end int) (int, int) {
+	from, alone := lineStart(content, start)
+	to := end
+	for to < len(content) && (content[to] == ' ' || content[to] == '\t') {
+		to++
+	}
+	if !alone {
+		return start, end
+	}
+	if to == len(content) {
+		return from, to
+	}
+	if content[to] == '\n' {
+		return from, to + 1
+	}
+	return start, end
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
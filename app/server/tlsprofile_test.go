@@ -0,0 +1,145 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyTLSDirectives(t *testing.T) {
+	content := `server {
+    listen 443 ssl;
+    ssl_certificate     /conf/example.com/fullchain.pem;
+    ssl_certificate_key /conf/example.com/privkey.pem;
+    ssl_protocols TLSv1 TLSv1.1;
+    ssl_stapling on; # keep it
+    location / {
+        ssl_ciphers HIGH;
+    }
+}
+server {
+    listen 80;
+    ssl_protocols TLSv1;
+}`
+
+	result, err := applyTLSDirectives(content, []string{"ssl_protocols TLSv1.3", "ssl_session_tickets off"})
+	assert.NoError(t, err, "Expected no error from applyTLSDirectives")
+	assert.Equal(t, `server {
+    listen 443 ssl;
+    ssl_certificate     /conf/example.com/fullchain.pem;
+    ssl_certificate_key /conf/example.com/privkey.pem;
+    ssl_protocols TLSv1.3;
+    ssl_session_tickets off;
+     # keep it
+    location / {
+        ssl_ciphers HIGH;
+    }
+}
+server {
+    listen 80;
+    ssl_protocols TLSv1;
+}`, result, "Expected TLS directives to be replaced in the HTTPS server only")
+
+	again, err := applyTLSDirectives(result, []string{"ssl_protocols TLSv1.3", "ssl_session_tickets off"})
+	assert.NoError(t, err)
+	assert.Equal(t, result, again, "Expected applying the same profile twice to change nothing")
+}
+
+func TestSetTLSProfile(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	domainDir := filepath.Join(cacheDir, domain)
+	assert.NoError(t, os.MkdirAll(domainDir, 0755))
+	config := "server {\n    listen 443 ssl;\n    ssl_certificate_key " + domainDir + "/privkey.pem;\n}\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(domainDir, "nginx.conf"), []byte(config), 0644))
+	service := &Service{
+		configDir:  configDir,
+		cacheDir:   cacheDir,
+		domains:    []string{domain},
+		nginx:      newFakeNginx(t, configDir, true),
+		tlsProfile: TLSProfileIntermediate,
+	}
+
+	err := service.SetTLSProfile(domain, "strict")
+	assert.Error(t, err, "Expected error for unknown profile")
+
+	err = service.SetTLSProfile(domain, TLSProfileModern)
+	assert.NoError(t, err, "Expected no error from SetTLSProfile")
+	content, _ := os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.Contains(t, string(content), "ssl_protocols TLSv1.3;")
+	assert.NotContains(t, string(content), "ssl_ciphers", "Expected no cipher list for TLS 1.3 only")
+
+	err = service.SetTLSProfile(domain, TLSProfileOld)
+	assert.NoError(t, err)
+	err = service.GenerateDHParams(2048)
+	assert.NoError(t, err, "Expected no error from GenerateDHParams")
+	content, _ = os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.Contains(t, string(content), "ssl_prefer_server_ciphers on;")
+	assert.Contains(t, string(content), "ssl_dhparam "+service.dhParamPath()+";", "Expected DH params for DHE ciphers")
+
+	dhparam, err := os.ReadFile(service.dhParamPath())
+	assert.NoError(t, err)
+	block, _ := pem.Decode(dhparam)
+	var params struct{ P, G *big.Int }
+	_, err = asn1.Unmarshal(block.Bytes, &params)
+	assert.NoError(t, err)
+	assert.Equal(t, 2048, params.P.BitLen())
+	assert.True(t, new(big.Int).Rsh(params.P, 1).ProbablyPrime(10), "Expected a safe prime")
+}
+
+func TestSwitchingStapledSiteToLocalCA(t *testing.T) {
+	service := newRenameTestService(t)
+	domainDir := filepath.Join(service.cacheDir, "wiki")
+
+	// the site has an ACME certificate with an issuer chain and an OCSP responder
+	root, rootKey := testCertificate(t, "Test Root", nil, true, nil, nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "wiki"},
+		DNSNames:     []string{"wiki", "www.wiki"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		OCSPServer:   []string{"http://ocsp.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, root, &key.PublicKey, rootKey)
+	assert.NoError(t, err)
+	assert.NoError(t, saveCertificate(&tls.Certificate{Certificate: [][]byte{der, root.Raw}, PrivateKey: key}, domainDir))
+	assert.NoError(t, service.saveSiteSettings("wiki", &SiteSettings{Aliases: []string{"www.wiki"}}))
+	templatePath, err := service.findTemplate("nginx.tmpl")
+	assert.NoError(t, err)
+	assert.NoError(t, service.generateNginxConfig("wiki", templatePath))
+	content, _ := os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.Contains(t, string(content), "ssl_stapling on;")
+
+	// nginx refuses a config with a trusted certificate that doesn't exist
+	binDir := t.TempDir()
+	script := "#!/bin/sh\n" +
+		"if grep -q " + domainDir + "/chain.pem " + domainDir + "/nginx.conf && [ ! -f " + domainDir + "/chain.pem ]; then\n" +
+		"  echo 'nginx: [emerg] cannot load ssl_trusted_certificate'; exit 1\n" +
+		"fi\n" +
+		"echo 'nginx: the configuration file syntax is ok'\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(binDir, "nginx"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	assert.NoError(t, service.SetCertSource("wiki", CertSourceLocal))
+	assert.NoFileExists(t, filepath.Join(domainDir, "chain.pem"), "Expected no chain for a local CA certificate")
+	content, _ = os.ReadFile(filepath.Join(domainDir, "nginx.conf"))
+	assert.NotContains(t, string(content), "ssl_trusted_certificate")
+	assert.NotContains(t, string(content), "ssl_stapling")
+	assert.NoError(t, service.nginx.TestConfig())
+}
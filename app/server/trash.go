@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const trashMetaFile = "meta.json"
+
+// TrashEntry is a removed domain kept in the trash until it is restored or purged
+type TrashEntry struct {
+	ID        string    `json:"id"`
+	Domain    string    `json:"domain"`
+	RemovedBy string    `json:"removedBy"`
+	RemovedAt time.Time `json:"removedAt"`
+}
+
+// ExpiresAt is the time the entry is purged automatically
+func (e TrashEntry) ExpiresAt(retention time.Duration) time.Time {
+	return e.RemovedAt.Add(retention)
+}
+
+// moveToTrash moves the domain directory to trash/<id>/site and stores who removed it and when
+func (s *Service) moveToTrash(domain string, user string) (*TrashEntry, error) {
+	now := time.Now().UTC()
+	entry := &TrashEntry{
+		Domain:    domain,
+		RemovedBy: user,
+		RemovedAt: now,
+	}
+	err := os.MkdirAll(s.trashDir, 0755)
+	if err != nil {
+		log.Printf("Failed to create trash directory %s: %v", s.trashDir, err)
+		return nil, err
+	}
+	// a domain removed twice within a second gets a numbered entry, the
+	// directory of an earlier entry is never reused
+	baseID := domain + "-" + now.Format("20060102150405")
+	var entryDir string
+	for i := 0; ; i++ {
+		entry.ID = baseID
+		if i > 0 {
+			entry.ID += "-" + strconv.Itoa(i)
+		}
+		entryDir = filepath.Join(s.trashDir, entry.ID)
+		err = os.Mkdir(entryDir, 0755)
+		if !errors.Is(err, fs.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to create trash directory %s: %v", entryDir, err)
+		return nil, err
+	}
+
+	meta, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(entryDir, trashMetaFile), meta, 0644)
+	if err != nil {
+		log.Printf("Failed to write trash metadata for %s: %v", domain, err)
+		os.RemoveAll(entryDir)
+		return nil, err
+	}
+
+	err = os.Rename(filepath.Join(s.cacheDir, domain), filepath.Join(entryDir, "site"))
+	if err != nil {
+		log.Printf("Failed to move %s to trash: %v", domain, err)
+		os.RemoveAll(entryDir)
+		return nil, err
+	}
+	log.Printf("Domain %s is moved to trash by %s", domain, user)
+
+	return entry, nil
+}
+
+// undoMoveToTrash puts the domain directory back right after moveToTrash
+func (s *Service) undoMoveToTrash(entry *TrashEntry) error {
+	err := os.Rename(filepath.Join(s.trashDir, entry.ID, "site"), filepath.Join(s.cacheDir, entry.Domain))
+	if err != nil {
+		log.Printf("Failed to restore %s, it is kept in trash as %s: %v", entry.Domain, entry.ID, err)
+		return err
+	}
+	return os.RemoveAll(filepath.Join(s.trashDir, entry.ID))
+}
+
+// GetTrash lists removed domains, most recent first
+func (s *Service) GetTrash() ([]TrashEntry, error) {
+	dirs, err := os.ReadDir(s.trashDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to read trash directory %s: %v", s.trashDir, err)
+		return nil, err
+	}
+
+	var entries []TrashEntry
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		entry, err := s.readTrashEntry(dir.Name())
+		if err != nil {
+			log.Printf("Skipping broken trash entry %s: %v", dir.Name(), err)
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].RemovedAt.After(entries[j].RemovedAt)
+	})
+
+	return entries, nil
+}
+
+// RestoreFromTrash moves a removed domain back, validates the config and reloads nginx.
+// The domain goes back to trash if nginx rejects it.
+func (s *Service) RestoreFromTrash(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.readTrashEntry(id)
+	if err != nil {
+		return err
+	}
+	if contains(s.domains, entry.Domain) {
+		return errors.New("Domain already exists")
+	}
+
+	domainDir := filepath.Join(s.cacheDir, entry.Domain)
+	siteDir := filepath.Join(s.trashDir, id, "site")
+	err = os.Rename(siteDir, domainDir)
+	if err != nil {
+		log.Printf("Failed to restore %s from trash: %v", entry.Domain, err)
+		return err
+	}
+
+	err = s.nginx.TestConfig()
+	if err != nil {
+		log.Printf("Restored config of %s is invalid, moving it back to trash: %v", entry.Domain, err)
+		os.Rename(domainDir, siteDir)
+		return err
+	}
+
+	os.RemoveAll(filepath.Join(s.trashDir, id))
+	s.domains = append(s.domains, entry.Domain)
+	s.nginx.RefreshConfig()
+	log.Printf("Domain %s is restored from trash", entry.Domain)
+
+	return nil
+}
+
+// PurgeFromTrash permanently deletes a removed domain with its certificates
+func (s *Service) PurgeFromTrash(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, err := s.readTrashEntry(id)
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(filepath.Join(s.trashDir, id))
+	if err != nil {
+		log.Printf("Failed to purge %s from trash: %v", id, err)
+		return err
+	}
+	log.Printf("Domain %s is purged from trash", entry.Domain)
+
+	return nil
+}
+
+// purgeExpiredTrash deletes entries older than the configured retention
+func (s *Service) purgeExpiredTrash() {
+	entries, err := s.GetTrash()
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	for _, entry := range entries {
+		if now.After(entry.ExpiresAt(s.trashRetention)) {
+			s.PurgeFromTrash(entry.ID)
+		}
+	}
+}
+
+func (s *Service) readTrashEntry(id string) (*TrashEntry, error) {
+	if id == "" || id != filepath.Base(id) {
+		return nil, errors.New("invalid trash entry")
+	}
+	content, err := os.ReadFile(filepath.Join(s.trashDir, id, trashMetaFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("trash entry does not exist")
+		}
+		return nil, err
+	}
+	var entry TrashEntry
+	err = json.Unmarshal(content, &entry)
+	if err != nil {
+		return nil, err
+	}
+	entry.ID = id
+
+	return &entry, nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeNginx puts a fake nginx executable on PATH, nginx -t succeeds only if valid is true
+func newFakeNginx(t *testing.T, configDir string, valid bool) *nginx {
+	binDir := t.TempDir()
+	script := "#!/bin/sh\necho 'nginx: the configuration file syntax is ok'\n"
+	if !valid {
+		script = "#!/bin/sh\necho 'nginx: [emerg] invalid config'\nexit 1\n"
+	}
+	err := os.WriteFile(filepath.Join(binDir, "nginx"), []byte(script), 0755)
+	assert.NoError(t, err, "Failed to create fake nginx")
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	return &nginx{rootPath: configDir}
+}
+
+func TestRemoveDomainMovesToTrash(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(cacheDir, domain, "privkey.pem"), []byte("key"), 0600))
+
+	service := &Service{
+		configDir:      configDir,
+		cacheDir:       cacheDir,
+		trashDir:       filepath.Join(configDir, "trash"),
+		trashRetention: time.Hour,
+		domains:        []string{domain},
+		nginx:          newFakeNginx(t, configDir, true),
+	}
+
+	err := service.RemoveDomain(domain, "admin@test.com")
+	assert.NoError(t, err, "Expected no error from RemoveDomain")
+	assert.Empty(t, service.domains, "Expected domain to be removed from the list")
+	_, err = os.Stat(filepath.Join(cacheDir, domain))
+	assert.True(t, os.IsNotExist(err), "Expected domain directory to be moved")
+
+	entries, err := service.GetTrash()
+	assert.NoError(t, err, "Expected no error from GetTrash")
+	assert.Len(t, entries, 1, "Expected one trash entry")
+	assert.Equal(t, domain, entries[0].Domain)
+	assert.Equal(t, "admin@test.com", entries[0].RemovedBy)
+	_, err = os.Stat(filepath.Join(service.trashDir, entries[0].ID, "site", "privkey.pem"))
+	assert.NoError(t, err, "Expected certificates to be kept in trash")
+
+	// entries within retention are kept
+	service.purgeExpiredTrash()
+	entries, _ = service.GetTrash()
+	assert.Len(t, entries, 1, "Expected trash entry to be kept within retention")
+
+	service.trashRetention = -time.Second
+	service.purgeExpiredTrash()
+	entries, _ = service.GetTrash()
+	assert.Empty(t, entries, "Expected expired trash entry to be purged")
+}
+
+func TestRemoveDomainRollsBackInvalidConfig(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+
+	service := &Service{
+		configDir: configDir,
+		cacheDir:  cacheDir,
+		trashDir:  filepath.Join(configDir, "trash"),
+		domains:   []string{domain},
+		nginx:     newFakeNginx(t, configDir, false),
+	}
+
+	err := service.RemoveDomain(domain, "admin@test.com")
+	assert.Error(t, err, "Expected error when nginx rejects the config")
+	assert.Equal(t, []string{domain}, service.domains, "Expected domain to stay in the list")
+	_, err = os.Stat(filepath.Join(cacheDir, domain))
+	assert.NoError(t, err, "Expected domain directory to be restored")
+	entries, _ := service.GetTrash()
+	assert.Empty(t, entries, "Expected no trash entry after rollback")
+}
+
+func TestRemoveDomainRefusesReferencedDomain(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	mainConfig := "http {\n    include " + filepath.Join(cacheDir, domain) + "/locations.conf;\n}\n"
+	assert.NoError(t, os.WriteFile(filepath.Join(configDir, "nginx.conf"), []byte(mainConfig), 0644))
+
+	service := &Service{
+		configDir: configDir,
+		cacheDir:  cacheDir,
+		trashDir:  filepath.Join(configDir, "trash"),
+		domains:   []string{domain},
+		nginx:     newFakeNginx(t, configDir, true),
+	}
+
+	err := service.RemoveDomain(domain, "admin@test.com")
+	assert.ErrorContains(t, err, "nginx.conf", "Expected error to name the referencing file")
+	_, err = os.Stat(filepath.Join(cacheDir, domain))
+	assert.NoError(t, err, "Expected domain directory to be kept")
+}
+
+func TestReadTrashEntryRejectsPaths(t *testing.T) {
+	service := &Service{trashDir: t.TempDir()}
+	_, err := service.readTrashEntry("../conf")
+	assert.Error(t, err, "Expected error for path outside of trash")
+}
+
+func TestMoveToTrashTwiceWithinASecond(t *testing.T) {
+	configDir := t.TempDir()
+	cacheDir := filepath.Join(configDir, "conf")
+	domain := "example.com"
+	service := &Service{configDir: configDir, cacheDir: cacheDir, trashDir: filepath.Join(configDir, "trash")}
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	first, err := service.moveToTrash(domain, "admin@test.com")
+	assert.NoError(t, err)
+	assert.NoError(t, os.MkdirAll(filepath.Join(cacheDir, domain), 0755))
+	second, err := service.moveToTrash(domain, "admin@test.com")
+	assert.NoError(t, err)
+	if first.RemovedAt.Truncate(time.Second).Equal(second.RemovedAt.Truncate(time.Second)) {
+		assert.Equal(t, first.ID+"-1", second.ID)
+	}
+	assert.NotEqual(t, first.ID, second.ID)
+
+	// a failed move leaves the earlier entries alone
+	_, err = service.moveToTrash(domain, "admin@test.com")
+	assert.Error(t, err, "Expected the missing domain directory to fail the move")
+	assert.DirExists(t, filepath.Join(service.trashDir, first.ID, "site"))
+	assert.DirExists(t, filepath.Join(service.trashDir, second.ID, "site"))
+	entries, err := service.GetTrash()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -1,9 +1,19 @@
 package server
 
 import (
+	"crypto/sha256"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -39,7 +49,7 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 
 		templates.Render(w, "main", data)
 	})
-	web.router.GET(IS_AUTH, "/", func(w http.ResponseWriter, r *http.Request) {
+	web.router.GET(false, "/", func(w http.ResponseWriter, r *http.Request) {
 		data := make(map[string]interface{})
 		claim := r.Context().Value(ContextKey("claims"))
 		error := ""
@@ -50,12 +60,13 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 
 			data["IsAuth"] = true
 			data["Configs"] = configs
+			data["Setup"] = service.GetSetupStatus()
 			data["Error"] = error
 		}
 		templates.Render(w, "index", data)
 
 	})
-	web.router.GET(IS_AUTH, "/configs", func(w http.ResponseWriter, r *http.Request) {
+	web.router.GET(false, "/configs", func(w http.ResponseWriter, r *http.Request) {
 		data := make(map[string]interface{})
 		claim := r.Context().Value(ContextKey("claims"))
 		error := ""
@@ -104,7 +115,7 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 			name = now.Format("2024-10-01-15-04-05")
 		}
 
-		err, content := service.AddDomain(name)
+		err, content := service.AddDomain(name, strings.Fields(strings.ReplaceAll(r.FormValue("aliases"), ",", " ")), r.FormValue("certSource"))
 		if err != nil {
 			log.Printf("Failed to add domain %s: %v", name, err)
 			error = err.Error()
@@ -160,10 +171,16 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 	web.router.POST(IS_AUTH, "/remove/{domain}", func(w http.ResponseWriter, r *http.Request) {
 		error := ""
 		name := r.PathValue("domain")
-		err := service.RemoveDomain(name)
+		// the editor asks to type the domain name, so a misclick can't remove a site
+		err := errors.New("Removal is not confirmed, type the domain name to remove it")
+		if r.Header.Get("HX-Prompt") == name {
+			err = service.RemoveDomain(name, getUsername(r))
+		}
+		message := name + " is removed and nginx is reloaded"
 		if err != nil {
 			log.Printf("Failed to remove domain %s: %v", name, err)
 			error = err.Error()
+			message = ""
 		}
 
 		configs := service.GetDomains()
@@ -171,6 +188,7 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 		data := map[string]interface{}{
 			"IsAuth":  true,
 			"Configs": configs,
+			"Message": message,
 			"Error":   error,
 		}
 
@@ -178,6 +196,560 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 		templates.SubRender(w, "index", "dashboard", data)
 	})
 
+	// adds the include of managed sites to the main config
+	web.router.POST(IS_AUTH, "/main/include", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		error := ""
+		message := "Main config includes " + managedInclude
+		err := service.EnsureMainInclude()
+		if err != nil {
+			log.Printf("Failed to include managed sites in main config: %v", err)
+			error = err.Error()
+			message = ""
+		}
+
+		data := map[string]interface{}{
+			"IsAuth":  true,
+			"Configs": service.GetDomains(),
+			"Setup":   service.GetSetupStatus(),
+			"Message": message,
+			"Error":   error,
+		}
+		templates.SubRender(w, "index", "dashboard", data)
+	}))
+
+	web.router.GET(IS_AUTH, "/setup", func(w http.ResponseWriter, r *http.Request) {
+		renderSetup(w, templates, service, "", nil)
+	})
+	// creates missing directories and the main config
+	web.router.POST(IS_AUTH, "/setup/layout", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		err := service.CreateLayout()
+		if err == nil {
+			w.Header().Set("HX-Trigger", "refreshConfigs")
+		}
+		renderSetup(w, templates, service, "Config layout is created", err)
+	}))
+
+	web.router.POST(IS_AUTH, "/disable/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		error := ""
+		name := r.PathValue("domain")
+		err := service.DisableDomain(name)
+		if err != nil {
+			log.Printf("Failed to disable domain %s: %v", name, err)
+			error = err.Error()
+		}
+
+		data := map[string]interface{}{
+			"Configs": service.GetDomains(),
+			"Error":   error,
+		}
+		templates.SubRender(w, "index", "configs", data)
+	})
+	web.router.POST(IS_AUTH, "/enable/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		error := ""
+		name := r.PathValue("domain")
+		err := service.EnableDomain(name)
+		if err != nil {
+			log.Printf("Failed to enable domain %s: %v", name, err)
+			error = err.Error()
+		}
+
+		data := map[string]interface{}{
+			"Configs": service.GetDomains(),
+			"Error":   error,
+		}
+		templates.SubRender(w, "index", "configs", data)
+	})
+	web.router.GET(IS_AUTH, "/rename-panel/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]interface{}{
+			"Name": r.PathValue("domain"),
+		}
+		templates.SubRender(w, "index", "renameDomain", data)
+	})
+	web.router.POST(IS_AUTH, "/rename/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		newName := r.FormValue("newName")
+		redirect := r.FormValue("redirect") == "on"
+		err := service.RenameDomain(name, newName, redirect, getUsername(r))
+		if err != nil {
+			log.Printf("Failed to rename domain %s to %s: %v", name, newName, err)
+			data := map[string]interface{}{
+				"Name":    name,
+				"NewName": newName,
+				"Error":   err.Error(),
+			}
+			templates.SubRender(w, "index", "renameDomain", data)
+			return
+		}
+
+		content, err := nginx.GetConfig(newName)
+		error := ""
+		if err != nil {
+			error = err.Error()
+		}
+		data := map[string]interface{}{
+			"Name":    newName,
+			"Content": content,
+			"Error":   error,
+		}
+		w.Header().Set("HX-Trigger", "refreshConfigs")
+		templates.SubRender(w, "index", "editor", data)
+	})
+	web.router.GET(IS_AUTH, "/clone-panel/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]interface{}{
+			"Name": r.PathValue("domain"),
+		}
+		templates.SubRender(w, "index", "cloneDomain", data)
+	})
+	web.router.POST(IS_AUTH, "/clone/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		error := ""
+		source := r.PathValue("domain")
+		name := r.FormValue("name")
+
+		err, content := service.CloneDomain(source, name)
+		if err != nil {
+			log.Printf("Failed to clone domain %s as %s: %v", source, name, err)
+			data := map[string]interface{}{
+				"Name":    source,
+				"NewName": name,
+				"Error":   err.Error(),
+			}
+			templates.SubRender(w, "index", "cloneDomain", data)
+			return
+		}
+		data := map[string]interface{}{
+			"Name":    name,
+			"Content": content,
+			"Error":   error,
+		}
+		w.Header().Set("HX-Trigger", "refreshConfigs")
+		templates.SubRender(w, "index", "editor", data)
+	})
+	web.router.GET(IS_AUTH, "/settings/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		renderSiteSettings(w, templates, service, r.PathValue("domain"), "", nil)
+	})
+	web.router.POST(IS_AUTH, "/settings/{domain}/aliases", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		aliases := strings.Fields(strings.ReplaceAll(r.FormValue("aliases"), ",", " "))
+		err := service.SetAliases(name, aliases)
+		if err != nil {
+			log.Printf("Failed to set aliases of %s: %v", name, err)
+		}
+		renderSiteSettings(w, templates, service, name, "Aliases are saved", err)
+	})
+	web.router.POST(IS_AUTH, "/settings/{domain}/key-type", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		err := service.SetKeyType(name, r.FormValue("keyType"))
+		if err != nil {
+			log.Printf("Failed to set key type of %s: %v", name, err)
+		}
+		renderSiteSettings(w, templates, service, name, "Certificate is issued with the new key type", err)
+	})
+	web.router.POST(IS_AUTH, "/settings/{domain}/ca", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		err := service.SetCA(name, r.FormValue("ca"))
+		if err != nil {
+			log.Printf("Failed to set CA of %s: %v", name, err)
+		}
+		renderSiteSettings(w, templates, service, name, "Certificate is issued by the new CA", err)
+	})
+	web.router.POST(IS_AUTH, "/settings/{domain}/certificate", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		err := uploadCertificate(r, service, name)
+		if err != nil {
+			log.Printf("Failed to upload certificate of %s: %v", name, err)
+		}
+		renderSiteSettings(w, templates, service, name, "Custom certificate is installed", err)
+	})
+	web.router.POST(IS_AUTH, "/settings/{domain}/client-auth", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		r.ParseMultipartForm(1 << 20)
+		var clientAuth *ClientAuthSettings
+		var bundle []byte
+		var err error
+		if mode := r.FormValue("clientAuth"); mode != "" {
+			clientAuth = &ClientAuthSettings{
+				Bundle:    mode == "bundle",
+				Locations: strings.Fields(strings.ReplaceAll(r.FormValue("locations"), ",", " ")),
+			}
+			bundle, err = formFileOrValue(r, "bundle")
+		}
+		if err == nil {
+			err = service.SetClientAuth(name, clientAuth, bundle)
+		}
+		if err != nil {
+			log.Printf("Failed to set client certificates of %s: %v", name, err)
+		}
+		renderSiteSettings(w, templates, service, name, "Client certificate settings are applied", err)
+	}))
+	web.router.GET(IS_AUTH, "/client-certificates", func(w http.ResponseWriter, r *http.Request) {
+		renderClientCertificates(w, templates, service, "", nil, nil)
+	})
+	// issued certificates are accepted by every site verifying clients with the nginx-ui CA
+	web.router.POST(IS_AUTH, "/client-certificates/issue", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		name := r.FormValue("name")
+		p12, err := service.IssueClientCertificate(name, r.FormValue("password"))
+		if err != nil {
+			log.Printf("Failed to issue client certificate for %s: %v", name, err)
+		}
+		renderClientCertificates(w, templates, service, "Client certificate for "+name+" is issued", err, &issuedClientCertificate{Name: name, P12: p12})
+	}))
+	web.router.POST(IS_AUTH, "/client-certificates/revoke/{serial}", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		serial := r.PathValue("serial")
+		err := service.RevokeClientCertificate(serial)
+		if err != nil {
+			log.Printf("Failed to revoke client certificate %s: %v", serial, err)
+		}
+		renderClientCertificates(w, templates, service, "Client certificate "+serial+" is revoked", err, nil)
+	}))
+	web.router.GET(IS_AUTH, "/client-ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		root, err := service.clientCA.authority.RootPEM()
+		if err != nil {
+			log.Printf("Failed to read client CA root: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="nginx-ui-client-ca.pem"`)
+		w.Write(root)
+	})
+	web.router.POST(IS_AUTH, "/settings/{domain}/source", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		err := service.SetCertSource(name, r.FormValue("certSource"))
+		if err != nil {
+			log.Printf("Failed to set certificate source of %s: %v", name, err)
+		}
+		renderSiteSettings(w, templates, service, name, "Certificate is issued from the new source", err)
+	})
+	web.router.GET(IS_AUTH, "/local-ca.pem", func(w http.ResponseWriter, r *http.Request) {
+		root, err := service.cert.LocalCARoot()
+		if err != nil {
+			log.Printf("Failed to read local CA root: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", `attachment; filename="nginx-ui-local-ca.pem"`)
+		w.Write(root)
+	})
+	web.router.POST(IS_AUTH, "/api/certificates/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		err := uploadCertificate(r, service, r.PathValue("domain"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	// exports contain the private key
+	web.router.POST(IS_AUTH, "/api/certificates/{domain}/export", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		export, err := service.ExportCertificate(name, r.FormValue("format"), r.FormValue("password"))
+		if err != nil {
+			log.Printf("Failed to export certificate of %s: %v", name, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Certificate of %s is exported as %s by %s", name, r.FormValue("format"), getUsername(r))
+		w.Header().Set("Content-Type", export.ContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+export.Filename+`"`)
+		w.Write(export.Content)
+	}))
+	web.router.POST(IS_AUTH, "/settings/{domain}/tls-profile", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		err := service.SetTLSProfile(name, r.FormValue("tlsProfile"))
+		if err != nil {
+			log.Printf("Failed to set TLS profile of %s: %v", name, err)
+		}
+		renderSiteSettings(w, templates, service, name, "TLS profile is applied", err)
+	})
+	web.router.POST(IS_AUTH, "/certificates/dhparam", func(w http.ResponseWriter, r *http.Request) {
+		err := service.GenerateDHParams(2048)
+		if err != nil {
+			log.Printf("Failed to generate DH params: %v", err)
+		}
+		renderCertificates(w, templates, service, "DH params are generated and added to the sites", err)
+	})
+	web.router.GET(IS_AUTH, "/certificates", func(w http.ResponseWriter, r *http.Request) {
+		renderCertificates(w, templates, service, "", nil)
+	})
+	web.router.POST(IS_AUTH, "/certificates/renew/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		err := service.RenewCertificate(r.Context(), name)
+		if err != nil {
+			log.Printf("Failed to renew certificate of %s: %v", name, err)
+		}
+		renderCertificates(w, templates, service, "Certificate for "+name+" is renewed", err)
+	})
+	web.router.POST(IS_AUTH, "/certificates/scan/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("domain")
+		result, err := service.ScanDomain(name)
+		message := ""
+		if err != nil {
+			log.Printf("Failed to scan %s: %v", name, err)
+		} else {
+			message = "TLS scan of " + name + ": grade " + result.Grade
+		}
+		renderCertificates(w, templates, service, message, err)
+	})
+	web.router.POST(IS_AUTH, "/api/scan/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		result, err := service.ScanDomain(r.PathValue("domain"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	})
+	web.router.GET(IS_AUTH, "/api/certificates", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(service.GetCertificates())
+	})
+	web.router.GET(IS_AUTH, "/notifications", func(w http.ResponseWriter, r *http.Request) {
+		renderNotifications(w, templates, service, "", nil)
+	})
+	web.router.POST(IS_AUTH, "/notifications/expiry", func(w http.ResponseWriter, r *http.Request) {
+		days, err := strconv.Atoi(r.FormValue("days"))
+		if err != nil {
+			err = errors.New("Expiry warning days must be a number")
+		} else {
+			err = service.SetExpiryWarningDays(days)
+		}
+		renderNotifications(w, templates, service, "Expiry warning is saved", err)
+	})
+	web.router.POST(IS_AUTH, "/notifications/channels", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		port, _ := strconv.Atoi(r.FormValue("smtpPort"))
+		channel := NotificationChannel{
+			Name:           r.FormValue("name"),
+			Type:           r.FormValue("type"),
+			Events:         r.Form["events"],
+			URL:            strings.TrimSpace(r.FormValue("url")),
+			SMTPHost:       strings.TrimSpace(r.FormValue("smtpHost")),
+			SMTPPort:       port,
+			SMTPUsername:   r.FormValue("smtpUsername"),
+			SMTPPassword:   r.FormValue("smtpPassword"),
+			From:           strings.TrimSpace(r.FormValue("from")),
+			To:             strings.Fields(strings.ReplaceAll(r.FormValue("to"), ",", " ")),
+			TelegramToken:  strings.TrimSpace(r.FormValue("telegramToken")),
+			TelegramChatID: strings.TrimSpace(r.FormValue("telegramChatId")),
+		}
+		err := service.AddNotificationChannel(channel)
+		if err != nil {
+			log.Printf("Failed to save notification channel %s: %v", channel.Name, err)
+		}
+		renderNotifications(w, templates, service, "Channel "+channel.Name+" is saved", err)
+	}))
+	web.router.POST(IS_AUTH, "/notifications/channels/{name}/test", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		err := service.TestNotificationChannel(name)
+		renderNotifications(w, templates, service, "Test notification is sent to "+name, err)
+	}))
+	web.router.POST(IS_AUTH, "/notifications/channels/{name}/delete", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		err := service.DeleteNotificationChannel(name)
+		renderNotifications(w, templates, service, "Channel "+name+" is deleted", err)
+	}))
+	web.router.GET(IS_AUTH, "/backup", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		renderBackup(w, templates, service, "", nil, nil, "")
+	}))
+	web.router.POST(IS_AUTH, "/backup/settings", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		settings, err := service.GetBackupSettings()
+		if err == nil {
+			settings.IntervalHours, _ = strconv.Atoi(r.FormValue("intervalHours"))
+			settings.Retention, _ = strconv.Atoi(r.FormValue("retention"))
+			settings.Storage = r.FormValue("storage")
+			settings.Directory = strings.TrimSpace(r.FormValue("directory"))
+			settings.S3.Endpoint = strings.TrimSpace(r.FormValue("s3Endpoint"))
+			settings.S3.Region = strings.TrimSpace(r.FormValue("s3Region"))
+			settings.S3.Bucket = strings.TrimSpace(r.FormValue("s3Bucket"))
+			settings.S3.Prefix = strings.TrimSpace(r.FormValue("s3Prefix"))
+			settings.S3.AccessKey = strings.TrimSpace(r.FormValue("s3AccessKey"))
+			// secrets are not rendered back, empty fields keep the saved ones
+			if secret := r.FormValue("s3SecretKey"); secret != "" {
+				settings.S3.SecretKey = secret
+			}
+			if r.FormValue("clearPassphrase") != "" {
+				settings.Passphrase = ""
+			} else if passphrase := r.FormValue("passphrase"); passphrase != "" {
+				settings.Passphrase = passphrase
+			}
+			err = service.SaveBackupSettings(settings)
+		}
+		if err != nil {
+			log.Printf("Failed to save backup settings: %v", err)
+		}
+		renderBackup(w, templates, service, "Backup settings are saved", err, nil, "")
+	}))
+	web.router.POST(IS_AUTH, "/backup/now", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		backup, err := service.StoreBackup()
+		if err != nil {
+			service.notify(EventBackupFailed, "", err.Error())
+			renderBackup(w, templates, service, "", err, nil, "")
+			return
+		}
+		renderBackup(w, templates, service, "Backup "+backup.Name+" is stored", nil, nil, "")
+	}))
+	web.router.POST(IS_AUTH, "/backup/upload", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(100 << 20)
+		data, err := formFileOrValue(r, "backup")
+		if err == nil && len(data) == 0 {
+			err = errors.New("Backup file is required")
+		}
+		var token string
+		var plan *RestorePlan
+		if err == nil {
+			token, plan, err = service.StageRestore(data, r.FormValue("passphrase"))
+		}
+		renderBackup(w, templates, service, "", err, plan, token)
+	}))
+	web.router.POST(IS_AUTH, "/backup/stored/{name}/restore", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		data, err := service.GetStoredBackup(r.PathValue("name"))
+		var token string
+		var plan *RestorePlan
+		if err == nil {
+			passphrase := r.FormValue("passphrase")
+			if passphrase == "" {
+				if settings, settingsErr := service.GetBackupSettings(); settingsErr == nil {
+					passphrase = settings.Passphrase
+				}
+			}
+			token, plan, err = service.StageRestore(data, passphrase)
+		}
+		renderBackup(w, templates, service, "", err, plan, token)
+	}))
+	web.router.POST(IS_AUTH, "/backup/restore/{token}", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		plan, err := service.RestoreStaged(r.PathValue("token"))
+		if err != nil {
+			log.Printf("Failed to restore backup: %v", err)
+			renderBackup(w, templates, service, "", err, nil, "")
+			return
+		}
+		log.Printf("Backup is restored by %s", getUsername(r))
+		w.Header().Set("HX-Trigger", "refreshConfigs")
+		renderBackup(w, templates, service, fmt.Sprintf("Backup is restored: %d added, %d changed, %d removed", len(plan.Added), len(plan.Changed), len(plan.Removed)), nil, nil, "")
+	}))
+	// backups contain private keys
+	web.router.POST(IS_AUTH, "/api/backup", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		backup, err := service.CreateBackup(r.FormValue("passphrase"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Backup %s is downloaded by %s", backup.Name, getUsername(r))
+		writeBackup(w, backup.Name, backup.Content, backup.Checksum)
+	}))
+	web.router.GET(IS_AUTH, "/api/backup/stored/{name}", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		content, err := service.GetStoredBackup(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		sum := sha256.Sum256(content)
+		writeBackup(w, name, content, hex.EncodeToString(sum[:]))
+	}))
+	// restores an uploaded backup, with dryRun=true only the plan is returned
+	web.router.POST(IS_AUTH, "/api/restore", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseMultipartForm(100 << 20)
+		data, err := formFileOrValue(r, "backup")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var plan *RestorePlan
+		if r.FormValue("dryRun") == "true" {
+			plan, err = service.PreviewRestore(data, r.FormValue("passphrase"))
+		} else {
+			plan, err = service.Restore(data, r.FormValue("passphrase"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+	}))
+	web.router.GET(IS_AUTH, "/import", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		renderImport(w, templates, DefaultImportPatterns, nil, "", nil)
+	}))
+	web.router.POST(IS_AUTH, "/import/preview", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		patterns := strings.Fields(r.FormValue("patterns"))
+		preview, err := service.PreviewImport(patterns)
+		renderImport(w, templates, patterns, preview, "", err)
+	}))
+	// imports the selected sites of existing configs, the config is reloaded
+	web.router.POST(IS_AUTH, "/import/apply", adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		patterns := strings.Fields(r.FormValue("patterns"))
+		imported, err := service.ImportSites(patterns, r.Form["domains"], r.FormValue("mode"))
+		if err != nil {
+			log.Printf("Failed to import sites: %v", err)
+			preview, _ := service.PreviewImport(patterns)
+			renderImport(w, templates, patterns, preview, "", err)
+			return
+		}
+		log.Printf("Sites %v are imported by %s", imported, getUsername(r))
+		w.Header().Set("HX-Trigger", "refreshConfigs")
+		preview, _ := service.PreviewImport(patterns)
+		renderImport(w, templates, patterns, preview, "Imported "+strings.Join(imported, ", "), nil)
+	}))
+	web.router.GET(IS_AUTH, "/trash", func(w http.ResponseWriter, r *http.Request) {
+		renderTrash(w, templates, service, "", nil)
+	})
+	web.router.POST(IS_AUTH, "/trash/restore/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		err := service.RestoreFromTrash(id)
+		if err != nil {
+			log.Printf("Failed to restore %s from trash: %v", id, err)
+		}
+		w.Header().Set("HX-Trigger", "refreshConfigs")
+		renderTrash(w, templates, service, "Restored "+id, err)
+	})
+	web.router.POST(IS_AUTH, "/trash/purge/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		err := service.PurgeFromTrash(id)
+		if err != nil {
+			log.Printf("Failed to purge %s from trash: %v", id, err)
+		}
+		renderTrash(w, templates, service, "Purged "+id, err)
+	})
+	web.router.GET(IS_AUTH, "/bulk-replace-panel", func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]interface{}{
+			"Configs": service.GetDomains(),
+		}
+		templates.SubRender(w, "index", "bulkReplace", data)
+	})
+	web.router.POST(IS_AUTH, "/bulk-replace/preview", func(w http.ResponseWriter, r *http.Request) {
+		error := ""
+		changes, err := service.PreviewBulkReplace(parseBulkReplace(r))
+		if err != nil {
+			log.Printf("Failed to preview bulk replace: %v", err)
+			error = err.Error()
+		}
+
+		data := map[string]interface{}{
+			"Changes": changes,
+			"Error":   error,
+		}
+		templates.SubRender(w, "index", "bulkResult", data)
+	})
+	web.router.POST(IS_AUTH, "/bulk-replace/apply", func(w http.ResponseWriter, r *http.Request) {
+		error := ""
+		changes, err := service.ApplyBulkReplace(parseBulkReplace(r))
+		status := "applied"
+		if err != nil {
+			log.Printf("Failed to apply bulk replace: %v", err)
+			error = err.Error()
+			status = "rolled back"
+		}
+
+		data := map[string]interface{}{
+			"Changes": changes,
+			"Status":  status,
+			"Error":   error,
+		}
+		templates.SubRender(w, "index", "bulkResult", data)
+	})
+
 	web.router.POST(false, "/login", func(w http.ResponseWriter, r *http.Request) {
 		//validate email and password
 		email := r.FormValue("email")
@@ -195,8 +767,9 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 
 			data["IsAuth"] = true
 			data["Configs"] = configs
+			data["Setup"] = service.GetSetupStatus()
 			data["Error"] = error
-			SetAuthCookie(w, r.FormValue("email"))
+			SetAuthCookie(w, r.FormValue("email"), RoleAdmin)
 			templates.SubRender(w, "index", "main", data)
 		}
 	})
@@ -211,6 +784,255 @@ func NewWeb(nginx *nginx, service *Service, config *Config, embedFs embed.FS) *W
 	return web
 }
 
+func renderCertificates(w http.ResponseWriter, templates *Template, service *Service, message string, err error) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+
+	data := map[string]interface{}{
+		"Certificates": service.GetCertificates(),
+		"Message":      message,
+		"Error":        error,
+	}
+	templates.SubRender(w, "index", "certificates", data)
+}
+
+func renderTrash(w http.ResponseWriter, templates *Template, service *Service, message string, err error) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+	entries, listErr := service.GetTrash()
+	if listErr != nil {
+		error = listErr.Error()
+	}
+
+	data := map[string]interface{}{
+		"Entries":   entries,
+		"Retention": service.trashRetention,
+		"Message":   message,
+		"Error":     error,
+	}
+	templates.SubRender(w, "index", "trash", data)
+}
+
+func renderSiteSettings(w http.ResponseWriter, templates *Template, service *Service, domain string, message string, err error) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+	settings, settingsErr := service.GetSiteSettings(domain)
+	if settingsErr != nil {
+		error = settingsErr.Error()
+		settings = &SiteSettings{}
+	}
+
+	data := map[string]interface{}{
+		"Name":      domain,
+		"Settings":  settings,
+		"Aliases":   strings.Join(settings.Aliases, " "),
+		"Locations": "",
+		"CAs":       service.cert.CANames(),
+		"Profiles":  TLSProfileNames,
+		"Default":   service.tlsProfile,
+		"Message":   message,
+		"Error":     error,
+	}
+	if settings.ClientAuth != nil {
+		data["Locations"] = strings.Join(settings.ClientAuth.Locations, " ")
+	}
+	templates.SubRender(w, "index", "siteSettings", data)
+}
+
+func renderNotifications(w http.ResponseWriter, templates *Template, service *Service, message string, err error) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+	settings, settingsErr := service.GetNotificationSettings()
+	if settingsErr != nil {
+		error = settingsErr.Error()
+		settings = &NotificationSettings{}
+	}
+
+	data := map[string]interface{}{
+		"Settings": settings,
+		"Events":   NotificationEvents,
+		"Types":    NotificationChannelTypes,
+		"Message":  message,
+		"Error":    error,
+	}
+	templates.SubRender(w, "index", "notifications", data)
+}
+
+func renderBackup(w http.ResponseWriter, templates *Template, service *Service, message string, err error, plan *RestorePlan, token string) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+	data := map[string]interface{}{
+		"Settings": &BackupSettings{},
+		"Storages": []string{BackupStorageLocal, BackupStorageS3},
+		"Plan":     plan,
+		"Token":    token,
+		"Message":  message,
+		"Error":    error,
+	}
+	settings, settingsErr := service.GetBackupSettings()
+	if settingsErr == nil {
+		data["Settings"] = settings
+	} else if error == "" {
+		error = settingsErr.Error()
+	}
+	backups, listErr := service.ListStoredBackups()
+	if listErr != nil && error == "" {
+		error = "Failed to list backups: " + listErr.Error()
+	}
+	data["Backups"] = backups
+	data["Error"] = error
+	templates.SubRender(w, "index", "backup", data)
+}
+
+func renderSetup(w http.ResponseWriter, templates *Template, service *Service, message string, err error) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+	data := map[string]interface{}{
+		"Setup":   service.CheckSetup(),
+		"Message": message,
+		"Error":   error,
+	}
+	templates.SubRender(w, "index", "setup", data)
+}
+
+func renderImport(w http.ResponseWriter, templates *Template, patterns []string, preview *ImportPreview, message string, err error) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+	data := map[string]interface{}{
+		"Patterns": strings.Join(patterns, "\n"),
+		"Preview":  preview,
+		"Message":  message,
+		"Error":    error,
+	}
+	templates.SubRender(w, "index", "import", data)
+}
+
+// writeBackup sends a backup as attachment with its SHA-256 checksum in a header
+func writeBackup(w http.ResponseWriter, name string, content []byte, checksum string) {
+	contentType := "application/gzip"
+	if strings.HasSuffix(name, ".age") {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	w.Header().Set("X-Checksum-Sha256", checksum)
+	w.Write(content)
+}
+
+// issuedClientCertificate is offered for download once, the key is not kept
+type issuedClientCertificate struct {
+	Name string
+	P12  []byte
+}
+
+func renderClientCertificates(w http.ResponseWriter, templates *Template, service *Service, message string, err error, issued *issuedClientCertificate) {
+	error := ""
+	if err != nil {
+		error = err.Error()
+		message = ""
+	}
+	clients, listErr := service.GetClientCertificates()
+	if listErr != nil && error == "" {
+		error = listErr.Error()
+	}
+
+	data := map[string]interface{}{
+		"Clients": clients,
+		"Message": message,
+		"Error":   error,
+	}
+	if err == nil && issued != nil {
+		data["Download"] = template.URL("data:application/x-pkcs12;base64," + base64.StdEncoding.EncodeToString(issued.P12))
+		data["DownloadName"] = issued.Name + ".p12"
+	}
+	templates.SubRender(w, "index", "clientCertificates", data)
+}
+
+// uploadCertificate installs a certificate from a form with either a PEM
+// "cert" and "key" or a PKCS#12 "p12" with its "password", as files or text
+func uploadCertificate(r *http.Request, service *Service, domain string) error {
+	r.ParseMultipartForm(10 << 20)
+	p12, err := formFileOrValue(r, "p12")
+	if err != nil {
+		return err
+	}
+	if len(p12) > 0 {
+		return service.UploadPKCS12(domain, p12, r.FormValue("password"))
+	}
+	cert, err := formFileOrValue(r, "cert")
+	if err != nil {
+		return err
+	}
+	key, err := formFileOrValue(r, "key")
+	if err != nil {
+		return err
+	}
+	if len(cert) == 0 || len(key) == 0 {
+		return errors.New("Certificate and private key are required")
+	}
+	return service.UploadCertificate(domain, cert, key)
+}
+
+// formFileOrValue returns an uploaded file or, without file, the form value of the same name
+func formFileOrValue(r *http.Request, name string) ([]byte, error) {
+	file, _, err := r.FormFile(name)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return []byte(r.FormValue(name)), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// getUsername returns the name of the logged in user from the auth claims
+func getUsername(r *http.Request) string {
+	claims, ok := r.Context().Value(ContextKey("claims")).(map[string]string)
+	if !ok {
+		return ""
+	}
+	return claims["username"]
+}
+
+// isAdmin reports whether the logged in user has the admin role
+func isAdmin(r *http.Request) bool {
+	claims, ok := r.Context().Value(ContextKey("claims")).(map[string]string)
+	return ok && claims["role"] == RoleAdmin
+}
+
+func parseBulkReplace(r *http.Request) BulkReplace {
+	r.ParseForm()
+	return BulkReplace{
+		Domains:   r.Form["domains"],
+		Mode:      r.FormValue("mode"),
+		Directive: r.FormValue("directive"),
+		Find:      r.FormValue("find"),
+		Replace:   r.FormValue("replace"),
+	}
+}
+
 // GetRouter returns the underlying http.ServeMux
 func (web *Web) GetRouter() *http.ServeMux {
 	return web.router.mux
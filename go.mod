@@ -11,11 +11,12 @@ require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.2 // indirect
+	golang.org/x/sys v0.28.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 require (
+	filippo.io/age v1.2.1
 	golang.org/x/crypto v0.30.0
-	golang.org/x/net v0.30.0 // indirect
-	golang.org/x/text v0.21.0 // indirect
+	software.sslmate.com/src/go-pkcs12 v0.5.0
 )